@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/pem"
@@ -15,12 +16,17 @@ import (
 	"net/http"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/api"
 	"github.com/rnzor/poor_man_exe/internal/auth"
 	"github.com/rnzor/poor_man_exe/internal/caddy"
 	"github.com/rnzor/poor_man_exe/internal/config"
 	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/reconcile"
 	"github.com/rnzor/poor_man_exe/internal/router"
 	"github.com/rnzor/poor_man_exe/internal/runner"
+	"github.com/rnzor/poor_man_exe/internal/service"
+	"github.com/rnzor/poor_man_exe/internal/sessions"
+	"github.com/rnzor/poor_man_exe/internal/webauth"
 	gossh "golang.org/x/crypto/ssh"
 )
 
@@ -34,38 +40,82 @@ func main() {
 	}
 	defer database.Close()
 
-	// Init DB schema (embedded)
-	if err := database.Init(); err != nil {
-		log.Printf("Warning: Failed to init schema (may already exist): %v", err)
+	// Bring the schema up to date (embedded migrations)
+	applied, err := database.Migrate()
+	if err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
 	}
 
 	// Init Docker runner
-	dockerRunner, err := runner.NewDockerRunner()
+	dockerRunner, err := runner.NewDockerRunner(cfg.DockerNetwork)
 	if err != nil {
 		log.Fatalf("Failed to init Docker runner: %v", err)
 	}
+	if err := dockerRunner.EnsureNetwork(context.Background()); err != nil {
+		log.Fatalf("Failed to create Docker network %s: %v", cfg.DockerNetwork, err)
+	}
 
 	// Init Authenticator, Caddy, and Router
-	authenticator := auth.NewAuthenticator(database)
-	caddyClient := caddy.NewClient(cfg.CaddyURL)
-	rtr := router.NewRouter(database, dockerRunner, cfg, caddyClient)
+	authenticator := auth.NewAuthenticator(database, cfg)
+	if cfg.UserCAKeysPath != "" {
+		if authenticator.UserCAs, err = auth.LoadUserCAKeys(cfg.UserCAKeysPath); err != nil {
+			log.Fatalf("Failed to load user CA keys: %v", err)
+		}
+		log.Printf("Trusting %d user CA key(s) from %s", len(authenticator.UserCAs), cfg.UserCAKeysPath)
+	}
+	ca, err := auth.LoadOrCreateCA(cfg.CAKeyPath)
+	if err != nil {
+		log.Fatalf("Failed to load CA key: %v", err)
+	}
+	authenticator.GatewayCA = ca.PublicKey()
+	caddyClient := caddy.NewClient(cfg.CaddyURL, cfg.AuthUpstream)
+	registry := sessions.NewRegistry(cfg.MaxSessionsPerKey)
+	rtr := router.NewRouter(database, dockerRunner, cfg, caddyClient, registry)
+
+	// Reconcile the registry with Docker and Caddy on startup and periodically,
+	// so routes lost in a Caddy restart come back
+	reconciler := reconcile.New(database, dockerRunner, caddyClient, cfg)
+	go func() {
+		for {
+			if rep, err := reconciler.Run(context.Background(), false); err != nil {
+				log.Printf("Reconcile failed: %v", err)
+			} else {
+				rep.Log()
+			}
+			if cfg.ReconcileInterval <= 0 {
+				return
+			}
+			time.Sleep(time.Duration(cfg.ReconcileInterval) * time.Second)
+		}
+	}()
 
 	// Start rate limiter cleanup goroutine
 	go func() {
 		for range time.Tick(5 * time.Minute) {
 			authenticator.Limiter.Cleanup()
+			authenticator.Bans.Cleanup()
 		}
 	}()
 
-	// Start health check server
+	// Expose the login pages for private apps
+	if err := caddyClient.UpsertAuthRoute(cfg.AuthHost); err != nil {
+		log.Printf("Warning: Failed to configure auth route in Caddy: %v", err)
+	}
+
+	// Start health check, auth and API server
 	go func() {
 		http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("OK"))
 		})
-		log.Printf("Starting health check server on :8080...")
-		if err := http.ListenAndServe(":8080", nil); err != nil {
-			log.Printf("Health check server failed: %v", err)
+		webauth.NewServer(database, cfg).Register(http.DefaultServeMux)
+		api.NewServer(service.New(database, dockerRunner, caddyClient, cfg)).Register(http.DefaultServeMux)
+		log.Printf("Starting HTTP server on :%d...", cfg.HTTPPort)
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.HTTPPort), nil); err != nil {
+			log.Printf("HTTP server failed: %v", err)
 		}
 	}()
 
@@ -73,8 +123,19 @@ func main() {
 	server := &ssh.Server{
 		Addr: fmt.Sprintf(":%d", cfg.SSHPort),
 		Handler: func(sess ssh.Session) {
-			defer authenticator.OnSessionClose(sess)
-			rtr.HandleSession(sess)
+			if err := authenticator.OnSessionStart(sess); err != nil {
+				fmt.Fprintf(sess, "Error: %v\n", err)
+				sess.Exit(1)
+				return
+			}
+			s, err := registry.Add(sess, router.Target(sess.User()))
+			if err != nil {
+				fmt.Fprintf(sess, "Error: %v\n", err)
+				sess.Exit(1)
+				return
+			}
+			defer registry.Remove(s.ID)
+			rtr.HandleSession(s.Wrap(sess))
 		},
 		PublicKeyHandler: authenticator.PublicKeyHandler,
 		BannerHandler:    authenticator.BannerHandler,
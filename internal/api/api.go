@@ -0,0 +1,434 @@
+// Package api serves a REST mirror of the SSH CLI. Requests authenticate with
+// tokens from 'tokens create' and get the same cli.Response envelope as the
+// CLI's --json output.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rnzor/poor_man_exe/internal/cli"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/runner"
+	"github.com/rnzor/poor_man_exe/internal/service"
+)
+
+// maxBodySize bounds request bodies; key imports are the largest
+const maxBodySize = 2 * service.MaxKeysSize
+
+// Server handles /api/ requests through the same service layer as the CLI
+type Server struct {
+	Svc *service.Service
+}
+
+func NewServer(svc *service.Service) *Server {
+	return &Server{Svc: svc}
+}
+
+// Register mounts the API endpoints on mux
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/apps", s.auth(s.handleListApps))
+	mux.HandleFunc("POST /api/apps", s.auth(s.handleCreateApp))
+	mux.HandleFunc("GET /api/apps/{name}", s.auth(s.handleDescribeApp))
+	mux.HandleFunc("DELETE /api/apps/{name}", s.auth(s.handleDeleteApp))
+	mux.HandleFunc("POST /api/apps/{name}/{op}", s.auth(s.handleLifecycle))
+	mux.HandleFunc("GET /api/apps/{name}/logs", s.auth(s.handleLogs))
+	mux.HandleFunc("GET /api/apps/{name}/images", s.auth(s.handleListImages))
+	mux.HandleFunc("GET /api/apps/{name}/releases", s.auth(s.handleListReleases))
+	mux.HandleFunc("POST /api/apps/{name}/rollback", s.auth(s.handleRollback))
+	mux.HandleFunc("POST /api/apps/{name}/share", s.auth(s.handleShare))
+	mux.HandleFunc("GET /api/apps/{name}/deploy-config", s.auth(s.handleGetDeployConfig))
+	mux.HandleFunc("PUT /api/apps/{name}/deploy-config", s.auth(s.handleSetDeployConfig))
+	mux.HandleFunc("GET /api/apps/{name}/env", s.auth(s.handleListEnv))
+	mux.HandleFunc("PUT /api/apps/{name}/env", s.auth(s.handleSetEnv))
+	mux.HandleFunc("DELETE /api/apps/{name}/env/{key}", s.auth(s.handleUnsetEnv))
+	mux.HandleFunc("GET /api/keys", s.auth(s.handleListKeys))
+	mux.HandleFunc("POST /api/keys", s.auth(s.handleImportKeys))
+	mux.HandleFunc("DELETE /api/keys/{fingerprint...}", s.auth(s.handleRemoveKey))
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusNotFound, cli.Response{Error: "unknown endpoint", Code: "not_found"})
+	})
+}
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, sub policy.Subject)
+
+// auth resolves the bearer token to the subject the handler acts as
+func (s *Server) auth(h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeResponse(w, http.StatusUnauthorized, cli.Response{Error: "missing bearer token", Code: "unauthorized"})
+			return
+		}
+		sub, err := s.Svc.TokenSubject(strings.TrimSpace(token), r.RemoteAddr)
+		if errors.Is(err, service.ErrInvalidToken) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeResponse(w, http.StatusUnauthorized, cli.Response{Error: err.Error(), Code: "unauthorized"})
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		h(w, r, sub)
+	}
+}
+
+func (s *Server) handleListApps(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	apps, err := s.Svc.ListApps(r.Context(), sub)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Data: map[string]interface{}{"vms": apps}})
+}
+
+func (s *Server) handleCreateApp(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	var req service.NewApp
+	if !decode(w, r, &req) {
+		return
+	}
+	app, warnings, err := s.Svc.CreateApp(r.Context(), sub, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, http.StatusCreated, cli.Response{
+		Success:  true,
+		Message:  fmt.Sprintf("Successfully created app '%s'", app.Name),
+		Data:     app,
+		Warnings: warnings,
+	})
+}
+
+func (s *Server) handleDescribeApp(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	app, err := s.Svc.DescribeApp(r.Context(), sub, r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Data: app})
+}
+
+func (s *Server) handleDeleteApp(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	name := r.PathValue("name")
+	warnings, err := s.Svc.DeleteApp(r.Context(), sub, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Message: fmt.Sprintf("Successfully removed app '%s'", name), Warnings: warnings})
+}
+
+// handleLifecycle serves POST /api/apps/{name}/start, stop and restart
+func (s *Server) handleLifecycle(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	name, op := r.PathValue("name"), r.PathValue("op")
+	verb, ok := map[string]string{"start": "started", "stop": "stopped", "restart": "restarted"}[op]
+	if !ok {
+		writeResponse(w, http.StatusNotFound, cli.Response{Error: "unknown endpoint", Code: "not_found"})
+		return
+	}
+	status, warnings, err := s.Svc.Lifecycle(r.Context(), sub, op, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{
+		Message:  fmt.Sprintf("Successfully %s app '%s'", verb, name),
+		Data:     map[string]string{"vm_name": name, "status": status},
+		Warnings: warnings,
+	})
+}
+
+// handleLogs streams LogLine records as NDJSON, like 'logs --json'. Errors
+// before the first line get a normal error response; later ones are sent as
+// a final NDJSON Response.
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	q := r.URL.Query()
+	opts := runner.LogOptions{
+		Follow:     q.Get("follow") == "true",
+		Timestamps: q.Get("timestamps") == "true",
+		Since:      q.Get("since"),
+		Tail:       q.Get("tail"),
+	}
+
+	out := &streamWriter{w: w}
+	err := cli.StreamLogsJSON(out, opts.Timestamps, func(stdout, stderr io.Writer) error {
+		return s.Svc.Logs(r.Context(), sub, r.PathValue("name"), opts, stdout, stderr)
+	})
+	if err != nil {
+		if !out.started {
+			writeError(w, err)
+			return
+		}
+		cli.WriteNDJSON(out, cli.ErrorResponse(err))
+	}
+}
+
+func (s *Server) handleShare(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	var req struct {
+		Cmd   string `json:"cmd"` // set-public, set-private, port, add or remove
+		Value string `json:"value"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	name := r.PathValue("name")
+	if err := s.Svc.Share(r.Context(), sub, req.Cmd, name, req.Value); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Message: fmt.Sprintf("Successfully updated sharing for '%s'", name)})
+}
+
+func (s *Server) handleGetDeployConfig(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	conf, err := s.Svc.GetDeployConfig(sub, r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Data: conf})
+}
+
+// handleSetDeployConfig takes the settings to change as a JSON object, e.g.
+// {"health": "http:/healthz"}
+func (s *Server) handleSetDeployConfig(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	var settings map[string]string
+	if !decode(w, r, &settings) {
+		return
+	}
+	name := r.PathValue("name")
+	if err := s.Svc.SetDeployConfig(sub, name, settings); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Message: fmt.Sprintf("Updated deploy settings for '%s'", name)})
+}
+
+func (s *Server) handleListImages(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	images, err := s.Svc.ListImages(sub, r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Data: map[string]interface{}{"images": images}})
+}
+
+func (s *Server) handleListReleases(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	releases, err := s.Svc.ListReleases(sub, r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Data: map[string]interface{}{"releases": releases}})
+}
+
+// handleRollback takes an optional body {"to": <release>}; without it the
+// app goes back to the release before the current one
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	var req struct {
+		To int `json:"to"`
+	}
+	if r.ContentLength != 0 && !decode(w, r, &req) {
+		return
+	}
+	name := r.PathValue("name")
+	rel, warnings, err := s.Svc.Rollback(r.Context(), sub, name, req.To)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{
+		Message:  fmt.Sprintf("Rolled back '%s' (%s), now release %d", name, rel.Reason, rel.Version),
+		Data:     rel,
+		Warnings: warnings,
+	})
+}
+
+func (s *Server) handleListEnv(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	vars, err := s.Svc.ListEnv(sub, r.PathValue("name"), r.URL.Query().Get("show") == "true")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Data: map[string]interface{}{"env": vars}})
+}
+
+func (s *Server) handleSetEnv(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	var req struct {
+		Vars     map[string]string `json:"vars"`
+		Secret   bool              `json:"secret"`
+		Recreate bool              `json:"recreate"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	var pairs []string
+	for k, v := range req.Vars {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+
+	name := r.PathValue("name")
+	keys, err := s.Svc.SetEnv(sub, name, pairs, req.Secret)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.applyEnv(w, r, sub, name, keys, req.Recreate)
+}
+
+// handleUnsetEnv serves DELETE /api/apps/{name}/env/{key}[?recreate=true]
+func (s *Server) handleUnsetEnv(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	name, keys := r.PathValue("name"), []string{r.PathValue("key")}
+	if err := s.Svc.UnsetEnv(sub, name, keys); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.applyEnv(w, r, sub, name, keys, r.URL.Query().Get("recreate") == "true")
+}
+
+// applyEnv optionally recreates the container after an env change and
+// writes the same response as 'env set --json'
+func (s *Server) applyEnv(w http.ResponseWriter, r *http.Request, sub policy.Subject, name string, keys []string, recreate bool) {
+	var warnings []string
+	if recreate {
+		var err error
+		if warnings, err = s.Svc.ApplyEnv(r.Context(), sub, name); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	writeOK(w, cli.Response{
+		Message:  fmt.Sprintf("Updated environment for '%s'", name),
+		Data:     map[string]interface{}{"vm_name": name, "keys": keys, "recreated": recreate},
+		Warnings: warnings,
+	})
+}
+
+func (s *Server) handleListKeys(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	keys, err := s.Svc.ListKeys(sub)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Data: map[string]interface{}{"keys": keys}})
+}
+
+// handleImportKeys adds keys from an authorized_keys body or a forge user,
+// like 'keys add' and 'keys import'
+func (s *Server) handleImportKeys(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	var req struct {
+		Keys    string   `json:"keys"`  // authorized_keys lines
+		Forge   string   `json:"forge"` // or a forge username or <user>.keys URL
+		Expires string   `json:"expires"`
+		Apps    []string `json:"apps"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	var limits service.KeyLimits
+	if req.Expires != "" {
+		ttl, err := cli.ParseDuration(req.Expires)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		limits.Expires = ttl
+	}
+	limits.Apps = req.Apps
+
+	data, source := []byte(req.Keys), "api"
+	if req.Forge != "" {
+		var err error
+		if data, source, err = s.Svc.ForgeKeys(r.Context(), req.Forge); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	results, added, err := s.Svc.ImportKeys(sub, data, source, limits)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := http.StatusCreated
+	if added == 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	writeResponse(w, status, cli.Response{
+		Success: added > 0,
+		Message: fmt.Sprintf("Added %d of %d keys", added, len(results)),
+		Data:    map[string]interface{}{"keys": results, "added": added},
+	})
+}
+
+// handleRemoveKey serves DELETE /api/keys/{fingerprint}. Clients should
+// escape the fingerprint, since base64 may contain "//" which the mux cleans.
+func (s *Server) handleRemoveKey(w http.ResponseWriter, r *http.Request, sub policy.Subject) {
+	if err := s.Svc.RemoveKey(sub, r.PathValue("fingerprint")); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, cli.Response{Message: "Key removed"})
+}
+
+// decode reads a JSON request body into v, writing the error response if it
+// can't
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeResponse(w, http.StatusBadRequest, cli.Response{Error: "invalid request body: " + err.Error(), Code: "bad_request"})
+		return false
+	}
+	return true
+}
+
+func writeOK(w http.ResponseWriter, resp cli.Response) {
+	resp.Success = true
+	writeResponse(w, http.StatusOK, resp)
+}
+
+// writeError maps policy denials to 403 and every other failure to 400,
+// with the same envelope the CLI prints for --json
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	var denied *policy.DeniedError
+	if errors.As(err, &denied) {
+		status = http.StatusForbidden
+	}
+	writeResponse(w, status, cli.ErrorResponse(err))
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp cli.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	cli.WriteResponse(w, resp)
+}
+
+// streamWriter sends NDJSON as it is written, committing the response
+// status on the first write
+type streamWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if !s.started {
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+		s.started = true
+	}
+	n, err := s.w.Write(p)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
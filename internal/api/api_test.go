@@ -0,0 +1,118 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/cli"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/service"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestAPI(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com'), (2, 'bob@example.com')")
+	d.Conn.Exec("INSERT INTO apps (name, user_id) VALUES ('bloggy', 2)")
+
+	svc := service.New(d, nil, nil, &config.Config{})
+	token, _, err := svc.CreateToken(policy.Subject{UserID: 1}, "ci", 0)
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+	if _, _, err := svc.CreateToken(policy.Subject{UserID: 1, Apps: []string{"bloggy"}}, "limited", 0); err == nil {
+		t.Error("App-limited subjects should not create tokens")
+	}
+
+	mux := http.NewServeMux()
+	NewServer(svc).Register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	do := func(method, path, auth, body string) (int, cli.Response) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var out cli.Response
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	if status, resp := do("GET", "/api/keys", "", ""); status != http.StatusUnauthorized || resp.Code != "unauthorized" {
+		t.Errorf("Expected 401 without token, got %d %+v", status, resp)
+	}
+	if status, _ := do("GET", "/api/keys", service.TokenPrefix+"bogus", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for unknown token, got %d", status)
+	}
+
+	// Keys round trip
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := gossh.NewPublicKey(pub)
+	line := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))) + " laptop"
+	body, _ := json.Marshal(map[string]interface{}{"keys": line, "expires": "30d"})
+	if status, resp := do("POST", "/api/keys", token, string(body)); status != http.StatusCreated || !resp.Success {
+		t.Errorf("Expected key import to succeed, got %d %+v", status, resp)
+	}
+	fp := gossh.FingerprintSHA256(key)
+	if status, resp := do("DELETE", "/api/keys/"+url.PathEscape(fp), token, ""); status != http.StatusOK || !resp.Success {
+		t.Errorf("Expected key removal to succeed, got %d %+v", status, resp)
+	}
+	if status, _ := do("DELETE", "/api/keys/"+url.PathEscape(fp), token, ""); status != http.StatusBadRequest {
+		t.Errorf("Expected removing a missing key to fail, got %d", status)
+	}
+
+	// Policy denials get the same envelope as the CLI
+	status, resp := do("GET", "/api/apps/bloggy/env", token, "")
+	if status != http.StatusForbidden || resp.Code != "access_denied" {
+		t.Errorf("Expected 403 access_denied for another user's app, got %d %+v", status, resp)
+	}
+	if status, _ := do("POST", "/api/keys", token, `{"bogus": 1}`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown fields, got %d", status)
+	}
+	if status, resp := do("GET", "/api/nope", token, ""); status != http.StatusNotFound || resp.Code != "not_found" {
+		t.Errorf("Expected 404 for unknown endpoint, got %d %+v", status, resp)
+	}
+
+	// Revoked tokens stop working
+	if err := svc.RevokeToken(policy.Subject{UserID: 1}, "ci"); err != nil {
+		t.Fatalf("RevokeToken failed: %v", err)
+	}
+	if status, _ := do("GET", "/api/keys", token, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 after revoke, got %d", status)
+	}
+
+	// So do tokens of disabled users
+	bobToken, _, err := svc.CreateToken(policy.Subject{UserID: 2}, "ci", 0)
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+	if status, _ := do("GET", "/api/keys", bobToken, ""); status != http.StatusOK {
+		t.Errorf("Expected 200 before disabling, got %d", status)
+	}
+	d.Conn.Exec("UPDATE users SET disabled = TRUE WHERE id = 2")
+	if status, _ := do("GET", "/api/keys", bobToken, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a disabled user, got %d", status)
+	}
+}
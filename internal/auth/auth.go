@@ -1,79 +1,154 @@
 package auth
 
 import (
+	"bytes"
 	"net"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/config"
 	"github.com/rnzor/poor_man_exe/internal/db"
 	gossh "golang.org/x/crypto/ssh"
 )
 
+// RegisterUser is the SSH username that lets unknown keys in to sign up.
+// Requiring it keeps a client's unregistered key from being accepted ahead
+// of a registered one it would have offered next.
+const RegisterUser = "register"
+
 type Authenticator struct {
-	DB          *db.Database
-	Limiter     *RateLimiter
-	Sessions    map[string]int // fingerprint -> count
-	SessionMu   sync.Mutex
-	MaxSessions int
+	DB               *db.Database
+	Limiter          *RateLimiter
+	Bans             *Banlist
+	IPv6Prefix       int // clients in the same IPv6 prefix share limits and bans
+	RegistrationMode string
+
+	// The gateway's own CA, which signs certificates from `keys sign`
+	GatewayCA gossh.PublicKey
+
+	// Trusted user CAs and how certificate principals map to users
+	UserCAs             []gossh.PublicKey
+	CertPrincipalDomain string
+	CertAutoProvision   bool
 }
 
-func NewAuthenticator(d *db.Database) *Authenticator {
+func NewAuthenticator(d *db.Database, cfg *config.Config) *Authenticator {
+	bans := NewBanlist(d, cfg.BanMaxFailures,
+		time.Duration(cfg.BanDuration)*time.Second, time.Duration(cfg.BanMaxDuration)*time.Second)
+
 	return &Authenticator{
-		DB:          d,
-		Limiter:     NewRateLimiter(0.1, 5.0), // 1 conn every 10s, burst of 5
-		Sessions:    make(map[string]int),
-		MaxSessions: 10,
+		DB:               d,
+		Limiter:          NewRateLimiter(0.1, 5.0), // 1 conn every 10s, burst of 5
+		Bans:             bans,
+		IPv6Prefix:       cfg.RateLimitIPv6Prefix,
+		RegistrationMode: cfg.RegistrationMode,
+
+		CertPrincipalDomain: cfg.CertPrincipalDomain,
+		CertAutoProvision:   cfg.CertAutoProvision,
 	}
 }
 
+// sessionValues are the context values an authentication attempt sets. Each
+// attempt starts from a clean slate so nothing carries over from a key the
+// client offered earlier but couldn't sign with.
+var sessionValues = []string{"user_id", "fingerprint", "key_id", "key_options", "allowed_apps", "restrictions",
+	"registering", "key_data", "provision_email", "cert_serial", "cert_key_id", "cert_principal"}
+
 func (a *Authenticator) PublicKeyHandler(ctx ssh.Context, key ssh.PublicKey) bool {
 	fingerprint := gossh.FingerprintSHA256(key)
+	for _, name := range sessionValues {
+		ctx.SetValue(name, nil)
+	}
 
-	// Check session cap
-	a.SessionMu.Lock()
-	count := a.Sessions[fingerprint]
-	if count >= a.MaxSessions {
-		a.SessionMu.Unlock()
+	// Count rejected keys towards a ban. Accepting a key here doesn't clear
+	// the count: this also runs for keys a client only offers without
+	// proving it holds them, and public keys are public. OnSessionStart
+	// clears it once the handshake has really succeeded.
+	if !a.authenticate(ctx, key, fingerprint) {
+		a.Bans.RecordFailure(ClientKey(ctx.RemoteAddr(), a.IPv6Prefix))
 		return false
 	}
-	a.Sessions[fingerprint] = count + 1
-	a.SessionMu.Unlock()
+	return true
+}
+
+func (a *Authenticator) authenticate(ctx ssh.Context, key ssh.PublicKey, fingerprint string) bool {
+	if cert, ok := key.(*gossh.Certificate); ok {
+		if a.GatewayCA != nil && bytes.Equal(cert.SignatureKey.Marshal(), a.GatewayCA.Marshal()) {
+			return a.gatewayCertHandler(ctx, cert, fingerprint)
+		}
+		return a.certHandler(ctx, cert, fingerprint)
+	}
 
-	var userID int
-	err := a.DB.Conn.QueryRow("SELECT user_id FROM public_keys WHERE fingerprint = ?", fingerprint).Scan(&userID)
+	var keyID, userID int
+	var disabled, expired bool
+	var options, apps, expiresAt string
+	err := a.DB.Conn.QueryRow(
+		`SELECT pk.id, pk.user_id, COALESCE(u.disabled, 0), COALESCE(pk.expires_at <= datetime('now'), 0), pk.options, pk.apps,
+		COALESCE(pk.expires_at, '')
+		FROM public_keys pk LEFT JOIN users u ON u.id = pk.user_id WHERE pk.fingerprint = ?`,
+		fingerprint,
+	).Scan(&keyID, &userID, &disabled, &expired, &options, &apps, &expiresAt)
+	if err == nil && (disabled || expired) {
+		return false
+	}
 	if err != nil {
+		if a.RegistrationMode == "open" || a.RegistrationMode == "invite" {
+			if ctx.User() == RegisterUser {
+				// Admit into a restricted signup session only
+				ctx.SetValue("registering", true)
+				ctx.SetValue("fingerprint", fingerprint)
+				ctx.SetValue("key_data", strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))))
+				ctx.SetValue("remote_ip", ctx.RemoteAddr().String())
+				return true
+			}
+		}
 		return false
 	}
 
-	// Store data in context
+	// Per-key options: from= is checked here, the rest by the router
+	opts, err := ParseKeyOptions(options)
+	if err != nil {
+		return false
+	}
+	if tcp, ok := ctx.RemoteAddr().(*net.TCPAddr); ok && !opts.AllowsFrom(tcp.IP) {
+		return false
+	}
+
+	// Store data in context. Usage is recorded in OnSessionStart, since this
+	// also runs for keys the client merely offers.
+	restrictions := Restrictions{Options: options}
+	restrictions.NotAfter, _ = time.Parse("2006-01-02 15:04:05", expiresAt)
 	ctx.SetValue("user_id", userID)
 	ctx.SetValue("fingerprint", fingerprint)
+	ctx.SetValue("key_id", keyID)
 	ctx.SetValue("remote_ip", ctx.RemoteAddr().String())
+	ctx.SetValue("key_options", opts)
+	ctx.SetValue("restrictions", restrictions)
+	if apps != "" {
+		ctx.SetValue("allowed_apps", strings.Split(apps, ","))
+	}
 
 	return true
 }
 
+// hostOnly strips the port from a host:port address
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 func (a *Authenticator) ConnCallback(ctx ssh.Context, conn net.Conn) net.Conn {
-	ip := conn.RemoteAddr().String()
-	if !a.Limiter.Allow(ip) {
+	client := ClientKey(conn.RemoteAddr(), a.IPv6Prefix)
+	if a.Bans.Banned(client) || !a.Limiter.Allow(client) {
 		conn.Close()
 		return nil
 	}
 	return conn
 }
 
-func (a *Authenticator) OnSessionClose(sess ssh.Session) {
-	fingerprint, ok := sess.Context().Value("fingerprint").(string)
-	if ok {
-		a.SessionMu.Lock()
-		a.Sessions[fingerprint]--
-		if a.Sessions[fingerprint] < 0 {
-			a.Sessions[fingerprint] = 0
-		}
-		a.SessionMu.Unlock()
-	}
-}
-
 func (a *Authenticator) BannerHandler(ctx ssh.Context) string {
 	return "\n╔════════════════════════════════════════════════════════════╗\n║  Poor Man's exe.dev SSH Gateway                           ║\n║  Welcome to the machine.                                   ║\n╚════════════════════════════════════════════════════════════╝\n\n"
 }
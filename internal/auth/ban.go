@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+// Banlist counts failed public-key attempts per client and, past a
+// threshold, bans the client in SQLite so the ban survives restarts. Each
+// repeat ban doubles in length up to MaxBan.
+type Banlist struct {
+	DB          *db.Database
+	MaxFailures int           // failed attempts within Window before a ban
+	Window      time.Duration // how long failures are remembered
+	BaseBan     time.Duration
+	MaxBan      time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*failureRecord
+}
+
+type failureRecord struct {
+	count int
+	first time.Time
+}
+
+func NewBanlist(d *db.Database, maxFailures int, baseBan, maxBan time.Duration) *Banlist {
+	return &Banlist{
+		DB:          d,
+		MaxFailures: maxFailures,
+		Window:      10 * time.Minute,
+		BaseBan:     baseBan,
+		MaxBan:      maxBan,
+		failures:    make(map[string]*failureRecord),
+	}
+}
+
+// Banned reports whether the client is currently banned
+func (b *Banlist) Banned(key string) bool {
+	var banned bool
+	b.DB.Conn.QueryRow("SELECT COUNT(*) > 0 FROM bans WHERE client = ? AND banned_until > datetime('now')", key).Scan(&banned)
+	return banned
+}
+
+// RecordFailure counts a rejected key and bans the client once it reaches
+// MaxFailures within Window. It reports whether the client is now banned.
+func (b *Banlist) RecordFailure(key string) bool {
+	if b.MaxFailures <= 0 {
+		return false
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	f, ok := b.failures[key]
+	if !ok || now.Sub(f.first) > b.Window {
+		f = &failureRecord{first: now}
+		b.failures[key] = f
+	}
+	f.count++
+	ban := f.count >= b.MaxFailures
+	if ban {
+		delete(b.failures, key)
+	}
+	b.mu.Unlock()
+
+	if ban {
+		b.ban(key, fmt.Sprintf("%d failed logins", b.MaxFailures))
+	}
+	return ban
+}
+
+// RecordSuccess forgets the client's failures, so keys offered before the
+// right one don't add up across logins
+func (b *Banlist) RecordSuccess(key string) {
+	b.mu.Lock()
+	delete(b.failures, key)
+	b.mu.Unlock()
+}
+
+func (b *Banlist) ban(key, reason string) {
+	var count int
+	b.DB.Conn.QueryRow("SELECT ban_count FROM bans WHERE client = ?", key).Scan(&count)
+
+	duration := b.BaseBan
+	for i := 0; i < count && duration < b.MaxBan; i++ {
+		duration *= 2
+	}
+	if duration > b.MaxBan {
+		duration = b.MaxBan
+	}
+	until := time.Now().UTC().Add(duration).Format("2006-01-02 15:04:05")
+
+	b.DB.Conn.Exec(`INSERT INTO bans (client, reason, banned_until) VALUES (?, ?, ?)
+		ON CONFLICT(client) DO UPDATE SET reason = excluded.reason, banned_until = excluded.banned_until,
+		ban_count = ban_count + 1, updated_at = CURRENT_TIMESTAMP`, key, reason, until)
+	b.DB.LogAudit("client_banned", 0, "", key, fmt.Sprintf("reason=%q until=%s ban_count=%d", reason, until, count+1))
+}
+
+// Cleanup drops failure counts older than Window
+func (b *Banlist) Cleanup() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for key, f := range b.failures {
+		if now.Sub(f.first) > b.Window {
+			delete(b.failures, key)
+		}
+	}
+}
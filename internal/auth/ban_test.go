@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+func TestBanlist(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	b := NewBanlist(d, 3, time.Hour, 3*time.Hour)
+	client := "1.2.3.4"
+
+	// A login in between resets the count
+	b.RecordFailure(client)
+	b.RecordFailure(client)
+	b.RecordSuccess(client)
+	if b.RecordFailure(client) || b.Banned(client) {
+		t.Fatal("Should not ban after a successful login reset the count")
+	}
+
+	b.RecordFailure(client)
+	if !b.RecordFailure(client) {
+		t.Fatal("Should ban on the 3rd failure")
+	}
+	if b.Banned("5.6.7.8") {
+		t.Error("Other clients should not be banned")
+	}
+
+	// Bans live in SQLite, so a new Banlist (a restart) still sees them
+	b = NewBanlist(d, 3, time.Hour, 3*time.Hour)
+	if !b.Banned(client) {
+		t.Error("Ban should survive a restart")
+	}
+
+	// Repeat offenders get longer bans, capped at MaxBan
+	for i := 0; i < 3; i++ {
+		b.ban(client, "test")
+	}
+	var count int
+	var hours float64
+	d.Conn.QueryRow("SELECT ban_count, (julianday(banned_until) - julianday('now')) * 24 FROM bans WHERE client = ?", client).Scan(&count, &hours)
+	if count != 4 {
+		t.Errorf("Expected ban_count 4, got %d", count)
+	}
+	if hours < 2.9 || hours > 3.01 {
+		t.Errorf("Expected ban capped at 3h, got %.2fh", hours)
+	}
+
+	// Expired bans don't block
+	d.Conn.Exec("UPDATE bans SET banned_until = datetime('now', '-1 minute')")
+	if b.Banned(client) {
+		t.Error("Expired ban should not block")
+	}
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Principals on gateway-issued certificates. Every cert names its user;
+// app principals, if any, restrict it to those apps.
+const (
+	UserPrincipalPrefix = "uid:"
+	AppPrincipalPrefix  = "app:"
+)
+
+// LoadCA reads the gateway's own CA private key
+func LoadCA(path string) (gossh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return gossh.ParsePrivateKey(data)
+}
+
+// LoadOrCreateCA reads the gateway's CA key, generating one on first start
+func LoadOrCreateCA(path string) (gossh.Signer, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := gossh.MarshalPrivateKey(privateKey, "poor-exe user CA")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			return nil, err
+		}
+	}
+	return LoadCA(path)
+}
+
+// IssueCert signs a user certificate for key, valid for ttl. An empty apps
+// list gives the holder the user's full access.
+func IssueCert(ca gossh.Signer, key gossh.PublicKey, userID int, keyID string, apps []string, ttl time.Duration) (*gossh.Certificate, error) {
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+
+	principals := []string{UserPrincipalPrefix + strconv.Itoa(userID)}
+	for _, app := range apps {
+		principals = append(principals, AppPrincipalPrefix+app)
+	}
+
+	now := time.Now()
+	cert := &gossh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        gossh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()), // allow for clock skew
+		ValidBefore:     uint64(now.Add(ttl).Unix()),
+		Permissions: gossh.Permissions{
+			Extensions: map[string]string{"permit-pty": ""},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Restrictions are the limits on the key or certificate a session logged in
+// with. Certificates issued from the session inherit them, so signing a new
+// key can't shed an expiry or a from= or command= option.
+type Restrictions struct {
+	Options  string    // authorized_keys options
+	NotAfter time.Time // zero if the credential doesn't expire
+}
+
+// RestrictionsFromContext returns the restrictions the authenticator stored
+// for the session's credential
+func RestrictionsFromContext(ctx context.Context) Restrictions {
+	r, _ := ctx.Value("restrictions").(Restrictions)
+	return r
+}
+
+// gatewayCertHandler admits a certificate issued by `keys sign`, applying
+// the options it inherited like those of a registered key
+func (a *Authenticator) gatewayCertHandler(ctx ssh.Context, cert *gossh.Certificate, fingerprint string) bool {
+	userID, apps, options, err := a.gatewayCertUser(cert)
+	var opts KeyOptions
+	if err == nil {
+		opts, err = ParseKeyOptions(options)
+	}
+	if tcp, ok := ctx.RemoteAddr().(*net.TCPAddr); err == nil && ok && !opts.AllowsFrom(tcp.IP) {
+		err = fmt.Errorf("source address %s not allowed by certificate", tcp.IP)
+	}
+	if err != nil {
+		a.DB.LogAudit("cert_rejected", 0, "", ctx.RemoteAddr().String(),
+			fmt.Sprintf("serial=%d key_id=%q error=%q", cert.Serial, cert.KeyId, err.Error()))
+		return false
+	}
+
+	ctx.SetValue("user_id", userID)
+	ctx.SetValue("fingerprint", fingerprint)
+	ctx.SetValue("remote_ip", ctx.RemoteAddr().String())
+	ctx.SetValue("cert_serial", cert.Serial)
+	ctx.SetValue("cert_key_id", cert.KeyId)
+	ctx.SetValue("cert_principal", UserPrincipalPrefix+strconv.Itoa(userID))
+	ctx.SetValue("key_options", opts)
+	ctx.SetValue("restrictions", Restrictions{Options: options, NotAfter: time.Unix(int64(cert.ValidBefore), 0)})
+	if len(apps) > 0 {
+		ctx.SetValue("allowed_apps", apps)
+	}
+	return true
+}
+
+// gatewayCertUser validates a gateway-issued cert and returns its user, app
+// restriction and inherited options. Its serial must be recorded as issued
+// to the user and not revoked.
+func (a *Authenticator) gatewayCertUser(cert *gossh.Certificate) (int, []string, string, error) {
+	if cert.CertType != gossh.UserCert {
+		return 0, nil, "", errors.New("not a user certificate")
+	}
+
+	userID := 0
+	var apps []string
+	for _, p := range cert.ValidPrincipals {
+		if id, ok := strings.CutPrefix(p, UserPrincipalPrefix); ok {
+			userID, _ = strconv.Atoi(id)
+		} else if app, ok := strings.CutPrefix(p, AppPrincipalPrefix); ok {
+			apps = append(apps, app)
+		}
+	}
+	if userID == 0 {
+		return 0, nil, "", errors.New("certificate names no user")
+	}
+
+	checker := gossh.CertChecker{}
+	if err := checker.CheckCert(UserPrincipalPrefix+strconv.Itoa(userID), cert); err != nil {
+		return 0, nil, "", err
+	}
+
+	var disabled, revoked bool
+	var options string
+	err := a.DB.Conn.QueryRow(
+		`SELECT COALESCE(u.disabled, 0), c.revoked_at IS NOT NULL, c.options FROM certificates c JOIN users u ON u.id = c.user_id
+		WHERE c.serial = ? AND c.user_id = ? AND c.fingerprint = ?`,
+		strconv.FormatUint(cert.Serial, 10), userID, gossh.FingerprintSHA256(cert.Key),
+	).Scan(&disabled, &revoked, &options)
+	if err != nil {
+		return 0, nil, "", errors.New("certificate was not issued by this gateway")
+	}
+	if revoked {
+		return 0, nil, "", errors.New("certificate has been revoked")
+	}
+	if disabled {
+		return 0, nil, "", fmt.Errorf("user %d is disabled", userID)
+	}
+	return userID, apps, options, nil
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const sourceAddressOption = "source-address"
+
+// LoadUserCAKeys reads trusted user CA public keys, one per line in
+// authorized_keys format (like sshd's TrustedUserCAKeys)
+func LoadUserCAKeys(path string) ([]gossh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []gossh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := gossh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+func (a *Authenticator) isUserCA(key gossh.PublicKey) bool {
+	for _, ca := range a.UserCAs {
+		if bytes.Equal(ca.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// certHandler admits a user certificate signed by a trusted CA
+func (a *Authenticator) certHandler(ctx ssh.Context, cert *gossh.Certificate, fingerprint string) bool {
+	userID, principal, err := a.certUser(ctx.RemoteAddr(), cert)
+	if err != nil {
+		a.DB.LogAudit("cert_rejected", 0, "", ctx.RemoteAddr().String(),
+			fmt.Sprintf("serial=%d key_id=%q error=%q", cert.Serial, cert.KeyId, err.Error()))
+		return false
+	}
+
+	if userID == 0 {
+		// Created in OnSessionStart, once the client has proven it holds the key
+		ctx.SetValue("provision_email", principal)
+	} else {
+		ctx.SetValue("user_id", userID)
+	}
+	ctx.SetValue("fingerprint", fingerprint)
+	ctx.SetValue("remote_ip", ctx.RemoteAddr().String())
+	ctx.SetValue("cert_serial", cert.Serial)
+	ctx.SetValue("cert_key_id", cert.KeyId)
+	ctx.SetValue("cert_principal", principal)
+
+	restrictions := Restrictions{NotAfter: time.Unix(int64(cert.ValidBefore), 0)}
+	if allowed, ok := cert.CriticalOptions[sourceAddressOption]; ok {
+		restrictions.Options = fmt.Sprintf("from=%q", allowed)
+	}
+	ctx.SetValue("restrictions", restrictions)
+	return true
+}
+
+// certUser validates cert and maps its principals to a user. It returns the
+// user ID and matched principal (as an email), or ID 0 with the email to
+// provision when the principal is unknown and auto-provisioning is on.
+func (a *Authenticator) certUser(remote net.Addr, cert *gossh.Certificate) (int, string, error) {
+	if cert.CertType != gossh.UserCert {
+		return 0, "", errors.New("not a user certificate")
+	}
+	if !a.isUserCA(cert.SignatureKey) {
+		return 0, "", errors.New("certificate not signed by a trusted CA")
+	}
+	// A cert without principals is valid for anyone; we can't map it to a user
+	if len(cert.ValidPrincipals) == 0 {
+		return 0, "", errors.New("certificate has no principals")
+	}
+
+	// Checks signature, validity window and critical options. force-command
+	// and any other option we can't honour make the cert unusable.
+	checker := gossh.CertChecker{SupportedCriticalOptions: []string{sourceAddressOption}}
+	if err := checker.CheckCert(cert.ValidPrincipals[0], cert); err != nil {
+		return 0, "", err
+	}
+	if allowed, ok := cert.CriticalOptions[sourceAddressOption]; ok {
+		if err := checkSourceAddress(remote, allowed); err != nil {
+			return 0, "", err
+		}
+	}
+
+	for _, p := range cert.ValidPrincipals {
+		email := a.principalEmail(p)
+		if email == "" {
+			continue
+		}
+		var userID int
+		var disabled bool
+		err := a.DB.Conn.QueryRow("SELECT id, COALESCE(disabled, 0) FROM users WHERE lower(email) = lower(?)", email).Scan(&userID, &disabled)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		if disabled {
+			return 0, "", fmt.Errorf("user %s is disabled", email)
+		}
+		return userID, email, nil
+	}
+
+	if a.CertAutoProvision {
+		for _, p := range cert.ValidPrincipals {
+			if email := a.principalEmail(p); email != "" {
+				return 0, email, nil
+			}
+		}
+	}
+	return 0, "", fmt.Errorf("no user for principals %q", cert.ValidPrincipals)
+}
+
+// principalEmail maps a principal to an email, or "" if it can't be mapped
+func (a *Authenticator) principalEmail(principal string) string {
+	if strings.Contains(principal, "@") {
+		return principal
+	}
+	if a.CertPrincipalDomain == "" {
+		return ""
+	}
+	return principal + "@" + a.CertPrincipalDomain
+}
+
+// checkSourceAddress enforces the source-address critical option, a
+// comma-separated list of addresses and CIDRs
+func checkSourceAddress(remote net.Addr, allowed string) error {
+	tcp, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("cannot check source-address for %v", remote)
+	}
+	for _, entry := range strings.Split(allowed, ",") {
+		entry = strings.TrimSpace(entry)
+		if ip := net.ParseIP(entry); ip != nil && ip.Equal(tcp.IP) {
+			return nil
+		}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil && ipNet.Contains(tcp.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("source address %s not allowed by certificate", tcp.IP)
+}
+
+// OnSessionStart runs once the client has proven it holds the key. It
+// clears the client's failed attempts, records when and from where a
+// registered key was used, and finishes
+// certificate logins: it provisions users for new principals and records the
+// cert's serial and key ID in the audit log.
+func (a *Authenticator) OnSessionStart(sess ssh.Session) error {
+	ctx := sess.Context()
+	a.Bans.RecordSuccess(ClientKey(sess.RemoteAddr(), a.IPv6Prefix))
+	remoteIP, _ := ctx.Value("remote_ip").(string)
+	if id, ok := ctx.Value("key_id").(int); ok {
+		a.DB.Conn.Exec("UPDATE public_keys SET last_used_at = CURRENT_TIMESTAMP, last_used_ip = ? WHERE id = ?", hostOnly(remoteIP), id)
+	}
+
+	keyID, ok := ctx.Value("cert_key_id").(string)
+	if !ok {
+		return nil
+	}
+	serial, _ := ctx.Value("cert_serial").(uint64)
+	principal, _ := ctx.Value("cert_principal").(string)
+
+	if email, ok := ctx.Value("provision_email").(string); ok {
+		if _, err := a.DB.Conn.Exec("INSERT INTO users (email) VALUES (?) ON CONFLICT(email) DO NOTHING", email); err != nil {
+			return err
+		}
+		var userID int
+		if err := a.DB.Conn.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID); err != nil {
+			return err
+		}
+		ctx.SetValue("user_id", userID)
+		a.DB.LogAudit("user_provision", userID, "", remoteIP, fmt.Sprintf("email=%s key_id=%q", email, keyID))
+	}
+
+	userID, _ := ctx.Value("user_id").(int)
+	a.DB.LogAudit("cert_login", userID, "", remoteIP, fmt.Sprintf("serial=%d key_id=%q principal=%s", serial, keyID, principal))
+	return nil
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/db"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestCertUser(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com')")
+
+	_, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := gossh.NewSignerFromKey(caPriv)
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := gossh.NewSignerFromKey(otherPriv)
+	userPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	userKey, _ := gossh.NewPublicKey(userPub)
+
+	now := time.Now()
+	sign := func(signer gossh.Signer, principals []string, opts map[string]string) *gossh.Certificate {
+		cert := &gossh.Certificate{
+			Key:             userKey,
+			Serial:          42,
+			CertType:        gossh.UserCert,
+			KeyId:           "alice-laptop",
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+			Permissions:     gossh.Permissions{CriticalOptions: opts},
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatalf("SignCert failed: %v", err)
+		}
+		return cert
+	}
+
+	a := &Authenticator{DB: d, UserCAs: []gossh.PublicKey{ca.PublicKey()}, CertPrincipalDomain: "example.com"}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 50000}
+
+	if id, _, err := a.certUser(remote, sign(ca, []string{"alice"}, nil)); err != nil || id != 1 {
+		t.Errorf("Expected principal alice to map to user 1, got %d, %v", id, err)
+	}
+	if _, _, err := a.certUser(remote, sign(other, []string{"alice"}, nil)); err == nil {
+		t.Error("Expected cert from untrusted CA to be rejected")
+	}
+	if _, _, err := a.certUser(remote, sign(ca, []string{"bob"}, nil)); err == nil {
+		t.Error("Expected unknown principal to be rejected without auto-provisioning")
+	}
+	if _, _, err := a.certUser(remote, sign(ca, []string{"alice"}, map[string]string{"force-command": "ls"})); err == nil {
+		t.Error("Expected unsupported critical option to be rejected")
+	}
+	if _, _, err := a.certUser(remote, sign(ca, []string{"alice"}, map[string]string{"source-address": "192.168.0.0/16"})); err == nil {
+		t.Error("Expected source-address mismatch to be rejected")
+	}
+	if _, _, err := a.certUser(remote, sign(ca, []string{"alice"}, map[string]string{"source-address": "10.0.0.0/8"})); err != nil {
+		t.Errorf("Expected matching source-address to be accepted, got %v", err)
+	}
+
+	a.CertAutoProvision = true
+	if id, email, err := a.certUser(remote, sign(ca, []string{"bob"}, nil)); err != nil || id != 0 || email != "bob@example.com" {
+		t.Errorf("Expected bob@example.com to be provisioned, got %d %q %v", id, email, err)
+	}
+}
+
+func TestGatewayCert(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	ca, err := LoadOrCreateCA(filepath.Join(t.TempDir(), "ca_key"))
+	if err != nil {
+		t.Fatalf("LoadOrCreateCA failed: %v", err)
+	}
+	userPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	userKey, _ := gossh.NewPublicKey(userPub)
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (7, 'contractor@example.com')")
+	record := func(cert *gossh.Certificate) {
+		d.Conn.Exec("INSERT INTO certificates (serial, user_id, fingerprint, key_id, expires_at) VALUES (?, 7, ?, '', '2099-01-01')",
+			strconv.FormatUint(cert.Serial, 10), gossh.FingerprintSHA256(userKey))
+	}
+
+	a := &Authenticator{DB: d, GatewayCA: ca.PublicKey()}
+	cert, err := IssueCert(ca, userKey, 7, "contractor", []string{"bloggy"}, time.Hour)
+	if err != nil {
+		t.Fatalf("IssueCert failed: %v", err)
+	}
+	if _, _, _, err := a.gatewayCertUser(cert); err == nil {
+		t.Error("Expected cert with an unrecorded serial to be rejected")
+	}
+	record(cert)
+	id, apps, _, err := a.gatewayCertUser(cert)
+	if err != nil || id != 7 || len(apps) != 1 || apps[0] != "bloggy" {
+		t.Errorf("Expected user 7 restricted to bloggy, got %d %v %v", id, apps, err)
+	}
+
+	expired, _ := IssueCert(ca, userKey, 7, "contractor", nil, -time.Hour)
+	record(expired)
+	if _, _, _, err := a.gatewayCertUser(expired); err == nil {
+		t.Error("Expected expired cert to be rejected")
+	}
+
+	d.Conn.Exec("UPDATE certificates SET revoked_at = CURRENT_TIMESTAMP WHERE serial = ?", strconv.FormatUint(cert.Serial, 10))
+	if _, _, _, err := a.gatewayCertUser(cert); err == nil {
+		t.Error("Expected revoked cert to be rejected")
+	}
+}
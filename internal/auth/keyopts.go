@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// KeyOptions are the authorized_keys options the gateway honours per key
+type KeyOptions struct {
+	From    string // from="pattern-list" of client addresses
+	Command string // forced command, run instead of what the client asked for
+	NoPTY   bool   // no-pty, or restrict without pty
+}
+
+// ParseKeyOptions parses options as stored (comma-separated, OpenSSH syntax).
+// Options the gateway can't enforce are rejected rather than ignored.
+func ParseKeyOptions(options string) (KeyOptions, error) {
+	var opts KeyOptions
+	restrict, pty := false, false
+	for _, opt := range splitOptions(options) {
+		name, value, hasValue := strings.Cut(opt, "=")
+		if hasValue {
+			value = strings.Trim(value, `"`)
+		}
+		switch strings.ToLower(name) {
+		case "from":
+			opts.From = value
+		case "command":
+			opts.Command = value
+		case "restrict":
+			restrict = true
+		case "no-pty":
+			opts.NoPTY = true
+		case "pty":
+			pty = true
+		// Forwarding is never available through the gateway
+		case "no-port-forwarding", "no-agent-forwarding", "no-x11-forwarding", "no-user-rc":
+		default:
+			return opts, fmt.Errorf("unsupported key option '%s'", name)
+		}
+	}
+	if restrict && !pty {
+		opts.NoPTY = true
+	}
+	return opts, nil
+}
+
+// splitOptions splits on commas outside double quotes
+func splitOptions(s string) []string {
+	var out []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				out = append(out, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if rest := s[start:]; rest != "" {
+		out = append(out, rest)
+	}
+	return out
+}
+
+// AllowsFrom reports whether a client at ip satisfies the from= pattern list:
+// addresses, CIDRs or wildcards, where a matching "!" entry always denies
+func (o KeyOptions) AllowsFrom(ip net.IP) bool {
+	if o.From == "" {
+		return true
+	}
+	allowed := false
+	for _, entry := range strings.Split(o.From, ",") {
+		entry = strings.TrimSpace(entry)
+		negated := strings.HasPrefix(entry, "!")
+		entry = strings.TrimPrefix(entry, "!")
+
+		var match bool
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			match = ipNet.Contains(ip)
+		} else {
+			match, _ = path.Match(entry, ip.String())
+		}
+		if match && negated {
+			return false
+		}
+		allowed = allowed || match
+	}
+	return allowed
+}
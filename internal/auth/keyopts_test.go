@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseKeyOptions(t *testing.T) {
+	opts, err := ParseKeyOptions(`from="10.0.0.0/8,!10.0.0.5",command="uptime, now",restrict`)
+	if err != nil {
+		t.Fatalf("ParseKeyOptions failed: %v", err)
+	}
+	if opts.Command != "uptime, now" || !opts.NoPTY {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+	if !opts.AllowsFrom(net.ParseIP("10.1.2.3")) {
+		t.Error("Expected 10.1.2.3 to be allowed")
+	}
+	if opts.AllowsFrom(net.ParseIP("10.0.0.5")) {
+		t.Error("Expected negated 10.0.0.5 to be denied")
+	}
+	if opts.AllowsFrom(net.ParseIP("192.168.1.1")) {
+		t.Error("Expected 192.168.1.1 to be denied")
+	}
+
+	if opts, _ := ParseKeyOptions("restrict,pty"); opts.NoPTY {
+		t.Error("Expected pty to re-enable PTY after restrict")
+	}
+	if _, err := ParseKeyOptions("permitopen=\"localhost:80\""); err == nil {
+		t.Error("Expected unsupported option to be rejected")
+	}
+}
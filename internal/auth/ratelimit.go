@@ -1,10 +1,39 @@
 package auth
 
 import (
+	"net"
 	"sync"
 	"time"
 )
 
+// ClientKey identifies a client for rate limiting and bans: its IP without the
+// source port, or its IPv6 prefix when ipv6Prefix is set, since one host
+// usually holds a whole /64
+func ClientKey(addr net.Addr, ipv6Prefix int) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return addr.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	if ipv6Prefix > 0 && ipv6Prefix < 128 {
+		ipNet := net.IPNet{IP: ip.Mask(net.CIDRMask(ipv6Prefix, 128)), Mask: net.CIDRMask(ipv6Prefix, 128)}
+		return ipNet.String()
+	}
+	return ip.String()
+}
+
 // RateLimiter implements a simple token bucket for IP-based rate limiting
 type RateLimiter struct {
 	mu       sync.Mutex
@@ -26,17 +55,18 @@ func NewRateLimiter(rate float64, capacity float64) *RateLimiter {
 	}
 }
 
-func (r *RateLimiter) Allow(ip string) bool {
+// Allow takes a token from the client's bucket; key comes from ClientKey
+func (r *RateLimiter) Allow(key string) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	b, ok := r.buckets[ip]
+	b, ok := r.buckets[key]
 	if !ok {
 		b = &bucket{
 			tokens:     r.capacity,
 			lastUpdate: time.Now(),
 		}
-		r.buckets[ip] = b
+		r.buckets[key] = b
 	}
 
 	now := time.Now()
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"net"
 	"testing"
 	"time"
 )
@@ -53,3 +54,22 @@ func TestRateLimiterCleanup(t *testing.T) {
 		t.Errorf("Expected 0 buckets after cleanup, got %d", len(rl.buckets))
 	}
 }
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		addr   net.Addr
+		prefix int
+		want   string
+	}{
+		// Source ports must not give each connection its own bucket
+		{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 50001}, 64, "1.2.3.4"},
+		{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 50002}, 64, "1.2.3.4"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 22}, 64, "2001:db8:1:2::/64"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 22}, 0, "2001:db8:1:2:3:4:5:6"},
+	}
+	for _, tt := range tests {
+		if got := ClientKey(tt.addr, tt.prefix); got != tt.want {
+			t.Errorf("ClientKey(%v, %d) = %q, want %q", tt.addr, tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -5,26 +5,70 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"reflect"
+	"strings"
 )
 
 type Client struct {
 	BaseURL string
+	// AuthUpstream is the gateway's HTTP address as seen from Caddy. Private
+	// app routes send a forward_auth subrequest there before proxying.
+	AuthUpstream string
 }
 
-func NewClient(baseURL string) *Client {
+func NewClient(baseURL, authUpstream string) *Client {
 	if baseURL == "" {
 		baseURL = "http://localhost:2019"
 	}
-	return &Client{BaseURL: baseURL}
+	return &Client{BaseURL: baseURL, AuthUpstream: authUpstream}
 }
 
 type Upstream struct {
 	Dial string `json:"dial"`
 }
 
+type Rewrite struct {
+	Method string `json:"method,omitempty"`
+	URI    string `json:"uri,omitempty"`
+}
+
+type HeaderOps struct {
+	Set     map[string][]string      `json:"set,omitempty"`
+	Delete  []string                 `json:"delete,omitempty"`
+	Replace map[string][]Replacement `json:"replace,omitempty"`
+}
+
+// Replacement rewrites the part of a header value matching SearchRegexp
+type Replacement struct {
+	SearchRegexp string `json:"search_regexp"`
+	Replace      string `json:"replace"`
+}
+
+type Headers struct {
+	Request *HeaderOps `json:"request,omitempty"`
+}
+
+type ResponseMatch struct {
+	StatusCode []int `json:"status_code,omitempty"`
+}
+
+type ResponseHandler struct {
+	Match  *ResponseMatch `json:"match,omitempty"`
+	Routes []Route        `json:"routes,omitempty"`
+}
+
 type ReverseProxy struct {
-	Handler   string     `json:"handler"`
-	Upstreams []Upstream `json:"upstreams"`
+	Handler        string            `json:"handler"`
+	Upstreams      []Upstream        `json:"upstreams"`
+	Rewrite        *Rewrite          `json:"rewrite,omitempty"`
+	Headers        *Headers          `json:"headers,omitempty"`
+	HandleResponse []ResponseHandler `json:"handle_response,omitempty"`
+}
+
+// HeadersHandler is Caddy's "headers" handler
+type HeadersHandler struct {
+	Handler string    `json:"handler"`
+	Request HeaderOps `json:"request"`
 }
 
 type Match struct {
@@ -32,67 +76,192 @@ type Match struct {
 }
 
 type Route struct {
-	Match  []Match        `json:"match"`
-	Handle []ReverseProxy `json:"handle"`
+	ID     string        `json:"@id,omitempty"`
+	Match  []Match       `json:"match,omitempty"`
+	Handle []interface{} `json:"handle"`
 }
 
-func (c *Client) UpsertRoute(appName, domain string, port int) error {
-	host := fmt.Sprintf("%s.%s", appName, domain)
-	routeID := fmt.Sprintf("poor-exe-%s", appName)
+// RoutePrefix marks routes managed by the gateway; app routes are
+// RoutePrefix + app name.
+const RoutePrefix = "poor-exe-"
 
-	route := Route{
-		Match: []Match{{Host: []string{host}}},
-		Handle: []ReverseProxy{{
-			Handler:   "reverse_proxy",
-			Upstreams: []Upstream{{Dial: fmt.Sprintf("localhost:%d", port)}},
+// AuthRouteID is the route serving the login pages
+const AuthRouteID = RoutePrefix + "auth"
+
+// UserHeader carries the authenticated email from forward_auth to the app
+const UserHeader = "X-Poor-Exe-User"
+
+// AuthCookie is the login session cookie. It is scoped to the whole domain
+// so forward_auth sees it on every app host, and stripped before requests
+// reach an app so no app, public or private, can replay it.
+const AuthCookie = "poor_exe_auth"
+
+// forwardAuth mirrors what Caddy's forward_auth directive expands to: a
+// GET subrequest to /auth/verify whose 2xx response lets the request through
+// (copying the user header), while any other response is returned as-is.
+func (c *Client) forwardAuth() ReverseProxy {
+	return ReverseProxy{
+		Handler:   "reverse_proxy",
+		Upstreams: []Upstream{{Dial: c.AuthUpstream}},
+		Rewrite:   &Rewrite{Method: "GET", URI: "/auth/verify"},
+		Headers: &Headers{Request: &HeaderOps{Set: map[string][]string{
+			"X-Forwarded-Method": {"{http.request.method}"},
+			"X-Forwarded-Uri":    {"{http.request.uri}"},
+		}}},
+		HandleResponse: []ResponseHandler{{
+			Match: &ResponseMatch{StatusCode: []int{2}},
+			Routes: []Route{{Handle: []interface{}{HeadersHandler{
+				Handler: "headers",
+				Request: HeaderOps{Set: map[string][]string{
+					UserHeader: {"{http.reverse_proxy.header." + UserHeader + "}"},
+				}},
+			}}}},
 		}},
 	}
+}
+
+// UpsertRoute points <appName>.<domain> at the upstream dial address. Private
+// apps get a forward_auth check in front of the proxy; public apps are
+// proxied directly. Either way a client-supplied user header is dropped and
+// the login cookie never reaches the app.
+func (c *Client) UpsertRoute(appName, domain, upstream string, public bool) error {
+	return c.putRoute(RoutePrefix+appName, c.appRoute(appName, domain, upstream, public))
+}
+
+func (c *Client) appRoute(appName, domain, upstream string, public bool) Route {
+	handle := []interface{}{HeadersHandler{
+		Handler: "headers",
+		Request: HeaderOps{Delete: []string{UserHeader}},
+	}}
+	if !public {
+		handle = append(handle, c.forwardAuth())
+	}
+	handle = append(handle, ReverseProxy{
+		Handler:   "reverse_proxy",
+		Upstreams: []Upstream{{Dial: upstream}},
+		Headers: &Headers{Request: &HeaderOps{Replace: map[string][]Replacement{
+			"Cookie": {{SearchRegexp: `(^|;\s*)` + AuthCookie + `=[^;]*`}},
+		}}},
+	})
+
+	return Route{
+		ID:     RoutePrefix + appName,
+		Match:  []Match{{Host: []string{fmt.Sprintf("%s.%s", appName, domain)}}},
+		Handle: handle,
+	}
+}
+
+// RouteCurrent reports whether installed, a route as returned by ListRoutes,
+// is exactly what UpsertRoute would write for the app now. A stale upstream
+// (e.g. an old container IP) or visibility makes it differ.
+func (c *Client) RouteCurrent(installed json.RawMessage, appName, domain, upstream string, public bool) bool {
+	want, err := json.Marshal(c.appRoute(appName, domain, upstream, public))
+	if err != nil {
+		return false
+	}
+	var got, wantV interface{}
+	if json.Unmarshal(installed, &got) != nil || json.Unmarshal(want, &wantV) != nil {
+		return false
+	}
+	return reflect.DeepEqual(got, wantV)
+}
 
+// UpsertAuthRoute exposes the gateway's login pages on authHost
+func (c *Client) UpsertAuthRoute(authHost string) error {
+	return c.putRoute(AuthRouteID, Route{
+		Match: []Match{{Host: []string{authHost}}},
+		Handle: []interface{}{ReverseProxy{
+			Handler:   "reverse_proxy",
+			Upstreams: []Upstream{{Dial: c.AuthUpstream}},
+		}},
+	})
+}
+
+// putRoute replaces the route with the given @id, or appends it to srv0 if
+// Caddy doesn't have it (e.g. after a Caddy restart).
+func (c *Client) putRoute(routeID string, route Route) error {
+	route.ID = routeID
 	data, err := json.Marshal(route)
 	if err != nil {
 		return err
 	}
 
-	// Caddy's /config/ path allows IDs for easy upsert/delete
-	url := fmt.Sprintf("%s/config/apps/http/servers/srv0/routes/%s", c.BaseURL, routeID)
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(data))
+	status, err := c.do(http.MethodPatch, fmt.Sprintf("%s/id/%s", c.BaseURL, routeID), data)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if status == http.StatusNotFound {
+		status, err = c.do(http.MethodPost, c.BaseURL+"/config/apps/http/servers/srv0/routes", data)
+		if err != nil {
+			return err
+		}
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	if status >= 400 {
+		return fmt.Errorf("caddy api error: %d %s", status, http.StatusText(status))
+	}
+
+	return nil
+}
+
+// ListRoutes returns every gateway-managed route in srv0 by @id, as Caddy
+// holds it
+func (c *Client) ListRoutes() (map[string]json.RawMessage, error) {
+	resp, err := http.Get(c.BaseURL + "/config/apps/http/servers/srv0/routes")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("caddy api error: %s", resp.Status)
+		return nil, fmt.Errorf("caddy api error: %s", resp.Status)
 	}
 
-	return nil
+	var routes []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&routes); err != nil {
+		return nil, err
+	}
+
+	managed := make(map[string]json.RawMessage)
+	for _, raw := range routes {
+		var r struct {
+			ID string `json:"@id"`
+		}
+		if json.Unmarshal(raw, &r) == nil && strings.HasPrefix(r.ID, RoutePrefix) {
+			managed[r.ID] = raw
+		}
+	}
+	return managed, nil
 }
 
 func (c *Client) DeleteRoute(appName string) error {
-	routeID := fmt.Sprintf("poor-exe-%s", appName)
-	url := fmt.Sprintf("%s/config/apps/http/servers/srv0/routes/%s", c.BaseURL, routeID)
-
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	status, err := c.do(http.MethodDelete, fmt.Sprintf("%s/id/%s%s", c.BaseURL, RoutePrefix, appName), nil)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	// 404 is fine, means route doesn't exist
+	if status >= 400 && status != http.StatusNotFound {
+		return fmt.Errorf("caddy api error: %d %s", status, http.StatusText(status))
+	}
+
+	return nil
+}
+
+func (c *Client) do(method, url string, body []byte) (int, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
-	defer resp.Body.Close()
 
-	// 404 is fine, means route doesn't exist
-	if resp.StatusCode >= 400 && resp.StatusCode != 404 {
-		return fmt.Errorf("caddy api error: %s", resp.Status)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
 	}
+	defer resp.Body.Close()
 
-	return nil
+	return resp.StatusCode, nil
 }
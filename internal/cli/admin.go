@@ -0,0 +1,549 @@
+package cli
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/caddy"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/reconcile"
+)
+
+func handleReconcile(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
+	if err := authorize(sess, d, cfg, policy.Admin); err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	dryRun := HasFlag(args, "--dry-run")
+	rep, err := reconcile.New(d, r, c, cfg).Run(sess.Context(), dryRun)
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	if !dryRun {
+		remoteIP, _ := sess.Context().Value("remote_ip").(string)
+		d.LogAudit("reconcile", userID, "", remoteIP, fmt.Sprintf("drift=%t errors=%d", rep.Drift(), len(rep.Errors)))
+	}
+
+	if isJSON {
+		WriteJSON(sess, len(rep.Errors) == 0, "", rep, nil)
+		return
+	}
+
+	if dryRun {
+		fmt.Fprintln(sess, "Dry run: no changes made.")
+	}
+	if !rep.Drift() {
+		fmt.Fprintln(sess, "No drift found.")
+	}
+	printList := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		fmt.Fprintf(sess, "%s:\n", title)
+		for _, item := range items {
+			fmt.Fprintf(sess, "  %s\n", item)
+		}
+	}
+	printList("Orphan containers (no app record)", rep.OrphanContainers)
+	printList("Missing containers", rep.MissingContainers)
+	printList("Status updated", rep.StatusUpdated)
+	printList("Routes restored", rep.RoutesRestored)
+	printList("Routes corrected", rep.RoutesUpdated)
+	printList("Stale routes removed", rep.RoutesRemoved)
+	printList("Errors", rep.Errors)
+}
+
+func handleMigrate(sess ssh.Session, args []string, d *db.Database, cfg *config.Config, userID int, isJSON bool) {
+	if err := authorize(sess, d, cfg, policy.Admin); err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	cmd := "status"
+	if positional := PositionalArgs(args); len(positional) > 0 {
+		cmd = positional[0]
+	}
+
+	switch cmd {
+	case "status":
+		states, err := d.MigrationStatus()
+		if err != nil {
+			if isJSON {
+				WriteJSON(sess, false, "", nil, err)
+			} else {
+				fmt.Fprintf(sess, "Error: %v\n", err)
+			}
+			return
+		}
+		if isJSON {
+			WriteJSON(sess, true, "", map[string]interface{}{"migrations": states}, nil)
+			return
+		}
+		fmt.Fprintf(sess, "%-8s %-30s %-20s\n", "VERSION", "NAME", "APPLIED")
+		fmt.Fprintf(sess, "%-8s %-30s %-20s\n", "-------", "----", "-------")
+		for _, s := range states {
+			applied := s.AppliedAt
+			if applied == "" {
+				applied = "pending"
+			}
+			fmt.Fprintf(sess, "%04d     %-30s %-20s\n", s.Version, s.Name, applied)
+		}
+
+	case "up":
+		applied, err := d.Migrate()
+		if len(applied) > 0 {
+			remoteIP, _ := sess.Context().Value("remote_ip").(string)
+			d.LogAudit("migrate", userID, "", remoteIP, fmt.Sprintf("applied=%d", len(applied)))
+		}
+		if isJSON {
+			WriteJSON(sess, err == nil, fmt.Sprintf("Applied %d migration(s)", len(applied)), map[string]interface{}{"applied": applied}, err)
+			return
+		}
+		for _, m := range applied {
+			fmt.Fprintf(sess, "Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		} else if len(applied) == 0 {
+			fmt.Fprintln(sess, "Schema is up to date.")
+		}
+
+	default:
+		msg := "Usage: migrate [status|up]"
+		if isJSON {
+			WriteJSON(sess, false, "", nil, errors.New(msg))
+		} else {
+			fmt.Fprintln(sess, msg)
+		}
+	}
+}
+
+func handleAdmin(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
+	if err := authorize(sess, d, cfg, policy.Admin); err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	positional := PositionalArgs(args)
+	group, sub := "", ""
+	if len(positional) > 0 {
+		group = positional[0]
+	}
+	if len(positional) > 1 {
+		sub = positional[1]
+	}
+
+	switch {
+	case group == "users" && sub == "ls":
+		handleAdminUsersLs(sess, d, isJSON)
+	case group == "users" && (sub == "disable" || sub == "enable" || sub == "promote" || sub == "demote"):
+		handleAdminUserSet(sess, sub, positional[2:], d, userID, isJSON)
+	case group == "apps" && sub == "ls":
+		handleAdminAppsLs(sess, d, r, userID, HasFlag(args, "--all"), HasFlag(args, "--stopped"), isJSON)
+	case group == "invite" && sub == "create":
+		handleAdminInviteCreate(sess, args, d, userID, isJSON)
+	case group == "invite" && sub == "ls":
+		handleAdminInviteLs(sess, d, isJSON)
+	case group == "bans" && sub == "ls":
+		handleAdminBansLs(sess, d, HasFlag(args, "--all"), isJSON)
+	case group == "bans" && sub == "rm":
+		handleAdminBansRm(sess, positional[2:], d, userID, isJSON)
+	case group == "reconcile":
+		handleReconcile(sess, args[1:], d, r, c, cfg, userID, isJSON)
+	case group == "migrate":
+		handleMigrate(sess, args[1:], d, cfg, userID, isJSON)
+	default:
+		usage := `Usage: admin <group> <cmd>
+  users ls
+  users disable|enable|promote|demote <email>
+  apps ls [--all] [--stopped]
+  invite create [--uses=N] [--expires=7d]
+  invite ls
+  bans ls [--all]
+  bans rm <ip>|--all
+  reconcile [--dry-run]
+  migrate [status|up]`
+		if isJSON {
+			WriteJSON(sess, false, "", nil, errors.New(usage))
+		} else {
+			fmt.Fprintln(sess, usage)
+		}
+	}
+}
+
+func handleAdminUsersLs(sess ssh.Session, d *db.Database, isJSON bool) {
+	rows, err := d.Conn.Query(`SELECT u.id, COALESCE(u.email, ''), u.is_admin, u.disabled, u.created_at,
+		(SELECT COUNT(*) FROM apps a WHERE a.user_id = u.id),
+		(SELECT COUNT(*) FROM public_keys k WHERE k.user_id = u.id)
+		FROM users u ORDER BY u.id`)
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error listing users: %v\n", err)
+		}
+		return
+	}
+	defer rows.Close()
+
+	type userInfo struct {
+		ID       int    `json:"id"`
+		Email    string `json:"email"`
+		Admin    bool   `json:"is_admin"`
+		Disabled bool   `json:"disabled"`
+		Created  string `json:"created_at"`
+		Apps     int    `json:"apps"`
+		Keys     int    `json:"keys"`
+	}
+	var users []userInfo
+
+	if !isJSON {
+		fmt.Fprintf(sess, "%-5s %-35s %-6s %-9s %-5s %-5s %-20s\n", "ID", "EMAIL", "ADMIN", "DISABLED", "APPS", "KEYS", "CREATED")
+		fmt.Fprintf(sess, "%-5s %-35s %-6s %-9s %-5s %-5s %-20s\n", "--", "-----", "-----", "--------", "----", "----", "-------")
+	}
+
+	for rows.Next() {
+		var u userInfo
+		rows.Scan(&u.ID, &u.Email, &u.Admin, &u.Disabled, &u.Created, &u.Apps, &u.Keys)
+		if isJSON {
+			users = append(users, u)
+		} else {
+			fmt.Fprintf(sess, "%-5d %-35s %-6t %-9t %-5d %-5d %-20s\n", u.ID, u.Email, u.Admin, u.Disabled, u.Apps, u.Keys, u.Created)
+		}
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"users": users}, nil)
+	}
+}
+
+func handleAdminUserSet(sess ssh.Session, action string, args []string, d *db.Database, userID int, isJSON bool) {
+	if len(args) == 0 {
+		msg := fmt.Sprintf("Usage: admin users %s <email>", action)
+		if isJSON {
+			WriteJSON(sess, false, "", nil, errors.New(msg))
+		} else {
+			fmt.Fprintln(sess, msg)
+		}
+		return
+	}
+
+	email := args[0]
+	var err error
+	var targetID int
+	if err = d.Conn.QueryRow("SELECT id FROM users WHERE lower(email) = lower(?)", email).Scan(&targetID); err != nil {
+		err = fmt.Errorf("user '%s' not found", email)
+	} else if targetID == userID && (action == "disable" || action == "demote") {
+		err = fmt.Errorf("refusing to %s yourself", action)
+	} else {
+		var query string
+		switch action {
+		case "disable":
+			query = "UPDATE users SET disabled = 1 WHERE id = ?"
+		case "enable":
+			query = "UPDATE users SET disabled = 0 WHERE id = ?"
+		case "promote":
+			query = "UPDATE users SET is_admin = 1 WHERE id = ?"
+		case "demote":
+			query = "UPDATE users SET is_admin = 0 WHERE id = ?"
+		}
+		_, err = d.Conn.Exec(query, targetID)
+	}
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	remoteIP, _ := sess.Context().Value("remote_ip").(string)
+	d.LogAudit("admin_user_"+action, userID, "", remoteIP, fmt.Sprintf("target_user=%d email=%s", targetID, email))
+
+	if isJSON {
+		WriteJSON(sess, true, fmt.Sprintf("User '%s' updated", email), map[string]interface{}{"user_id": targetID, "action": action}, nil)
+	} else {
+		fmt.Fprintf(sess, "User '%s' updated (%s)\n", email, action)
+	}
+}
+
+// handleAdminAppsLs lists the admin's own apps, or every user's with --all.
+// --stopped only shows apps that aren't running.
+func handleAdminAppsLs(sess ssh.Session, d *db.Database, r Runner, userID int, all, stopped, isJSON bool) {
+	rows, err := d.Conn.Query(`SELECT a.name, a.image, a.status, COALESCE(u.email, ''), a.created_at
+		FROM apps a LEFT JOIN users u ON u.id = a.user_id WHERE ? OR a.user_id = ? ORDER BY a.name`, all, userID)
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error listing apps: %v\n", err)
+		}
+		return
+	}
+	defer rows.Close()
+
+	type appInfo struct {
+		Name    string `json:"vm_name"`
+		Image   string `json:"image"`
+		Status  string `json:"status"`
+		Owner   string `json:"owner"`
+		Created string `json:"created_at"`
+	}
+	var apps []appInfo
+
+	if !isJSON {
+		fmt.Fprintf(sess, "%-25s %-25s %-12s %-30s %-20s\n", "NAME", "IMAGE", "STATUS", "OWNER", "CREATED")
+		fmt.Fprintf(sess, "%-25s %-25s %-12s %-30s %-20s\n", "----", "-----", "------", "-----", "-------")
+	}
+
+	for rows.Next() {
+		var a appInfo
+		var dbStatus string
+		rows.Scan(&a.Name, &a.Image, &dbStatus, &a.Owner, &a.Created)
+
+		// Sync with Docker
+		status, err := r.GetAppStatus(sess.Context(), a.Name)
+		if err != nil {
+			status = dbStatus
+		}
+		a.Status = status
+		if stopped && status == "running" {
+			continue
+		}
+
+		if isJSON {
+			apps = append(apps, a)
+		} else {
+			fmt.Fprintf(sess, "%-25s %-25s %-12s %-30s %-20s\n", a.Name, a.Image, a.Status, a.Owner, a.Created)
+		}
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"vms": apps}, nil)
+	}
+}
+
+func handleAdminInviteCreate(sess ssh.Session, args []string, d *db.Database, userID int, isJSON bool) {
+	uses := 1
+	if v := FlagValue(args, "--uses"); v != "" {
+		if _, err := fmt.Sscanf(v, "%d", &uses); err != nil || uses < 1 {
+			err = fmt.Errorf("invalid --uses value %q", v)
+			if isJSON {
+				WriteJSON(sess, false, "", nil, err)
+			} else {
+				fmt.Fprintf(sess, "Error: %v\n", err)
+			}
+			return
+		}
+	}
+
+	var expiresAt interface{}
+	if v := FlagValue(args, "--expires"); v != "" {
+		ttl, err := ParseDuration(v)
+		if err != nil {
+			if isJSON {
+				WriteJSON(sess, false, "", nil, err)
+			} else {
+				fmt.Fprintf(sess, "Error: %v\n", err)
+			}
+			return
+		}
+		expiresAt = time.Now().UTC().Add(ttl).Format("2006-01-02 15:04:05")
+	}
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	code := hex.EncodeToString(buf)
+
+	_, err := d.Conn.Exec("INSERT INTO invites (code, created_by, max_uses, expires_at) VALUES (?, ?, ?, ?)", code, userID, uses, expiresAt)
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error creating invite: %v\n", err)
+		}
+		return
+	}
+
+	remoteIP, _ := sess.Context().Value("remote_ip").(string)
+	d.LogAudit("admin_invite_create", userID, "", remoteIP, fmt.Sprintf("code=%s uses=%d expires=%v", code, uses, expiresAt))
+
+	if isJSON {
+		WriteJSON(sess, true, "Invite created", map[string]interface{}{
+			"code":       code,
+			"max_uses":   uses,
+			"expires_at": expiresAt,
+		}, nil)
+	} else {
+		fmt.Fprintf(sess, "Invite code: %s (uses: %d", code, uses)
+		if expiresAt != nil {
+			fmt.Fprintf(sess, ", expires: %s UTC", expiresAt)
+		}
+		fmt.Fprintln(sess, ")")
+	}
+}
+
+func handleAdminInviteLs(sess ssh.Session, d *db.Database, isJSON bool) {
+	rows, err := d.Conn.Query(`SELECT i.code, i.uses, i.max_uses, COALESCE(i.expires_at, ''), COALESCE(u.email, ''), i.created_at
+		FROM invites i LEFT JOIN users u ON u.id = i.created_by ORDER BY i.id`)
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error listing invites: %v\n", err)
+		}
+		return
+	}
+	defer rows.Close()
+
+	type inviteInfo struct {
+		Code      string `json:"code"`
+		Uses      int    `json:"uses"`
+		MaxUses   int    `json:"max_uses"`
+		ExpiresAt string `json:"expires_at,omitempty"`
+		CreatedBy string `json:"created_by"`
+		Created   string `json:"created_at"`
+	}
+	var invites []inviteInfo
+
+	if !isJSON {
+		fmt.Fprintf(sess, "%-18s %-7s %-20s %-30s %-20s\n", "CODE", "USES", "EXPIRES", "CREATED BY", "CREATED")
+		fmt.Fprintf(sess, "%-18s %-7s %-20s %-30s %-20s\n", "----", "----", "-------", "----------", "-------")
+	}
+
+	for rows.Next() {
+		var i inviteInfo
+		rows.Scan(&i.Code, &i.Uses, &i.MaxUses, &i.ExpiresAt, &i.CreatedBy, &i.Created)
+		if isJSON {
+			invites = append(invites, i)
+		} else {
+			expires := i.ExpiresAt
+			if expires == "" {
+				expires = "never"
+			}
+			fmt.Fprintf(sess, "%-18s %-7s %-20s %-30s %-20s\n", i.Code, fmt.Sprintf("%d/%d", i.Uses, i.MaxUses), expires, i.CreatedBy, i.Created)
+		}
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"invites": invites}, nil)
+	}
+}
+
+// handleAdminBansLs lists client bans. Expired bans are kept to escalate
+// repeat offenders and only shown with --all.
+func handleAdminBansLs(sess ssh.Session, d *db.Database, all, isJSON bool) {
+	query := `SELECT client, COALESCE(reason, ''), ban_count, banned_until, banned_until > datetime('now'), updated_at FROM bans`
+	if !all {
+		query += " WHERE banned_until > datetime('now')"
+	}
+	rows, err := d.Conn.Query(query + " ORDER BY banned_until DESC")
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error listing bans: %v\n", err)
+		}
+		return
+	}
+	defer rows.Close()
+
+	type banInfo struct {
+		Client  string `json:"client"`
+		Reason  string `json:"reason"`
+		Count   int    `json:"ban_count"`
+		Until   string `json:"banned_until"`
+		Active  bool   `json:"active"`
+		Updated string `json:"updated_at"`
+	}
+	var bans []banInfo
+
+	if !isJSON {
+		fmt.Fprintf(sess, "%-40s %-25s %-6s %-7s %-20s\n", "CLIENT", "REASON", "COUNT", "ACTIVE", "UNTIL")
+		fmt.Fprintf(sess, "%-40s %-25s %-6s %-7s %-20s\n", "------", "------", "-----", "------", "-----")
+	}
+
+	for rows.Next() {
+		var b banInfo
+		rows.Scan(&b.Client, &b.Reason, &b.Count, &b.Until, &b.Active, &b.Updated)
+		if isJSON {
+			bans = append(bans, b)
+		} else {
+			fmt.Fprintf(sess, "%-40s %-25s %-6d %-7t %-20s\n", b.Client, b.Reason, b.Count, b.Active, b.Until)
+		}
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"bans": bans}, nil)
+	}
+}
+
+// handleAdminBansRm lifts a ban and forgets its history, so the client's next
+// ban starts short again
+func handleAdminBansRm(sess ssh.Session, args []string, d *db.Database, userID int, isJSON bool) {
+	var err error
+	var client string
+	var removed int64
+	switch {
+	case HasFlag(args, "--all"):
+		client = "all"
+		var result sql.Result
+		if result, err = d.Conn.Exec("DELETE FROM bans"); err == nil {
+			removed, _ = result.RowsAffected()
+		}
+	case len(PositionalArgs(args)) == 1:
+		client = PositionalArgs(args)[0]
+		var result sql.Result
+		if result, err = d.Conn.Exec("DELETE FROM bans WHERE client = ?", client); err == nil {
+			if removed, _ = result.RowsAffected(); removed == 0 {
+				err = fmt.Errorf("no ban for '%s'", client)
+			}
+		}
+	default:
+		err = errors.New("usage: admin bans rm <ip>|--all")
+	}
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	remoteIP, _ := sess.Context().Value("remote_ip").(string)
+	d.LogAudit("admin_unban", userID, "", remoteIP, fmt.Sprintf("client=%s removed=%d", client, removed))
+
+	if isJSON {
+		WriteJSON(sess, true, fmt.Sprintf("Removed %d ban(s)", removed), map[string]interface{}{"removed": removed}, nil)
+	} else {
+		fmt.Fprintf(sess, "Removed %d ban(s)\n", removed)
+	}
+}
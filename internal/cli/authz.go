@@ -0,0 +1,25 @@
+package cli
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+)
+
+// subjectOf identifies the session's user to the policy engine
+func subjectOf(sess ssh.Session) policy.Subject {
+	return policy.SubjectFromContext(sess.Context())
+}
+
+func authorizeApp(sess ssh.Session, d *db.Database, cfg *config.Config, action policy.Action, appName string) (int, error) {
+	return policy.New(d, cfg).AuthorizeApp(subjectOf(sess), action, appName)
+}
+
+func authorizeOrg(sess ssh.Session, d *db.Database, cfg *config.Config, action policy.Action, orgName string) (int, error) {
+	return policy.New(d, cfg).AuthorizeOrg(subjectOf(sess), action, orgName)
+}
+
+func authorize(sess ssh.Session, d *db.Database, cfg *config.Config, action policy.Action) error {
+	return policy.New(d, cfg).Authorize(subjectOf(sess), action)
+}
@@ -4,18 +4,27 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/gliderlabs/ssh"
-	"github.com/moby/moby/client"
 	"github.com/rnzor/poor_man_exe/internal/caddy"
 	"github.com/rnzor/poor_man_exe/internal/config"
 	"github.com/rnzor/poor_man_exe/internal/db"
 	"github.com/rnzor/poor_man_exe/internal/runner"
-	gossh "golang.org/x/crypto/ssh"
+	"github.com/rnzor/poor_man_exe/internal/service"
+	"github.com/rnzor/poor_man_exe/internal/sessions"
+	"github.com/rnzor/poor_man_exe/internal/webauth"
 )
 
-func ExecuteCommand(sess ssh.Session, args []string, d *db.Database, r *runner.DockerRunner, c *caddy.Client, cfg *config.Config) {
+// Runner is the part of runner.DockerRunner the commands use, through the
+// service and the reconciler
+type Runner interface {
+	service.Runner
+	ListApps(ctx context.Context) ([]runner.AppContainer, error)
+}
+
+func ExecuteCommand(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, reg *sessions.Registry) {
 	if len(args) == 0 {
 		return
 	}
@@ -28,17 +37,49 @@ func ExecuteCommand(sess ssh.Session, args []string, d *db.Database, r *runner.D
 
 	switch cmd {
 	case "ls":
-		handleLs(sess, d, r, userID, isJSON)
+		handleLs(sess, d, r, c, cfg, userID, isJSON)
 	case "new":
 		handleNew(sess, args[1:], d, r, c, cfg, userID, isJSON)
+	case "describe":
+		handleDescribe(sess, args[1:], d, r, c, cfg, userID, isJSON)
 	case "rm":
-		handleRm(sess, args[1:], d, r, c, userID, isJSON)
+		handleRm(sess, args[1:], d, r, c, cfg, userID, isJSON)
+	case "start", "stop", "restart":
+		handleLifecycle(sess, cmd, args[1:], d, r, c, cfg, userID, isJSON)
+	case "logs":
+		handleLogs(sess, args[1:], d, r, c, cfg, userID, isJSON)
+	case "deploy":
+		handleDeploy(sess, args[1:], d, r, c, cfg, isJSON)
+	case "deploy-config":
+		handleDeployConfig(sess, args[1:], d, r, c, cfg, isJSON)
+	case "images":
+		handleImages(sess, args[1:], d, r, c, cfg, isJSON)
+	case "releases":
+		handleReleases(sess, args[1:], d, r, c, cfg, isJSON)
+	case "rollback":
+		handleRollback(sess, args[1:], d, r, c, cfg, isJSON)
+	case "env":
+		handleEnv(sess, args[1:], d, r, c, cfg, userID, isJSON)
 	case "share":
-		handleShare(sess, args[1:], d, c, cfg, userID, isJSON)
+		handleShare(sess, args[1:], d, r, c, cfg, userID, isJSON)
+	case "org":
+		handleOrg(sess, args[1:], d, cfg, userID, isJSON)
 	case "keys":
-		handleKeys(sess, args[1:], d, userID, isJSON)
+		handleKeys(sess, args[1:], d, cfg, userID, isJSON)
+	case "tokens":
+		handleTokens(sess, args[1:], d, cfg, userID, isJSON)
+	case "sessions":
+		handleSessions(sess, args[1:], d, cfg, reg, userID, isJSON)
 	case "whoami":
 		handleWhoami(sess, d, userID, isJSON)
+	case "login":
+		handleLogin(sess, args[1:], d, cfg, userID, isJSON)
+	case "admin":
+		handleAdmin(sess, args[1:], d, r, c, cfg, userID, isJSON)
+	case "reconcile":
+		handleReconcile(sess, args[1:], d, r, c, cfg, userID, isJSON)
+	case "migrate":
+		handleMigrate(sess, args[1:], d, cfg, userID, isJSON)
 	case "help":
 		handleHelp(sess)
 	default:
@@ -50,7 +91,7 @@ func ExecuteCommand(sess ssh.Session, args []string, d *db.Database, r *runner.D
 	}
 }
 
-func StartInteractiveCLI(sess ssh.Session, d *db.Database, r *runner.DockerRunner, c *caddy.Client, cfg *config.Config) {
+func StartInteractiveCLI(sess ssh.Session, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, reg *sessions.Registry) {
 	fmt.Fprintf(sess, "Poor Man's exe.dev CLI\nType 'help' for commands.\n\n")
 
 	for {
@@ -71,12 +112,12 @@ func StartInteractiveCLI(sess ssh.Session, d *db.Database, r *runner.DockerRunne
 		}
 
 		args := strings.Fields(input)
-		ExecuteCommand(sess, args, d, r, c, cfg)
+		ExecuteCommand(sess, args, d, r, c, cfg, reg)
 	}
 }
 
-func handleLs(sess ssh.Session, d *db.Database, r *runner.DockerRunner, userID int, isJSON bool) {
-	rows, err := d.Conn.Query("SELECT name, image, status, created_at FROM apps WHERE user_id = ?", userID)
+func handleLs(sess ssh.Session, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
+	apps, err := service.New(d, r, c, cfg).ListApps(sess.Context(), subjectOf(sess))
 	if err != nil {
 		if isJSON {
 			WriteJSON(sess, false, "", nil, err)
@@ -85,109 +126,125 @@ func handleLs(sess ssh.Session, d *db.Database, r *runner.DockerRunner, userID i
 		}
 		return
 	}
-	defer rows.Close()
 
-	type appInfo struct {
-		Name    string `json:"vm_name"`
-		Image   string `json:"image"`
-		Status  string `json:"status"`
-		Created string `json:"created_at"`
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"vms": apps}, nil)
+		return
 	}
-	var apps []appInfo
 
-	if !isJSON {
-		fmt.Fprintf(sess, "%-25s %-25s %-12s %-20s\n", "NAME", "IMAGE", "STATUS", "CREATED")
-		fmt.Fprintf(sess, "%-25s %-25s %-12s %-20s\n", "----", "-----", "------", "-------")
+	fmt.Fprintf(sess, "%-25s %-25s %-12s %-8s %-5s %-6s %-20s\n", "NAME", "IMAGE", "STATUS", "MEMORY", "CPUS", "PIDS", "CREATED")
+	fmt.Fprintf(sess, "%-25s %-25s %-12s %-8s %-5s %-6s %-20s\n", "----", "-----", "------", "------", "----", "----", "-------")
+	for _, app := range apps {
+		memory, cpus, pids := formatLimits(app.Limits)
+		fmt.Fprintf(sess, "%-25s %-25s %-12s %-8s %-5s %-6s %-20s\n", app.Name, app.Image, app.Status, memory, cpus, pids, app.Created)
 	}
+}
 
-	for rows.Next() {
-		var name, image, dbStatus, created string
-		rows.Scan(&name, &image, &dbStatus, &created)
-
-		// Sync with Docker
-		status, err := r.GetAppStatus(sess.Context(), name)
-		if err != nil {
-			status = dbStatus // Fallback to DB
+func handleNew(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
+	req := service.NewApp{
+		Name:  FlagValue(args, "--name"),
+		Image: FlagValue(args, "--image"),
+		Org:   FlagValue(args, "--org"),
+	}
+	if req.Name == "" {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, fmt.Errorf("usage: new --name=<name> [--image=<image>] [--org=<org>] [--memory=<mb>] [--cpus=<n>] [--pids=<n>]"))
+		} else {
+			fmt.Fprintf(sess, "Usage: new --name=<name> [--image=<image>] [--org=<org>] [--memory=<mb>] [--cpus=<n>] [--pids=<n>]\n")
 		}
+		return
+	}
 
+	// Pull progress streams ahead of the result: as NDJSON records with
+	// --json, so the result is the last line, otherwise as layer status lines.
+	// Closing the session cancels the pull.
+	if isJSON {
+		req.Pull = func(ev runner.PullEvent) { WriteNDJSON(sess, PullLine{Event: "pull", PullEvent: ev}) }
+	} else {
+		req.Pull = func(ev runner.PullEvent) { printPull(sess, ev) }
+	}
+
+	var app *service.AppDetail
+	var warnings []string
+	limits, err := parseLimits(args)
+	if err == nil {
+		req.Limits = limits
+		app, warnings, err = service.New(d, r, c, cfg).CreateApp(sess.Context(), subjectOf(sess), req)
+	}
+	if err != nil {
 		if isJSON {
-			apps = append(apps, appInfo{name, image, status, created})
+			WriteNDJSON(sess, ErrorResponse(err))
 		} else {
-			fmt.Fprintf(sess, "%-25s %-25s %-12s %-20s\n", name, image, status, created)
+			fmt.Fprintf(sess, "Error: %v\n", err)
 		}
+		return
 	}
 
 	if isJSON {
-		WriteJSON(sess, true, "", map[string]interface{}{"vms": apps}, nil)
+		WriteNDJSON(sess, Response{Success: true, Message: fmt.Sprintf("Successfully created app '%s'", app.Name), Data: app, Warnings: warnings})
+	} else {
+		writeWarnings(sess, warnings)
+		fmt.Fprintf(sess, "Successfully created app '%s' using image '%s'\n", app.Name, app.Image)
+		fmt.Fprintf(sess, "Endpoint: %s\n", app.Endpoint)
 	}
 }
 
-func handleNew(sess ssh.Session, args []string, d *db.Database, r *runner.DockerRunner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
-	name := ""
-	image := "alpine:latest"
-
-	for _, arg := range args {
-		if strings.HasPrefix(arg, "--name=") {
-			name = strings.TrimPrefix(arg, "--name=")
-		} else if strings.HasPrefix(arg, "--image=") {
-			image = strings.TrimPrefix(arg, "--image=")
-		}
+// printPull writes one line of image pull progress
+func printPull(w io.Writer, ev runner.PullEvent) {
+	switch {
+	case ev.Layer == "":
+		fmt.Fprintln(w, ev.Status)
+	case ev.Total > 0:
+		fmt.Fprintf(w, "%s: %s %s/%s\n", ev.Layer, ev.Status, formatBytes(ev.Current), formatBytes(ev.Total))
+	default:
+		fmt.Fprintf(w, "%s: %s\n", ev.Layer, ev.Status)
 	}
+}
 
-	if name == "" {
+func handleDescribe(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
+	positional := PositionalArgs(args)
+	if len(positional) == 0 {
 		if isJSON {
-			WriteJSON(sess, false, "", nil, fmt.Errorf("usage: new --name=<name> [--image=<image>]"))
+			WriteJSON(sess, false, "", nil, fmt.Errorf("usage: describe <app_name>"))
 		} else {
-			fmt.Fprintf(sess, "Usage: new --name=<name> [--image=<image>]\n")
+			fmt.Fprintf(sess, "Usage: describe <app_name>\n")
 		}
 		return
 	}
 
-	err := r.CreateApp(sess.Context(), name, image, userID)
+	app, err := service.New(d, r, c, cfg).DescribeApp(sess.Context(), subjectOf(sess), positional[0])
 	if err != nil {
 		if isJSON {
 			WriteJSON(sess, false, "", nil, err)
 		} else {
-			fmt.Fprintf(sess, "Error creating app: %v\n", err)
+			fmt.Fprintf(sess, "Error: %v\n", err)
 		}
 		return
 	}
 
-	_, err = d.Conn.Exec("INSERT INTO apps (name, image, user_id, status) VALUES (?, ?, ?, 'running')", name, image, userID)
-	if err != nil {
-		if isJSON {
-			WriteJSON(sess, false, "App created in Docker but failed to update registry", nil, err)
-		} else {
-			fmt.Fprintf(sess, "App created in Docker but failed to update registry: %v\n", err)
-		}
+	if isJSON {
+		WriteJSON(sess, true, "", app, nil)
 		return
 	}
 
-	// Add to Caddy
-	if err := c.UpsertRoute(name, cfg.Domain, 80); err != nil {
-		if !isJSON {
-			fmt.Fprintf(sess, "Warning: Failed to configure HTTP proxy: %v\n", err)
-		}
-	}
-
-	// Audit log
-	remoteIP, _ := sess.Context().Value("remote_ip").(string)
-	d.LogAudit("app_create", userID, name, remoteIP, "image="+image)
-
-	if isJSON {
-		WriteJSON(sess, true, fmt.Sprintf("Successfully created app '%s'", name), map[string]string{
-			"vm_name":  name,
-			"image":    image,
-			"status":   "running",
-			"endpoint": fmt.Sprintf("https://%s.%s", name, cfg.Domain),
-		}, nil)
-	} else {
-		fmt.Fprintf(sess, "Successfully created app '%s' using image '%s'\n", name, image)
-		fmt.Fprintf(sess, "Endpoint: https://%s.%s\n", name, cfg.Domain)
+	memory, cpus, pids := formatLimits(app.Limits)
+	fmt.Fprintf(sess, "Name:      %s\n", app.Name)
+	fmt.Fprintf(sess, "Image:     %s\n", app.Image)
+	fmt.Fprintf(sess, "Status:    %s\n", app.Status)
+	if app.Org != "" {
+		fmt.Fprintf(sess, "Org:       %s\n", app.Org)
 	}
+	fmt.Fprintf(sess, "Endpoint:  %s\n", app.Endpoint)
+	fmt.Fprintf(sess, "HTTP Port: %d\n", app.HTTPPort)
+	fmt.Fprintf(sess, "Public:    %t\n", app.IsPublic)
+	fmt.Fprintf(sess, "Health:    %s\n", app.HealthCheck)
+	fmt.Fprintf(sess, "Memory:    %s\n", memory)
+	fmt.Fprintf(sess, "CPUs:      %s\n", cpus)
+	fmt.Fprintf(sess, "PIDs:      %s\n", pids)
+	fmt.Fprintf(sess, "Created:   %s\n", app.Created)
 }
 
-func handleRm(sess ssh.Session, args []string, d *db.Database, r *runner.DockerRunner, c *caddy.Client, userID int, isJSON bool) {
+func handleRm(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
 	if len(args) == 0 {
 		if isJSON {
 			WriteJSON(sess, false, "", nil, fmt.Errorf("usage: rm <app_name>"))
@@ -198,53 +255,90 @@ func handleRm(sess ssh.Session, args []string, d *db.Database, r *runner.DockerR
 	}
 
 	name := args[0]
-	// Verify ownership
-	var exists bool
-	d.Conn.QueryRow("SELECT EXISTS(SELECT 1 FROM apps WHERE name = ? AND user_id = ?)", name, userID).Scan(&exists)
-	if !exists {
+	warnings, err := service.New(d, r, c, cfg).DeleteApp(sess.Context(), subjectOf(sess), name)
+	if err != nil {
 		if isJSON {
-			WriteJSON(sess, false, "", nil, fmt.Errorf("app '%s' not found or access denied", name))
+			WriteJSON(sess, false, "", nil, err)
 		} else {
-			fmt.Fprintf(sess, "Error: App '%s' not found or access denied.\n", name)
+			fmt.Fprintf(sess, "Error: %v\n", err)
 		}
 		return
 	}
 
-	// Remove from Caddy
-	if err := c.DeleteRoute(name); err != nil {
-		if !isJSON {
-			fmt.Fprintf(sess, "Warning: Failed to remove HTTP proxy: %v\n", err)
-		}
+	if isJSON {
+		WriteResponse(sess, Response{Success: true, Message: fmt.Sprintf("Successfully removed app '%s'", name), Warnings: warnings})
+	} else {
+		writeWarnings(sess, warnings)
+		fmt.Fprintf(sess, "Successfully removed app '%s'\n", name)
 	}
+}
 
-	// Remove from Docker
-	containerName := fmt.Sprintf("poor-exe-%s", name)
-	_, err := r.Cli.ContainerRemove(context.Background(), containerName, client.ContainerRemoveOptions{Force: true})
-	if err != nil {
-		if !isJSON {
-			fmt.Fprintf(sess, "Warning: Failed to remove container from Docker: %v\n", err)
+// handleLifecycle starts, stops or restarts an app's container without
+// recreating it, so the container filesystem survives the bounce.
+func handleLifecycle(sess ssh.Session, cmd string, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
+	if len(PositionalArgs(args)) == 0 {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, fmt.Errorf("usage: %s <app_name>", cmd))
+		} else {
+			fmt.Fprintf(sess, "Usage: %s <app_name>\n", cmd)
 		}
+		return
 	}
 
-	// Remove from DB
-	_, err = d.Conn.Exec("DELETE FROM apps WHERE name = ? AND user_id = ?", name, userID)
+	name := PositionalArgs(args)[0]
+	status, warnings, err := service.New(d, r, c, cfg).Lifecycle(sess.Context(), subjectOf(sess), cmd, name)
 	if err != nil {
 		if isJSON {
 			WriteJSON(sess, false, "", nil, err)
 		} else {
-			fmt.Fprintf(sess, "Error removing app from registry: %v\n", err)
+			fmt.Fprintf(sess, "Error: %v\n", err)
 		}
 		return
 	}
 
-	// Audit log
-	remoteIP, _ := sess.Context().Value("remote_ip").(string)
-	d.LogAudit("app_delete", userID, name, remoteIP, "")
-
+	verb := map[string]string{"start": "started", "stop": "stopped", "restart": "restarted"}[cmd]
 	if isJSON {
-		WriteJSON(sess, true, fmt.Sprintf("Successfully removed app '%s'", name), nil, nil)
+		WriteResponse(sess, Response{Success: true, Message: fmt.Sprintf("Successfully %s app '%s'", verb, name), Data: map[string]string{
+			"vm_name": name,
+			"status":  status,
+		}, Warnings: warnings})
 	} else {
-		fmt.Fprintf(sess, "Successfully removed app '%s'\n", name)
+		writeWarnings(sess, warnings)
+		fmt.Fprintf(sess, "Successfully %s app '%s'\n", verb, name)
+	}
+}
+
+func handleLogs(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
+	positional := PositionalArgs(args)
+	if len(positional) == 0 {
+		if isJSON {
+			WriteNDJSON(sess, Response{Success: false, Error: "usage: logs <app_name> [--follow] [--timestamps] [--since=<time>] [--tail=<n>]"})
+		} else {
+			fmt.Fprintf(sess, "Usage: logs <app_name> [--follow] [--timestamps] [--since=<time>] [--tail=<n>]\n")
+		}
+		return
+	}
+
+	name := positional[0]
+	opts := runner.LogOptions{
+		Follow:     HasFlag(args, "--follow") || HasFlag(args, "-f"),
+		Timestamps: HasFlag(args, "--timestamps") || HasFlag(args, "-t"),
+		Since:      FlagValue(args, "--since"),
+		Tail:       FlagValue(args, "--tail"),
+	}
+	svc := service.New(d, r, c, cfg)
+
+	if isJSON {
+		err := StreamLogsJSON(sess, opts.Timestamps, func(stdout, stderr io.Writer) error {
+			return svc.Logs(sess.Context(), subjectOf(sess), name, opts, stdout, stderr)
+		})
+		if err != nil {
+			WriteNDJSON(sess, ErrorResponse(err))
+		}
+		return
+	}
+	if err := svc.Logs(sess.Context(), subjectOf(sess), name, opts, sess, sess.Stderr()); err != nil {
+		fmt.Fprintf(sess.Stderr(), "Error: %v\n", err)
 	}
 }
 
@@ -261,75 +355,62 @@ func handleWhoami(sess ssh.Session, d *db.Database, userID int, isJSON bool) {
 	}
 }
 
-func handleShare(sess ssh.Session, args []string, d *db.Database, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
-	if len(args) < 2 {
-		usage := "Usage: share <cmd> <vm> [args]\nCmds: set-public, set-private, port, add, remove"
+// handleLogin issues a one-time URL that logs the browser into private apps
+// as the SSH user, for setups without SMTP or when email is inconvenient.
+func handleLogin(sess ssh.Session, args []string, d *db.Database, cfg *config.Config, userID int, isJSON bool) {
+	var email string
+	d.Conn.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+	if email == "" {
 		if isJSON {
-			WriteJSON(sess, false, "", nil, errors.New(usage))
+			WriteJSON(sess, false, "", nil, errors.New("your account has no email address"))
 		} else {
-			fmt.Fprintln(sess, usage)
+			fmt.Fprintln(sess, "Error: your account has no email address.")
 		}
 		return
 	}
 
-	cmd := args[0]
-	vmName := args[1]
+	redirect := ""
+	if positional := PositionalArgs(args); len(positional) > 0 {
+		redirect = fmt.Sprintf("https://%s.%s/", positional[0], cfg.Domain)
+	}
 
-	// Verify ownership
-	var appID int
-	var currentPort int
-	err := d.Conn.QueryRow("SELECT id, http_port FROM apps WHERE name = ? AND user_id = ?", vmName, userID).Scan(&appID, &currentPort)
+	token, err := webauth.IssueLoginToken(d, email)
 	if err != nil {
 		if isJSON {
-			WriteJSON(sess, false, "", nil, fmt.Errorf("app '%s' not found or access denied", vmName))
+			WriteJSON(sess, false, "", nil, err)
 		} else {
-			fmt.Fprintf(sess, "Error: App '%s' not found.\n", vmName)
+			fmt.Fprintf(sess, "Error creating login link: %v\n", err)
 		}
 		return
 	}
+	link := webauth.LoginURL(cfg, token, redirect)
 
-	switch cmd {
-	case "set-public":
-		_, err = d.Conn.Exec("UPDATE apps SET is_public = 1 WHERE id = ?", appID)
-	case "set-private":
-		_, err = d.Conn.Exec("UPDATE apps SET is_public = 0 WHERE id = ?", appID)
-	case "port":
-		if len(args) < 3 {
-			err = fmt.Errorf("usage: share port <vm> <port>")
-		} else {
-			_, err = d.Conn.Exec("UPDATE apps SET http_port = ? WHERE id = ?", args[2], appID)
-			if err == nil {
-				// Update Caddy too
-				port := 80
-				fmt.Sscanf(args[2], "%d", &port)
-				c.UpsertRoute(vmName, cfg.Domain, port)
-			}
-		}
-	case "add":
-		if len(args) < 3 {
-			err = fmt.Errorf("usage: share add <vm> <email>")
-		} else {
-			_, err = d.Conn.Exec("INSERT OR IGNORE INTO app_shares (app_id, email) VALUES (?, ?)", appID, args[2])
-		}
-	case "remove":
-		if len(args) < 3 {
-			err = fmt.Errorf("usage: share remove <vm> <email>")
+	remoteIP, _ := sess.Context().Value("remote_ip").(string)
+	d.LogAudit("web_login_issued", userID, "", remoteIP, "")
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]string{"url": link, "email": email}, nil)
+	} else {
+		fmt.Fprintf(sess, "Open this link within %s to log in as %s:\n%s\n", webauth.LoginTokenTTL, email, link)
+	}
+}
+
+func handleShare(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
+	if len(args) < 2 {
+		usage := "Usage: share <cmd> <vm> [args]\nCmds: set-public, set-private, port, add, remove"
+		if isJSON {
+			WriteJSON(sess, false, "", nil, errors.New(usage))
 		} else {
-			_, err = d.Conn.Exec("DELETE FROM app_shares WHERE app_id = ? AND email = ?", appID, args[2])
+			fmt.Fprintln(sess, usage)
 		}
-	default:
-		err = fmt.Errorf("unknown share command: %s", cmd)
+		return
 	}
 
-	if err == nil {
-		// Audit log
-		remoteIP, _ := sess.Context().Value("remote_ip").(string)
-		details := cmd
-		if len(args) >= 3 {
-			details = cmd + " " + args[2]
-		}
-		d.LogAudit("share_change", userID, vmName, remoteIP, details)
+	cmd, vmName, arg := args[0], args[1], ""
+	if len(args) >= 3 {
+		arg = args[2]
 	}
+	err := service.New(d, r, c, cfg).Share(sess.Context(), subjectOf(sess), cmd, vmName, arg)
 
 	if isJSON {
 		WriteJSON(sess, err == nil, "", nil, err)
@@ -340,15 +421,51 @@ func handleShare(sess ssh.Session, args []string, d *db.Database, c *caddy.Clien
 	}
 }
 
+// writeWarnings reports side effects that failed without failing the command
+func writeWarnings(sess ssh.Session, warnings []string) {
+	for _, w := range warnings {
+		fmt.Fprintf(sess, "Warning: %s\n", w)
+	}
+}
+
 func handleHelp(sess ssh.Session) {
 	help := `
 Available commands:
   ls                     List your apps
-  new --name=X           Create a new app
+  new --name=X           Create a new app (--image, --org, --memory, --cpus, --pids)
+  describe <app>         Show app details and limits
   rm <app>               Delete an app
+  start <app>            Start a stopped app
+  stop <app>             Stop a running app
+  restart <app>          Restart an app
+  logs <app> [-f]        Show app output (--since, --tail, -t)
+  deploy <app>           Build the tar build context on stdin and deploy it
+                         (tar cz . | ssh <host> deploy <app>)
+  deploy-config <app> [health=<check>]
+                         Show or set the redeploy health check
+                         (tcp, http:/path, none or default)
+  images <app>           List the versions deployed to an app
+  releases <app>         List the configurations an app has run
+  rollback <app> [--to=N]
+                         Go back to the previous (or given) release
+  env <cmd> <app>        Manage environment variables
   share <cmd> <vm>       Update sharing settings
-  keys [add|rm]          Manage SSH keys
+  org <cmd>              Manage organizations (ls, create, invite, remove,
+                         members, move)
+  keys [add|rm]          Manage SSH keys (add with no key reads stdin)
+                         add/import take --expires=30d and --apps=a,b
+  keys import [<user>|<url>]
+                         Add keys from stdin or a forge's <user>.keys
+  keys sign [--ttl=8h] [--apps=a,b]
+                         Issue a short-lived certificate for your key
+  tokens [create|revoke] Manage HTTP API tokens (create <name> [--expires=90d])
+  sessions [ls|kill <id>]
+                         List or end your live SSH sessions (admins: all)
   whoami                 Show user info
+  login [app]            Get a one-time browser login link for private apps
+  admin <group> <cmd>    Manage users, apps and invites (admin)
+  reconcile [--dry-run]  Repair drift between registry, Docker and Caddy (admin)
+  migrate [status|up]    Show or apply database migrations (admin)
   help                   Show this help
   exit                   Disconnect
 
@@ -357,133 +474,3 @@ Options:
 `
 	fmt.Fprint(sess, help)
 }
-
-func handleKeys(sess ssh.Session, args []string, d *db.Database, userID int, isJSON bool) {
-	if len(args) == 0 {
-		// List keys
-		rows, err := d.Conn.Query("SELECT fingerprint, comment, created_at FROM public_keys WHERE user_id = ?", userID)
-		if err != nil {
-			if isJSON {
-				WriteJSON(sess, false, "", nil, err)
-			} else {
-				fmt.Fprintf(sess, "Error listing keys: %v\n", err)
-			}
-			return
-		}
-		defer rows.Close()
-
-		type keyInfo struct {
-			Fingerprint string `json:"fingerprint"`
-			Comment     string `json:"comment"`
-			Created     string `json:"created_at"`
-		}
-		var keys []keyInfo
-
-		if !isJSON {
-			fmt.Fprintf(sess, "%-50s %-20s %-20s\n", "FINGERPRINT", "COMMENT", "CREATED")
-			fmt.Fprintf(sess, "%-50s %-20s %-20s\n", "-----------", "-------", "-------")
-		}
-
-		for rows.Next() {
-			var fp, comment, created string
-			rows.Scan(&fp, &comment, &created)
-			if isJSON {
-				keys = append(keys, keyInfo{fp, comment, created})
-			} else {
-				fmt.Fprintf(sess, "%-50s %-20s %-20s\n", fp, comment, created)
-			}
-		}
-
-		if isJSON {
-			WriteJSON(sess, true, "", map[string]interface{}{"keys": keys}, nil)
-		}
-		return
-	}
-
-	cmd := args[0]
-	switch cmd {
-	case "add":
-		if len(args) < 2 {
-			msg := "Usage: keys add <public_key_data>"
-			if isJSON {
-				WriteJSON(sess, false, "", nil, errors.New(msg))
-			} else {
-				fmt.Fprintln(sess, msg)
-			}
-			return
-		}
-		// Join all remaining args as key data (may contain spaces)
-		keyData := strings.Join(args[1:], " ")
-		// Parse the public key and compute proper fingerprint
-		pubKey, comment, _, _, err := gossh.ParseAuthorizedKey([]byte(keyData))
-		if err != nil {
-			if isJSON {
-				WriteJSON(sess, false, "", nil, fmt.Errorf("invalid SSH key format: %v", err))
-			} else {
-				fmt.Fprintf(sess, "Error: invalid SSH key format: %v\n", err)
-			}
-			return
-		}
-		fingerprint := gossh.FingerprintSHA256(pubKey)
-
-		_, err = d.Conn.Exec("INSERT INTO public_keys (user_id, fingerprint, key_data, comment) VALUES (?, ?, ?, ?)",
-			userID, fingerprint, keyData, comment)
-		if err != nil {
-			if isJSON {
-				WriteJSON(sess, false, "", nil, err)
-			} else {
-				fmt.Fprintf(sess, "Error adding key: %v\n", err)
-			}
-			return
-		}
-		if isJSON {
-			WriteJSON(sess, true, "Key added", map[string]string{"fingerprint": fingerprint}, nil)
-		} else {
-			fmt.Fprintf(sess, "Key added: %s\n", fingerprint)
-		}
-
-	case "rm":
-		if len(args) < 2 {
-			msg := "Usage: keys rm <fingerprint>"
-			if isJSON {
-				WriteJSON(sess, false, "", nil, errors.New(msg))
-			} else {
-				fmt.Fprintln(sess, msg)
-			}
-			return
-		}
-		fp := args[1]
-		result, err := d.Conn.Exec("DELETE FROM public_keys WHERE user_id = ? AND fingerprint = ?", userID, fp)
-		if err != nil {
-			if isJSON {
-				WriteJSON(sess, false, "", nil, err)
-			} else {
-				fmt.Fprintf(sess, "Error removing key: %v\n", err)
-			}
-			return
-		}
-		affected, _ := result.RowsAffected()
-		if affected == 0 {
-			msg := "Key not found"
-			if isJSON {
-				WriteJSON(sess, false, "", nil, errors.New(msg))
-			} else {
-				fmt.Fprintln(sess, msg)
-			}
-			return
-		}
-		if isJSON {
-			WriteJSON(sess, true, "Key removed", nil, nil)
-		} else {
-			fmt.Fprintln(sess, "Key removed")
-		}
-
-	default:
-		msg := "Usage: keys [add <key>|rm <fingerprint>]"
-		if isJSON {
-			WriteJSON(sess, false, "", nil, errors.New(msg))
-		} else {
-			fmt.Fprintln(sess, msg)
-		}
-	}
-}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/caddy"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+// fakeRunner records lifecycle calls instead of reaching Docker. Methods it
+// doesn't override panic through the nil embedded Runner.
+type fakeRunner struct {
+	Runner
+	calls []string
+}
+
+func (f *fakeRunner) StartApp(ctx context.Context, appName string) error {
+	f.calls = append(f.calls, "start "+appName)
+	return nil
+}
+
+func (f *fakeRunner) StopApp(ctx context.Context, appName string, timeout int) error {
+	f.calls = append(f.calls, "stop "+appName)
+	return nil
+}
+
+func (f *fakeRunner) RestartApp(ctx context.Context, appName string, timeout int) error {
+	f.calls = append(f.calls, "restart "+appName)
+	return nil
+}
+
+func (f *fakeRunner) Upstream(ctx context.Context, appName string, port int, dialByIP bool) (string, error) {
+	return fmt.Sprintf("poor-exe-%s:%d", appName, port), nil
+}
+
+func TestLifecycleCommands(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com'), (2, 'bob@example.com'), (3, 'carol@example.com')")
+	d.Conn.Exec("INSERT INTO orgs (id, name, created_by) VALUES (1, 'acme', 1)")
+	d.Conn.Exec("INSERT INTO org_members (org_id, user_id, role) VALUES (1, 1, 'owner'), (1, 2, 'viewer')")
+	d.Conn.Exec("INSERT INTO apps (name, user_id, org_id, status) VALUES ('bloggy', 1, 1, 'running')")
+
+	// Stand-in for Caddy's admin API
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer admin.Close()
+
+	fake := &fakeRunner{}
+	c := caddy.NewClient(admin.URL, "gateway:8080")
+	cfg := &config.Config{Domain: "example.com"}
+
+	tests := []struct {
+		name   string
+		userID int
+		args   []string
+		calls  []string // nil if Docker mustn't be reached
+		output string
+		status string
+	}{
+		{"missing app", 1, []string{"stop"}, nil, "Usage: stop <app_name>", "running"},
+		{"missing app json", 1, []string{"stop", "--json"}, nil, `"error": "usage: stop `, "running"},
+		{"stop", 1, []string{"stop", "bloggy"}, []string{"stop bloggy"}, "Successfully stopped app 'bloggy'", "stopped"},
+		{"flag first", 1, []string{"start", "--json", "bloggy"}, []string{"start bloggy"}, `"status": "running"`, "running"},
+		{"restart", 1, []string{"restart", "bloggy"}, []string{"restart bloggy"}, "Successfully restarted app 'bloggy'", "running"},
+		{"viewer", 2, []string{"stop", "bloggy"}, nil, "not found or access denied", "running"},
+		{"viewer json", 2, []string{"stop", "bloggy", "--json"}, nil, `"code": "access_denied"`, "running"},
+		{"outsider", 3, []string{"restart", "bloggy"}, nil, "not found or access denied", "running"},
+		{"unknown app", 1, []string{"start", "ghost"}, nil, "not found or access denied", "running"},
+	}
+	for _, tt := range tests {
+		fake.calls = nil
+		sess := newFakeSession(tt.args...)
+		sess.ctx.values["user_id"] = tt.userID
+		ExecuteCommand(sess, tt.args, d, fake, c, cfg, nil)
+
+		if !reflect.DeepEqual(fake.calls, tt.calls) {
+			t.Errorf("%s: expected Docker calls %v, got %v", tt.name, tt.calls, fake.calls)
+		}
+		if !strings.Contains(sess.out.String(), tt.output) {
+			t.Errorf("%s: expected output mentioning %q, got %q", tt.name, tt.output, sess.out.String())
+		}
+		var status string
+		d.Conn.QueryRow("SELECT status FROM apps WHERE name = 'bloggy'").Scan(&status)
+		if status != tt.status {
+			t.Errorf("%s: expected status %q, got %q", tt.name, tt.status, status)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/caddy"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/service"
+)
+
+// handleDeploy builds the tar build context piped on stdin and rolls the app
+// onto the new image. Build output streams to stdout, or to stderr with
+// --json so stdout stays a single JSON document.
+func handleDeploy(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, isJSON bool) {
+	positional := PositionalArgs(args)
+	var err error
+	if len(positional) == 0 {
+		err = errors.New("usage: deploy <app_name> < build-context.tar, e.g. tar cz . | ssh <host> deploy <app_name>")
+	} else if _, _, isPty := sess.Pty(); isPty {
+		err = fmt.Errorf("pipe a tar build context on stdin, e.g. tar cz . | ssh <host> deploy %s", positional[0])
+	}
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	name := positional[0]
+	var out io.Writer = sess
+	if isJSON {
+		out = sess.Stderr()
+	}
+	built, warnings, err := service.New(d, r, c, cfg).Deploy(sess.Context(), subjectOf(sess), name, sess, "upload", out)
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		sess.Exit(1)
+		return
+	}
+
+	if isJSON {
+		WriteResponse(sess, Response{Success: true, Message: fmt.Sprintf("Deployed '%s' version %d", name, built.Version), Data: built, Warnings: warnings})
+	} else {
+		writeWarnings(sess, warnings)
+		fmt.Fprintf(sess, "Deployed '%s' version %d (%s)\n", name, built.Version, built.Image)
+		fmt.Fprintf(sess, "Endpoint: https://%s.%s\n", name, cfg.Domain)
+	}
+}
+
+// handleDeployConfig shows the app's redeploy settings, or changes those
+// given as name=value
+func handleDeployConfig(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, isJSON bool) {
+	positional := PositionalArgs(args)
+	if len(positional) == 0 {
+		usage := "Usage: deploy-config <app_name> [health=<tcp|http:/path|none|default>]"
+		if isJSON {
+			WriteJSON(sess, false, "", nil, errors.New(usage))
+		} else {
+			fmt.Fprintln(sess, usage)
+		}
+		return
+	}
+
+	name := positional[0]
+	svc := service.New(d, r, c, cfg)
+	var err error
+	if len(positional) > 1 {
+		settings := make(map[string]string)
+		for _, arg := range positional[1:] {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				err = fmt.Errorf("expected name=value, got '%s'", arg)
+				break
+			}
+			settings[key] = value
+		}
+		if err == nil {
+			err = svc.SetDeployConfig(subjectOf(sess), name, settings)
+		}
+	}
+	var conf *service.DeployConfig
+	if err == nil {
+		conf, err = svc.GetDeployConfig(subjectOf(sess), name)
+	}
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", conf, nil)
+		return
+	}
+	health := conf.HealthCheck
+	if conf.Default {
+		health += " (server default)"
+	}
+	fmt.Fprintf(sess, "Health check: %s\n", health)
+}
+
+func handleImages(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, isJSON bool) {
+	positional := PositionalArgs(args)
+	if len(positional) == 0 {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, errors.New("usage: images <app_name>"))
+		} else {
+			fmt.Fprintln(sess, "Usage: images <app_name>")
+		}
+		return
+	}
+
+	images, err := service.New(d, r, c, cfg).ListImages(subjectOf(sess), positional[0])
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"images": images}, nil)
+		return
+	}
+
+	fmt.Fprintf(sess, "%-8s %-35s %-20s %-25s %-20s\n", "VERSION", "IMAGE", "SOURCE", "DEPLOYED BY", "CREATED")
+	fmt.Fprintf(sess, "%-8s %-35s %-20s %-25s %-20s\n", "-------", "-----", "------", "-----------", "-------")
+	for _, img := range images {
+		fmt.Fprintf(sess, "%-8d %-35s %-20s %-25s %-20s\n", img.Version, img.Image, img.Source, img.By, img.Created)
+	}
+}
+
+func handleReleases(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, isJSON bool) {
+	positional := PositionalArgs(args)
+	if len(positional) == 0 {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, errors.New("usage: releases <app_name>"))
+		} else {
+			fmt.Fprintln(sess, "Usage: releases <app_name>")
+		}
+		return
+	}
+
+	releases, err := service.New(d, r, c, cfg).ListReleases(subjectOf(sess), positional[0])
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"releases": releases}, nil)
+		return
+	}
+
+	fmt.Fprintf(sess, "%-8s %-35s %-6s %-28s %-25s %-20s\n", "RELEASE", "IMAGE", "PORT", "REASON", "DEPLOYED BY", "CREATED")
+	fmt.Fprintf(sess, "%-8s %-35s %-6s %-28s %-25s %-20s\n", "-------", "-----", "----", "------", "-----------", "-------")
+	for i, rel := range releases {
+		marker := " "
+		if i == 0 {
+			marker = "*"
+		}
+		fmt.Fprintf(sess, "%-8s %-35s %-6d %-28s %-25s %-20s\n", fmt.Sprintf("%s%d", marker, rel.Version), rel.Image, rel.HTTPPort, rel.Reason, rel.By, rel.Created)
+	}
+}
+
+// handleRollback recreates an app from an earlier release, by default the
+// one before the current release
+func handleRollback(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, isJSON bool) {
+	positional := PositionalArgs(args)
+	var err error
+	version := 0
+	if len(positional) == 0 {
+		err = errors.New("usage: rollback <app_name> [--to=<release>]")
+	} else if to := strings.TrimPrefix(FlagValue(args, "--to"), "v"); to != "" {
+		if version, err = strconv.Atoi(to); err != nil || version < 1 {
+			err = fmt.Errorf("invalid release: %s", to)
+		}
+	}
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	name := positional[0]
+	rel, warnings, err := service.New(d, r, c, cfg).Rollback(sess.Context(), subjectOf(sess), name, version)
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	msg := fmt.Sprintf("Rolled back '%s' (%s), now release %d", name, rel.Reason, rel.Version)
+	if isJSON {
+		WriteResponse(sess, Response{Success: true, Message: msg, Data: rel, Warnings: warnings})
+	} else {
+		writeWarnings(sess, warnings)
+		fmt.Fprintln(sess, msg)
+		fmt.Fprintf(sess, "Image: %s\n", rel.Image)
+	}
+}
@@ -0,0 +1,106 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/caddy"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/service"
+)
+
+func handleEnv(sess ssh.Session, args []string, d *db.Database, r Runner, c *caddy.Client, cfg *config.Config, userID int, isJSON bool) {
+	positional := PositionalArgs(args)
+	if len(positional) < 2 {
+		usage := "Usage: env <cmd> <app> [args]\nCmds: ls [--show], set KEY=VAL... [--secret] [--recreate], unset KEY... [--recreate]"
+		if isJSON {
+			WriteJSON(sess, false, "", nil, errors.New(usage))
+		} else {
+			fmt.Fprintln(sess, usage)
+		}
+		return
+	}
+
+	cmd := positional[0]
+	appName := positional[1]
+	rest := positional[2:]
+	svc := service.New(d, r, c, cfg)
+	sub := subjectOf(sess)
+
+	var keys []string
+	var err error
+	switch cmd {
+	case "ls":
+		handleEnvLs(sess, svc, appName, HasFlag(args, "--show"), isJSON)
+		return
+	case "set":
+		keys, err = svc.SetEnv(sub, appName, rest, HasFlag(args, "--secret"))
+	case "unset":
+		keys, err = rest, svc.UnsetEnv(sub, appName, rest)
+	default:
+		err = fmt.Errorf("unknown env command: %s", cmd)
+	}
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	// Env is baked into the container at creation time
+	recreated := false
+	var warnings []string
+	if HasFlag(args, "--recreate") || (!isJSON && Confirm(sess, "Recreate the container now to apply the change?")) {
+		warnings, err = svc.ApplyEnv(sess.Context(), sub, appName)
+		if err != nil {
+			if isJSON {
+				WriteJSON(sess, false, "Environment updated but failed to recreate container", nil, err)
+			} else {
+				fmt.Fprintf(sess, "Environment updated but %v\n", err)
+			}
+			return
+		}
+		recreated = true
+	}
+
+	if isJSON {
+		WriteResponse(sess, Response{Success: true, Message: fmt.Sprintf("Updated environment for '%s'", appName), Data: map[string]interface{}{
+			"vm_name":   appName,
+			"keys":      keys,
+			"recreated": recreated,
+		}, Warnings: warnings})
+	} else {
+		writeWarnings(sess, warnings)
+		fmt.Fprintf(sess, "Updated environment for '%s'\n", appName)
+		if !recreated {
+			fmt.Fprintf(sess, "Run 'env %s %s ... --recreate' or recreate the app for it to take effect.\n", cmd, appName)
+		}
+	}
+}
+
+func handleEnvLs(sess ssh.Session, svc *service.Service, appName string, show, isJSON bool) {
+	vars, err := svc.ListEnv(subjectOf(sess), appName, show)
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"env": vars}, nil)
+		return
+	}
+
+	fmt.Fprintf(sess, "%-30s %-40s %-7s %-20s\n", "KEY", "VALUE", "SECRET", "UPDATED")
+	fmt.Fprintf(sess, "%-30s %-40s %-7s %-20s\n", "---", "-----", "------", "-------")
+	for _, v := range vars {
+		fmt.Fprintf(sess, "%-30s %-40s %-7t %-20s\n", v.Key, v.Value, v.Secret, v.Updated)
+	}
+}
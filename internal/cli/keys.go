@@ -0,0 +1,268 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/auth"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/service"
+)
+
+func handleKeys(sess ssh.Session, args []string, d *db.Database, cfg *config.Config, userID int, isJSON bool) {
+	if len(PositionalArgs(args)) == 0 {
+		handleKeysLs(sess, d, cfg, userID, isJSON)
+		return
+	}
+
+	positional := PositionalArgs(args)
+	cmd := positional[0]
+	switch cmd {
+	case "add", "import":
+		if err := keyImport(sess, cmd, args, d, cfg, userID, isJSON); err != nil {
+			if isJSON {
+				WriteJSON(sess, false, "", nil, err)
+			} else {
+				fmt.Fprintf(sess, "Error: %v\n", err)
+			}
+		}
+
+	case "rm":
+		if len(positional) < 2 {
+			msg := "Usage: keys rm <fingerprint>"
+			if isJSON {
+				WriteJSON(sess, false, "", nil, errors.New(msg))
+			} else {
+				fmt.Fprintln(sess, msg)
+			}
+			return
+		}
+		if err := service.New(d, nil, nil, cfg).RemoveKey(subjectOf(sess), positional[1]); err != nil {
+			if isJSON {
+				WriteJSON(sess, false, "", nil, err)
+			} else {
+				fmt.Fprintf(sess, "Error: %v\n", err)
+			}
+			return
+		}
+		if isJSON {
+			WriteJSON(sess, true, "Key removed", nil, nil)
+		} else {
+			fmt.Fprintln(sess, "Key removed")
+		}
+
+	case "sign":
+		if err := keySign(sess, args, d, cfg, userID, isJSON); err != nil {
+			if isJSON {
+				WriteJSON(sess, false, "", nil, err)
+			} else {
+				fmt.Fprintf(sess, "Error: %v\n", err)
+			}
+		}
+
+	case "certs":
+		handleCertsLs(sess, d, cfg, isJSON)
+
+	case "revoke":
+		var err error
+		if len(positional) < 2 {
+			err = errors.New("usage: keys revoke <serial>")
+		} else {
+			err = service.New(d, nil, nil, cfg).RevokeCert(subjectOf(sess), positional[1])
+		}
+		if err != nil {
+			if isJSON {
+				WriteJSON(sess, false, "", nil, err)
+			} else {
+				fmt.Fprintf(sess, "Error: %v\n", err)
+			}
+			return
+		}
+		if isJSON {
+			WriteJSON(sess, true, "Certificate revoked", nil, nil)
+		} else {
+			fmt.Fprintln(sess, "Certificate revoked")
+		}
+
+	default:
+		msg := "Usage: keys [add [<key>]|import [<user>|<url>]|rm <fingerprint>|sign [<key>] [--ttl=8h] [--apps=a,b]|certs|revoke <serial>]"
+		if isJSON {
+			WriteJSON(sess, false, "", nil, errors.New(msg))
+		} else {
+			fmt.Fprintln(sess, msg)
+		}
+	}
+}
+
+// keySign issues a short-lived certificate from the gateway's CA for a
+// public key given as args or on stdin, optionally restricted to some apps
+func keySign(sess ssh.Session, args []string, d *db.Database, cfg *config.Config, userID int, isJSON bool) error {
+	ttl := 8 * time.Hour
+	if v := FlagValue(args, "--ttl"); v != "" {
+		var err error
+		if ttl, err = ParseDuration(v); err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid --ttl '%s'", v)
+		}
+	}
+	var apps []string
+	if v := FlagValue(args, "--apps"); v != "" {
+		apps = strings.Split(v, ",")
+	}
+
+	var keyLine string
+	if positional := PositionalArgs(args); len(positional) > 1 {
+		keyLine = strings.Join(positional[1:], " ")
+	} else if _, _, isPty := sess.Pty(); isPty {
+		return errors.New("pass the public key to sign, e.g. ssh <host> keys sign < contractor.pub")
+	} else {
+		data, err := io.ReadAll(io.LimitReader(sess, service.MaxKeysSize))
+		if err != nil {
+			return err
+		}
+		keyLine = string(data)
+	}
+
+	cert, err := service.New(d, nil, nil, cfg).SignKey(subjectOf(sess), keyLine, apps, ttl, auth.RestrictionsFromContext(sess.Context()))
+	if err != nil {
+		return err
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "Certificate issued", cert, nil)
+		return nil
+	}
+	fmt.Fprintln(sess, cert.Certificate)
+	fmt.Fprintf(sess.Stderr(), "Serial %d, valid until %s UTC", cert.Serial, cert.Expires)
+	if len(cert.Apps) > 0 {
+		fmt.Fprintf(sess.Stderr(), " for %s", strings.Join(cert.Apps, ", "))
+	}
+	fmt.Fprintln(sess.Stderr(), ". Save it next to the private key as <key>-cert.pub.")
+	return nil
+}
+
+func handleCertsLs(sess ssh.Session, d *db.Database, cfg *config.Config, isJSON bool) {
+	certs, err := service.New(d, nil, nil, cfg).ListCerts(subjectOf(sess))
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error listing certificates: %v\n", err)
+		}
+		return
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"certificates": certs}, nil)
+		return
+	}
+
+	fmt.Fprintf(sess, "%-21s %-50s %-20s %-20s %s\n", "SERIAL", "FINGERPRINT", "EXPIRES", "REVOKED", "APPS")
+	fmt.Fprintf(sess, "%-21s %-50s %-20s %-20s %s\n", "------", "-----------", "-------", "-------", "----")
+	for _, c := range certs {
+		fmt.Fprintf(sess, "%-21d %-50s %-20s %-20s %s\n", c.Serial, c.Fingerprint, c.Expires, orDash(c.Revoked), orDash(strings.Join(c.Apps, ",")))
+	}
+}
+
+// keyImport adds every key from an authorized_keys stream: the key given as
+// args, stdin, or a forge's <user>.keys file
+func keyImport(sess ssh.Session, cmd string, args []string, d *db.Database, cfg *config.Config, userID int, isJSON bool) error {
+	limits := service.KeyLimits{Inherit: auth.RestrictionsFromContext(sess.Context())}
+	if v := FlagValue(args, "--expires"); v != "" {
+		ttl, err := ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid --expires '%s'", v)
+		}
+		limits.Expires = ttl
+	}
+	if v := FlagValue(args, "--apps"); v != "" {
+		limits.Apps = strings.Split(v, ",")
+	}
+	svc := service.New(d, nil, nil, cfg)
+	args = PositionalArgs(args)[1:]
+
+	var data []byte
+	var source string
+	var err error
+	switch {
+	case cmd == "add" && len(args) > 0:
+		// Key pasted as args (may contain spaces)
+		data, source = []byte(strings.Join(args, " ")), "args"
+	case len(args) == 0 || args[0] == "-":
+		if _, _, isPty := sess.Pty(); isPty {
+			return fmt.Errorf("pipe keys on stdin, e.g. ssh <host> keys %s < ~/.ssh/id_ed25519.pub", cmd)
+		}
+		if data, err = io.ReadAll(io.LimitReader(sess, service.MaxKeysSize)); err != nil {
+			return err
+		}
+		source = "stdin"
+	default:
+		if data, source, err = svc.ForgeKeys(sess.Context(), args[0]); err != nil {
+			return err
+		}
+	}
+
+	results, added, err := svc.ImportKeys(subjectOf(sess), data, source, limits)
+	if err != nil {
+		return err
+	}
+
+	if isJSON {
+		WriteJSON(sess, added > 0, fmt.Sprintf("Added %d of %d keys", added, len(results)),
+			map[string]interface{}{"keys": results, "added": added}, nil)
+		return nil
+	}
+	for _, res := range results {
+		switch res.Status {
+		case "invalid":
+			fmt.Fprintf(sess, "%-10s line %d: %s\n", res.Status, res.Line, res.Error)
+		case "added":
+			fmt.Fprintf(sess, "%-10s %s %s\n", res.Status, res.Fingerprint, res.Comment)
+		default:
+			fmt.Fprintf(sess, "%-10s %s %s (%s)\n", res.Status, res.Fingerprint, res.Comment, res.Error)
+		}
+	}
+	fmt.Fprintf(sess, "Added %d of %d keys\n", added, len(results))
+	return nil
+}
+
+func handleKeysLs(sess ssh.Session, d *db.Database, cfg *config.Config, userID int, isJSON bool) {
+	keys, err := service.New(d, nil, nil, cfg).ListKeys(subjectOf(sess))
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error listing keys: %v\n", err)
+		}
+		return
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"keys": keys}, nil)
+		return
+	}
+
+	fmt.Fprintf(sess, "%-50s %-15s %-20s %-20s %-16s %s\n", "FINGERPRINT", "COMMENT", "EXPIRES", "LAST USED", "FROM", "RESTRICTIONS")
+	fmt.Fprintf(sess, "%-50s %-15s %-20s %-20s %-16s %s\n", "-----------", "-------", "-------", "---------", "----", "------------")
+	for _, k := range keys {
+		var restrictions []string
+		if k.Options != "" {
+			restrictions = append(restrictions, k.Options)
+		}
+		if len(k.Apps) > 0 {
+			restrictions = append(restrictions, "apps="+strings.Join(k.Apps, ","))
+		}
+		fmt.Fprintf(sess, "%-50s %-15s %-20s %-20s %-16s %s\n", k.Fingerprint, k.Comment, orDash(k.Expires), orDash(k.LastUsed), orDash(k.LastUsedIP), orDash(strings.Join(restrictions, " ")))
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
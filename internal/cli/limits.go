@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rnzor/poor_man_exe/internal/runner"
+)
+
+// parseLimits reads --memory, --cpus and --pids. Unset limits stay zero and
+// get the server defaults when the app is created.
+func parseLimits(args []string) (runner.Limits, error) {
+	var limits runner.Limits
+	if v := FlagValue(args, "--memory"); v != "" {
+		mb, err := parseMemoryMB(v)
+		if err != nil {
+			return limits, err
+		}
+		limits.MemoryMB = mb
+	}
+	if v := FlagValue(args, "--cpus"); v != "" {
+		cpus, err := strconv.ParseFloat(v, 64)
+		if err != nil || cpus <= 0 {
+			return limits, fmt.Errorf("invalid --cpus value %q", v)
+		}
+		limits.CPUs = cpus
+	}
+	if v := FlagValue(args, "--pids"); v != "" {
+		pids, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || pids <= 0 {
+			return limits, fmt.Errorf("invalid --pids value %q", v)
+		}
+		limits.Pids = pids
+	}
+	return limits, nil
+}
+
+// parseMemoryMB accepts plain megabytes ("512") or a unit suffix ("512m", "1g")
+func parseMemoryMB(v string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(v))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "g"):
+		multiplier = 1024
+		s = strings.TrimSuffix(s, "g")
+	case strings.HasSuffix(s, "m"):
+		s = strings.TrimSuffix(s, "m")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid --memory value %q", v)
+	}
+	return n * multiplier, nil
+}
+
+// formatLimits renders limits for table output
+func formatLimits(l runner.Limits) (memory, cpus, pids string) {
+	memory, cpus, pids = "-", "-", "-"
+	if l.MemoryMB > 0 {
+		memory = fmt.Sprintf("%dMB", l.MemoryMB)
+	}
+	if l.CPUs > 0 {
+		cpus = strconv.FormatFloat(l.CPUs, 'g', -1, 64)
+	}
+	if l.Pids > 0 {
+		pids = strconv.FormatInt(l.Pids, 10)
+	}
+	return memory, cpus, pids
+}
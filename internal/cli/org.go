@@ -0,0 +1,278 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+)
+
+var orgNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,38}$`)
+
+func handleOrg(sess ssh.Session, args []string, d *db.Database, cfg *config.Config, userID int, isJSON bool) {
+	positional := PositionalArgs(args)
+	cmd := ""
+	if len(positional) > 0 {
+		cmd = positional[0]
+	}
+
+	var err error
+	switch {
+	case cmd == "ls":
+		handleOrgLs(sess, d, userID, isJSON)
+		return
+	case cmd == "create" && len(positional) == 2:
+		err = orgCreate(sess, d, userID, positional[1], isJSON)
+	case cmd == "invite" && len(positional) == 3:
+		role := FlagValue(args, "--role")
+		if role == "" {
+			role = db.RoleDeveloper
+		}
+		err = orgInvite(sess, d, cfg, userID, positional[1], positional[2], role, isJSON)
+	case cmd == "remove" && len(positional) == 3:
+		err = orgRemove(sess, d, cfg, userID, positional[1], positional[2], isJSON)
+	case cmd == "members" && len(positional) == 2:
+		err = orgMembers(sess, d, cfg, userID, positional[1], isJSON)
+	case cmd == "move" && len(positional) == 3:
+		err = orgMove(sess, d, cfg, userID, positional[1], positional[2], isJSON)
+	case cmd == "move" && len(positional) == 2 && HasFlag(args, "--personal"):
+		err = orgMove(sess, d, cfg, userID, positional[1], "", isJSON)
+	default:
+		err = errors.New("Usage: org <cmd>\nCmds: ls, create <org>, invite <org> <email> [--role=owner|developer|viewer], remove <org> <email>, members <org>, move <app> <org>|--personal")
+	}
+
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+	}
+}
+
+func orgCreate(sess ssh.Session, d *db.Database, userID int, name string, isJSON bool) error {
+	if !orgNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid org name '%s' (lowercase letters, digits and dashes)", name)
+	}
+
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO orgs (name, created_by) VALUES (?, ?)", name, userID)
+	if err != nil {
+		return fmt.Errorf("org '%s' already exists", name)
+	}
+	orgID, _ := result.LastInsertId()
+	if _, err := tx.Exec("INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)", orgID, userID, db.RoleOwner); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	remoteIP, _ := sess.Context().Value("remote_ip").(string)
+	d.LogAudit("org_create", userID, "", remoteIP, "org="+name)
+
+	if isJSON {
+		WriteJSON(sess, true, fmt.Sprintf("Created org '%s'", name), map[string]interface{}{"org": name, "role": db.RoleOwner}, nil)
+	} else {
+		fmt.Fprintf(sess, "Created org '%s'. Add members with 'org invite %s <email>'.\n", name, name)
+	}
+	return nil
+}
+
+// orgInvite adds an existing user to the org, or changes their role
+func orgInvite(sess ssh.Session, d *db.Database, cfg *config.Config, userID int, orgName, email, role string, isJSON bool) error {
+	if !db.ValidRole(role) {
+		return fmt.Errorf("invalid role '%s' (owner, developer, viewer)", role)
+	}
+	orgID, err := authorizeOrg(sess, d, cfg, policy.OrgManage, orgName)
+	if err != nil {
+		return err
+	}
+
+	var memberID int
+	if err := d.Conn.QueryRow("SELECT id FROM users WHERE lower(email) = lower(?)", email).Scan(&memberID); err != nil {
+		return fmt.Errorf("no user with email '%s'; they need to sign up first", email)
+	}
+	if role != db.RoleOwner && !otherOwners(d, orgID, memberID) {
+		return fmt.Errorf("'%s' must keep at least one owner", orgName)
+	}
+	_, err = d.Conn.Exec(`INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)
+		ON CONFLICT(org_id, user_id) DO UPDATE SET role = excluded.role`, orgID, memberID, role)
+	if err != nil {
+		return err
+	}
+
+	remoteIP, _ := sess.Context().Value("remote_ip").(string)
+	d.LogAudit("org_member_add", userID, "", remoteIP, fmt.Sprintf("org=%s email=%s role=%s", orgName, email, role))
+
+	if isJSON {
+		WriteJSON(sess, true, fmt.Sprintf("Added %s to '%s'", email, orgName), map[string]string{"org": orgName, "email": email, "role": role}, nil)
+	} else {
+		fmt.Fprintf(sess, "Added %s to '%s' as %s\n", email, orgName, role)
+	}
+	return nil
+}
+
+func orgRemove(sess ssh.Session, d *db.Database, cfg *config.Config, userID int, orgName, email string, isJSON bool) error {
+	orgID, err := authorizeOrg(sess, d, cfg, policy.OrgManage, orgName)
+	if err != nil {
+		return err
+	}
+
+	var memberID int
+	if err := d.Conn.QueryRow("SELECT id FROM users WHERE lower(email) = lower(?)", email).Scan(&memberID); err != nil {
+		return fmt.Errorf("'%s' is not a member of '%s'", email, orgName)
+	}
+
+	if !otherOwners(d, orgID, memberID) {
+		return fmt.Errorf("'%s' must keep at least one owner", orgName)
+	}
+
+	result, err := d.Conn.Exec("DELETE FROM org_members WHERE org_id = ? AND user_id = ?", orgID, memberID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("'%s' is not a member of '%s'", email, orgName)
+	}
+
+	remoteIP, _ := sess.Context().Value("remote_ip").(string)
+	d.LogAudit("org_member_remove", userID, "", remoteIP, fmt.Sprintf("org=%s email=%s", orgName, email))
+
+	if isJSON {
+		WriteJSON(sess, true, fmt.Sprintf("Removed %s from '%s'", email, orgName), nil, nil)
+	} else {
+		fmt.Fprintf(sess, "Removed %s from '%s'\n", email, orgName)
+	}
+	return nil
+}
+
+// otherOwners reports whether the org has an owner besides userID, so
+// removing or demoting them never leaves it without one
+func otherOwners(d *db.Database, orgID, userID int) bool {
+	var owners int
+	d.Conn.QueryRow("SELECT COUNT(*) FROM org_members WHERE org_id = ? AND role = ? AND user_id != ?", orgID, db.RoleOwner, userID).Scan(&owners)
+	return owners > 0
+}
+
+// orgMove puts an app in an org, or with an empty orgName back into its
+// creator's personal apps. It takes ownership of the app and, for an org,
+// the right to create apps in it.
+func orgMove(sess ssh.Session, d *db.Database, cfg *config.Config, userID int, appName, orgName string, isJSON bool) error {
+	appID, err := authorizeApp(sess, d, cfg, policy.AppDelete, appName)
+	if err != nil {
+		return err
+	}
+	var orgID interface{}
+	if orgName != "" {
+		if orgID, err = authorizeOrg(sess, d, cfg, policy.AppCreate, orgName); err != nil {
+			return err
+		}
+	}
+	if _, err := d.Conn.Exec("UPDATE apps SET org_id = ? WHERE id = ?", orgID, appID); err != nil {
+		return err
+	}
+
+	remoteIP, _ := sess.Context().Value("remote_ip").(string)
+	d.LogAudit("org_app_move", userID, appName, remoteIP, "org="+orgName)
+
+	msg := fmt.Sprintf("Moved '%s' to '%s'", appName, orgName)
+	if orgName == "" {
+		msg = fmt.Sprintf("Moved '%s' out of its org", appName)
+	}
+	if isJSON {
+		WriteJSON(sess, true, msg, map[string]string{"app": appName, "org": orgName}, nil)
+	} else {
+		fmt.Fprintln(sess, msg)
+	}
+	return nil
+}
+
+func orgMembers(sess ssh.Session, d *db.Database, cfg *config.Config, userID int, orgName string, isJSON bool) error {
+	orgID, err := authorizeOrg(sess, d, cfg, policy.OrgRead, orgName)
+	if err != nil {
+		return err
+	}
+
+	rows, err := d.Conn.Query(`SELECT COALESCE(u.email, ''), m.role, m.created_at FROM org_members m
+		JOIN users u ON u.id = m.user_id WHERE m.org_id = ? ORDER BY m.id`, orgID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type memberInfo struct {
+		Email  string `json:"email"`
+		Role   string `json:"role"`
+		Joined string `json:"joined_at"`
+	}
+	var members []memberInfo
+
+	if !isJSON {
+		fmt.Fprintf(sess, "%-35s %-10s %-20s\n", "EMAIL", "ROLE", "JOINED")
+		fmt.Fprintf(sess, "%-35s %-10s %-20s\n", "-----", "----", "------")
+	}
+	for rows.Next() {
+		var m memberInfo
+		rows.Scan(&m.Email, &m.Role, &m.Joined)
+		if isJSON {
+			members = append(members, m)
+		} else {
+			fmt.Fprintf(sess, "%-35s %-10s %-20s\n", m.Email, m.Role, m.Joined)
+		}
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"org": orgName, "members": members}, nil)
+	}
+	return nil
+}
+
+func handleOrgLs(sess ssh.Session, d *db.Database, userID int, isJSON bool) {
+	rows, err := d.Conn.Query(`SELECT o.name, m.role, (SELECT COUNT(*) FROM apps a WHERE a.org_id = o.id), o.created_at
+		FROM orgs o JOIN org_members m ON m.org_id = o.id WHERE m.user_id = ? ORDER BY o.name`, userID)
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error listing orgs: %v\n", err)
+		}
+		return
+	}
+	defer rows.Close()
+
+	type orgInfo struct {
+		Name    string `json:"org"`
+		Role    string `json:"role"`
+		Apps    int    `json:"apps"`
+		Created string `json:"created_at"`
+	}
+	var orgs []orgInfo
+
+	if !isJSON {
+		fmt.Fprintf(sess, "%-25s %-10s %-5s %-20s\n", "ORG", "ROLE", "APPS", "CREATED")
+		fmt.Fprintf(sess, "%-25s %-10s %-5s %-20s\n", "---", "----", "----", "-------")
+	}
+	for rows.Next() {
+		var o orgInfo
+		rows.Scan(&o.Name, &o.Role, &o.Apps, &o.Created)
+		if isJSON {
+			orgs = append(orgs, o)
+		} else {
+			fmt.Fprintf(sess, "%-25s %-10s %-5d %-20s\n", o.Name, o.Role, o.Apps, o.Created)
+		}
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"orgs": orgs}, nil)
+	}
+}
@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+func TestOrgMembership(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com'), (2, 'bob@example.com'), (3, 'carol@example.com')")
+	d.Conn.Exec("INSERT INTO apps (id, name, user_id) VALUES (1, 'bloggy', 1), (2, 'bobs', 2)")
+	cfg := &config.Config{}
+
+	// run executes an org command as userID and returns the error it printed, if any
+	run := func(userID int, args ...string) string {
+		sess := newFakeSession()
+		sess.ctx.values["user_id"] = userID
+		handleOrg(sess, args, d, cfg, userID, false)
+		if out := sess.out.String(); strings.HasPrefix(out, "Error: ") {
+			return out
+		}
+		return ""
+	}
+	role := func(userID int, app string) string {
+		_, r, _ := d.AppRole(userID, app)
+		return r
+	}
+
+	if err := run(1, "create", "acme"); err != "" {
+		t.Fatalf("org create failed: %s", err)
+	}
+	if err := run(1, "invite", "acme", "bob@example.com", "--role=developer"); err != "" {
+		t.Fatalf("org invite failed: %s", err)
+	}
+
+	// The last owner can neither leave nor step down
+	if err := run(1, "remove", "acme", "alice@example.com"); !strings.Contains(err, "at least one owner") {
+		t.Errorf("Expected the last owner to stay, got %q", err)
+	}
+	if err := run(1, "invite", "acme", "alice@example.com", "--role=developer"); !strings.Contains(err, "at least one owner") {
+		t.Errorf("Expected the last owner to keep their role, got %q", err)
+	}
+	if _, r, _ := d.OrgRole(1, "acme"); r != db.RoleOwner {
+		t.Errorf("Expected alice to still own acme, got %q", r)
+	}
+
+	// Moving into the org needs ownership of the app, then shares it
+	if err := run(2, "move", "bloggy", "acme"); !strings.Contains(err, "access denied") {
+		t.Errorf("Expected bob to be refused moving alice's app, got %q", err)
+	}
+	if err := run(1, "move", "bloggy", "acme"); err != "" {
+		t.Fatalf("org move failed: %s", err)
+	}
+	if r := role(2, "bloggy"); r != db.RoleDeveloper {
+		t.Errorf("Expected bob to get his org role on a moved app, got %q", r)
+	}
+	if err := run(2, "move", "bobs", "acme"); err != "" {
+		t.Fatalf("org move by a developer of the org failed: %s", err)
+	}
+	if r := role(1, "bobs"); r != db.RoleOwner {
+		t.Errorf("Expected alice to own bob's app through the org, got %q", r)
+	}
+	if err := run(3, "move", "bloggy", "--personal"); !strings.Contains(err, "access denied") {
+		t.Errorf("Expected a non-member to be refused, got %q", err)
+	}
+
+	// Removed members lose access to the org's apps except their own
+	if err := run(1, "remove", "acme", "bob@example.com"); err != "" {
+		t.Fatalf("org remove failed: %s", err)
+	}
+	if r := role(2, "bloggy"); r != "" {
+		t.Errorf("Expected bob to lose access to bloggy, got %q", r)
+	}
+	if r := role(2, "bobs"); r != db.RoleOwner {
+		t.Errorf("Expected bob to keep owning the app he created, got %q", r)
+	}
+	if err := run(2, "move", "bloggy", "--personal"); !strings.Contains(err, "access denied") {
+		t.Errorf("Expected a removed member to be refused, got %q", err)
+	}
+
+	// Moving out hands the app back to its creator alone
+	if err := run(1, "move", "bobs", "--personal"); err != "" {
+		t.Fatalf("org move --personal failed: %s", err)
+	}
+	if r := role(1, "bobs"); r != "" {
+		t.Errorf("Expected alice to lose access to bob's personal app, got %q", r)
+	}
+	var orgID interface{}
+	d.Conn.QueryRow("SELECT org_id FROM apps WHERE name = 'bobs'").Scan(&orgID)
+	if orgID != nil {
+		t.Errorf("Expected bobs to have no org, got %v", orgID)
+	}
+
+	var moves int
+	d.Conn.QueryRow("SELECT COUNT(*) FROM audit_log WHERE event = 'org_app_move'").Scan(&moves)
+	if moves != 3 {
+		t.Errorf("Expected 3 moves in the audit log, got %d", moves)
+	}
+}
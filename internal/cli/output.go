@@ -1,10 +1,19 @@
 package cli
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/runner"
 )
 
 // Response is a generic container for API outputs
@@ -13,6 +22,27 @@ type Response struct {
 	Message string      `json:"message,omitempty"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"`
+	// Warnings are side effects that failed without failing the request
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// DeniedData is the data payload of every access_denied response
+type DeniedData struct {
+	Action   policy.Action `json:"action"`
+	Resource string        `json:"resource,omitempty"`
+}
+
+// ErrorResponse builds the failure envelope for err. Policy denials always get
+// code "access_denied" and the denied action, whichever command hit them.
+func ErrorResponse(err error) Response {
+	resp := Response{Success: false, Error: err.Error()}
+	var denied *policy.DeniedError
+	if errors.As(err, &denied) {
+		resp.Code = "access_denied"
+		resp.Data = DeniedData{Action: denied.Action, Resource: denied.Resource}
+	}
+	return resp
 }
 
 // WriteJSON writes a structured response to the SSH session
@@ -23,14 +53,188 @@ func WriteJSON(sess ssh.Session, success bool, message string, data interface{},
 		Data:    data,
 	}
 	if err != nil {
-		resp.Error = err.Error()
+		resp = ErrorResponse(err)
 	}
+	WriteResponse(sess, resp)
+}
 
-	encoder := json.NewEncoder(sess)
+// WriteResponse writes resp as indented JSON
+func WriteResponse(w io.Writer, resp Response) {
+	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "  ")
 	if err := encoder.Encode(resp); err != nil {
-		fmt.Fprintf(sess, "Error encoding JSON: %v\n", err)
+		fmt.Fprintf(w, "Error encoding JSON: %v\n", err)
+	}
+}
+
+// WriteNDJSON writes a single compact JSON object followed by a newline.
+// Streaming commands use it instead of the indented Response envelope.
+func WriteNDJSON(w io.Writer, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintf(w, "Error encoding JSON: %v\n", err)
+	}
+}
+
+// LogLine is one NDJSON record emitted by streaming log output
+type LogLine struct {
+	Stream    string `json:"stream"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Line      string `json:"line"`
+}
+
+// PullLine is one NDJSON record of image pull progress from `new --json`
+type PullLine struct {
+	Event string `json:"event"`
+	runner.PullEvent
+}
+
+// StreamLogsJSON runs run with its stdout and stderr turned into LogLine
+// records on w
+func StreamLogsJSON(w io.Writer, timestamps bool, run func(stdout, stderr io.Writer) error) error {
+	var mu sync.Mutex
+	stdout := newLineWriter(w, &mu, "stdout", timestamps)
+	stderr := newLineWriter(w, &mu, "stderr", timestamps)
+	err := run(stdout, stderr)
+	stdout.Flush()
+	stderr.Flush()
+	return err
+}
+
+// lineWriter splits a byte stream into lines and emits each one as a LogLine.
+// Writers sharing mu can safely feed the same output concurrently.
+type lineWriter struct {
+	out        io.Writer
+	mu         *sync.Mutex
+	stream     string
+	timestamps bool
+	buf        []byte
+}
+
+func newLineWriter(out io.Writer, mu *sync.Mutex, stream string, timestamps bool) *lineWriter {
+	return &lineWriter{out: out, mu: mu, stream: stream, timestamps: timestamps}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush emits any trailing partial line
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) emit(text string) {
+	line := LogLine{Stream: w.stream, Line: strings.TrimSuffix(text, "\r")}
+	if w.timestamps {
+		// Docker prefixes each line with an RFC3339Nano timestamp and a space
+		if ts, rest, ok := strings.Cut(line.Line, " "); ok {
+			line.Timestamp, line.Line = ts, rest
+		}
+	}
+	w.mu.Lock()
+	WriteNDJSON(w.out, line)
+	w.mu.Unlock()
+}
+
+// FlagValue returns the value of a --flag=value argument, or "" if absent
+func FlagValue(args []string, flag string) string {
+	prefix := flag + "="
+	for _, arg := range args {
+		if strings.HasPrefix(arg, prefix) {
+			return strings.TrimPrefix(arg, prefix)
+		}
+	}
+	return ""
+}
+
+// ParseDuration extends time.ParseDuration with a "d" (day) unit, e.g. "7d"
+func ParseDuration(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration: %s", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration: %s", v)
+	}
+	return d, nil
+}
+
+// PositionalArgs returns the arguments that are not flags
+func PositionalArgs(args []string) []string {
+	var out []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			out = append(out, arg)
+		}
+	}
+	return out
+}
+
+// Confirm asks a yes/no question on interactive (PTY) sessions. Sessions
+// without a PTY always get false so scripts never block on a prompt.
+func Confirm(sess ssh.Session, prompt string) bool {
+	if _, _, isPty := sess.Pty(); !isPty {
+		return false
+	}
+	answer, err := Prompt(sess, prompt+" [y/N] ")
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
+
+// Prompt writes prompt and reads one line of input. On a PTY the client
+// sends raw keystrokes, so they are echoed and backspace is handled here.
+func Prompt(sess ssh.Session, prompt string) (string, error) {
+	fmt.Fprint(sess, prompt)
+	_, _, isPty := sess.Pty()
+
+	var line []byte
+	buf := make([]byte, 1)
+	for len(line) < 1024 {
+		if _, err := sess.Read(buf); err != nil {
+			return "", err
+		}
+		switch c := buf[0]; {
+		case c == '\r' || c == '\n':
+			if isPty {
+				fmt.Fprint(sess, "\r\n")
+			}
+			return strings.TrimSpace(string(line)), nil
+		case c == 3 || c == 4: // Ctrl-C, Ctrl-D
+			return "", io.EOF
+		case c == 127 || c == 8:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				if isPty {
+					fmt.Fprint(sess, "\b \b")
+				}
+			}
+		default:
+			line = append(line, c)
+			if isPty {
+				sess.Write(buf)
+			}
+		}
 	}
+	return strings.TrimSpace(string(line)), nil
 }
 
 // HasFlag checks if a flag exists in the arguments
@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStreamLogsJSON(t *testing.T) {
+	var out bytes.Buffer
+	wantErr := errors.New("container went away")
+	err := StreamLogsJSON(&out, true, func(stdout, stderr io.Writer) error {
+		fmt.Fprint(stdout, "2026-01-17T10:00:00.000000000Z GET / 200\r\n2026-01-17T10:00:01.000000000Z GET /a")
+		fmt.Fprint(stderr, "2026-01-17T10:00:02.000000000Z panic: boom\n")
+		fmt.Fprint(stdout, "bc 404\n")
+		return wantErr
+	})
+	if err != wantErr {
+		t.Errorf("Expected the run error to be returned, got %v", err)
+	}
+
+	want := []LogLine{
+		{Stream: "stdout", Timestamp: "2026-01-17T10:00:00.000000000Z", Line: "GET / 200"},
+		{Stream: "stderr", Timestamp: "2026-01-17T10:00:02.000000000Z", Line: "panic: boom"},
+		{Stream: "stdout", Timestamp: "2026-01-17T10:00:01.000000000Z", Line: "GET /abc 404"},
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d records, got %q", len(want), out.String())
+	}
+	for i, raw := range lines {
+		var got LogLine
+		if err := json.Unmarshal([]byte(raw), &got); err != nil {
+			t.Fatalf("Record %d is not JSON: %q", i, raw)
+		}
+		if got != want[i] {
+			t.Errorf("Record %d: expected %+v, got %+v", i, want[i], got)
+		}
+	}
+
+	// A partial last line is flushed when the stream ends
+	out.Reset()
+	StreamLogsJSON(&out, false, func(stdout, stderr io.Writer) error {
+		fmt.Fprint(stderr, "no newline")
+		return nil
+	})
+	if got := strings.TrimSpace(out.String()); got != `{"stream":"stderr","line":"no newline"}` {
+		t.Errorf("Unexpected record for a partial line: %s", got)
+	}
+}
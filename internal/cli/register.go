@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+// StartRegistration runs the restricted session for an unknown key: it
+// collects an email (and invite code if required), creates the user and binds
+// the key's fingerprint to it. Nothing else is reachable from here.
+func StartRegistration(sess ssh.Session, d *db.Database, cfg *config.Config) {
+	args := sess.Command()
+	isJSON := HasFlag(args, "--json")
+	_, _, isPty := sess.Pty()
+
+	email := FlagValue(args, "--email")
+	invite := FlagValue(args, "--invite")
+
+	if !isJSON && email == "" {
+		fmt.Fprintf(sess, "Welcome! This key is not registered yet.\r\n")
+	}
+	if email == "" && isPty {
+		email, _ = Prompt(sess, "Email: ")
+	}
+	if invite == "" && cfg.RegistrationMode == "invite" && isPty {
+		invite, _ = Prompt(sess, "Invite code: ")
+	}
+
+	userID, err := registerUser(sess, d, cfg, email, invite)
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Registration failed: %v\r\n", err)
+		}
+		sess.Exit(1)
+		return
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "Registered", map[string]interface{}{"user_id": userID, "email": email}, nil)
+	} else {
+		fmt.Fprintf(sess, "Registered %s. Reconnect as poor-exe@%s to get started.\r\n", email, cfg.Domain)
+	}
+}
+
+func registerUser(sess ssh.Session, d *db.Database, cfg *config.Config, email, invite string) (int, error) {
+	if email == "" {
+		return 0, errors.New("usage: ssh register@<gateway> --email=<you@example.com> [--invite=<code>]")
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return 0, fmt.Errorf("invalid email address: %s", email)
+	}
+	if !emailDomainAllowed(cfg, email) {
+		return 0, fmt.Errorf("email domain not allowed: %s", email)
+	}
+	fingerprint, _ := sess.Context().Value("fingerprint").(string)
+	keyData, _ := sess.Context().Value("key_data").(string)
+
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE lower(email) = lower(?))", email).Scan(&taken)
+	if taken {
+		return 0, errors.New("that email is already registered; add this key from an existing session with 'keys add'")
+	}
+
+	if cfg.RegistrationMode == "invite" {
+		// Consume one use; rolled back with the rest if signup fails
+		result, err := tx.Exec(`UPDATE invites SET uses = uses + 1
+			WHERE code = ? AND uses < max_uses AND (expires_at IS NULL OR expires_at > datetime('now'))`, invite)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 || invite == "" {
+			return 0, errors.New("a valid invite code is required")
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO users (email) VALUES (?)", email)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	if _, err := tx.Exec("INSERT INTO public_keys (user_id, fingerprint, key_data, comment) VALUES (?, ?, ?, ?)",
+		id, fingerprint, keyData, "registered"); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	remoteIP, _ := sess.Context().Value("remote_ip").(string)
+	details := "email=" + email + " fingerprint=" + fingerprint
+	if invite != "" {
+		details += " invite=" + invite
+	}
+	d.LogAudit("user_register", int(id), "", remoteIP, details)
+	return int(id), nil
+}
+
+func emailDomainAllowed(cfg *config.Config, email string) bool {
+	if len(cfg.AllowedEmailDomains) == 0 {
+		return true
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	for _, allowed := range cfg.AllowedEmailDomains {
+		if strings.EqualFold(domain, allowed) {
+			return true
+		}
+	}
+	return false
+}
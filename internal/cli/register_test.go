@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+// fakeContext carries the values the auth handlers put on a connection.
+// Methods it doesn't override panic through the nil embedded Context.
+type fakeContext struct {
+	ssh.Context
+	values map[interface{}]interface{}
+}
+
+func (c *fakeContext) Value(key interface{}) interface{}       { return c.values[key] }
+func (c *fakeContext) Done() <-chan struct{}                   { return nil }
+func (c *fakeContext) Err() error                              { return nil }
+func (c *fakeContext) Deadline() (deadline time.Time, ok bool) { return }
+func (c *fakeContext) SetValue(key, value interface{})         { c.values[key] = value }
+
+// fakeSession records output and the exit code of a command run without a PTY
+type fakeSession struct {
+	ssh.Session
+	ctx  *fakeContext
+	args []string
+	out  bytes.Buffer
+	code int
+}
+
+func newFakeSession(args ...string) *fakeSession {
+	return &fakeSession{ctx: &fakeContext{values: map[interface{}]interface{}{}}, args: args, code: -1}
+}
+
+func (s *fakeSession) Context() ssh.Context                    { return s.ctx }
+func (s *fakeSession) Command() []string                       { return s.args }
+func (s *fakeSession) Pty() (ssh.Pty, <-chan ssh.Window, bool) { return ssh.Pty{}, nil, false }
+func (s *fakeSession) Write(p []byte) (int, error)             { return s.out.Write(p) }
+func (s *fakeSession) Stderr() io.ReadWriter                   { return &s.out }
+func (s *fakeSession) Read(p []byte) (int, error)              { return 0, io.EOF }
+func (s *fakeSession) Exit(code int) error                     { s.code = code; return nil }
+
+func TestRegisterUser(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'root@example.com')")
+	d.Conn.Exec(`INSERT INTO invites (code, created_by, max_uses, uses, expires_at) VALUES
+		('fresh', 1, 2, 0, NULL),
+		('used-up', 1, 1, 1, NULL),
+		('expired', 1, 5, 0, datetime('now', '-1 hour')),
+		('expiring', 1, 5, 0, datetime('now', '+1 hour')),
+		('', 1, 5, 0, NULL)`)
+
+	tests := []struct {
+		name   string
+		mode   string
+		email  string
+		invite string
+		err    string
+	}{
+		{"open mode needs no invite", "open", "a@example.com", "", ""},
+		{"open mode ignores a bad invite", "open", "b@example.com", "bogus", ""},
+		{"missing email", "open", "", "", "usage"},
+		{"malformed email", "open", "Bob <bob@example.com>", "", "invalid email"},
+		{"email taken", "open", "ROOT@example.com", "", "already registered"},
+		{"invite below max uses", "invite", "c@example.com", "fresh", ""},
+		{"invite last use", "invite", "d@example.com", "fresh", ""},
+		{"invite used up", "invite", "e@example.com", "fresh", "valid invite code"},
+		{"invite never usable again", "invite", "e@example.com", "used-up", "valid invite code"},
+		{"invite expired", "invite", "e@example.com", "expired", "valid invite code"},
+		{"invite not yet expired", "invite", "f@example.com", "expiring", ""},
+		{"invite unknown", "invite", "e@example.com", "bogus", "valid invite code"},
+		// An invite stored with an empty code doesn't open signup to anyone
+		// who leaves the code out
+		{"invite empty", "invite", "e@example.com", "", "valid invite code"},
+		{"invite email taken", "invite", "a@example.com", "expiring", "already registered"},
+	}
+	for i, tt := range tests {
+		sess := newFakeSession()
+		sess.ctx.values["fingerprint"] = fmt.Sprintf("SHA256:key%d", i)
+		sess.ctx.values["key_data"] = "ssh-ed25519 AAAA"
+		cfg := &config.Config{RegistrationMode: tt.mode}
+
+		id, err := registerUser(sess, d, cfg, tt.email, tt.invite)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected an error mentioning %q, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: registerUser failed: %v", tt.name, err)
+			continue
+		}
+		var owner int
+		d.Conn.QueryRow("SELECT user_id FROM public_keys WHERE fingerprint = ?", sess.ctx.values["fingerprint"]).Scan(&owner)
+		if owner != id {
+			t.Errorf("%s: expected the key to be bound to user %d, got %d", tt.name, id, owner)
+		}
+	}
+
+	// Only successful signups consume a use, failed ones are rolled back
+	uses := map[string]int{}
+	rows, _ := d.Conn.Query("SELECT code, uses FROM invites")
+	for rows.Next() {
+		var code string
+		var n int
+		rows.Scan(&code, &n)
+		uses[code] = n
+	}
+	rows.Close()
+	want := map[string]int{"fresh": 2, "used-up": 1, "expired": 0, "expiring": 1, "": 0}
+	for code, n := range want {
+		if uses[code] != n {
+			t.Errorf("Invite %q: expected %d uses, got %d", code, n, uses[code])
+		}
+	}
+}
+
+func TestAdminInviteCreate(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email, is_admin) VALUES (1, 'root@example.com', TRUE)")
+
+	for _, bad := range [][]string{{"--uses=0"}, {"--uses=many"}, {"--expires=soon"}} {
+		sess := newFakeSession()
+		handleAdminInviteCreate(sess, bad, d, 1, true)
+		if !strings.Contains(sess.out.String(), `"success": false`) {
+			t.Errorf("%v: expected the invite to be refused, got %s", bad, sess.out.String())
+		}
+	}
+	var n int
+	d.Conn.QueryRow("SELECT COUNT(*) FROM invites").Scan(&n)
+	if n != 0 {
+		t.Fatalf("Expected no invites from bad flags, got %d", n)
+	}
+
+	sess := newFakeSession()
+	handleAdminInviteCreate(sess, []string{"--uses=2", "--expires=1h"}, d, 1, true)
+	var resp struct {
+		Success bool
+		Data    struct {
+			Code      string `json:"code"`
+			MaxUses   int    `json:"max_uses"`
+			ExpiresAt string `json:"expires_at"`
+		}
+	}
+	if err := json.Unmarshal(sess.out.Bytes(), &resp); err != nil || !resp.Success || resp.Data.Code == "" {
+		t.Fatalf("Expected an invite, got %s", sess.out.String())
+	}
+	expires, err := time.Parse("2006-01-02 15:04:05", resp.Data.ExpiresAt)
+	if err != nil || expires.Before(time.Now().Add(59*time.Minute)) || expires.After(time.Now().Add(61*time.Minute)) {
+		t.Errorf("Expected the invite to expire in an hour, got %q", resp.Data.ExpiresAt)
+	}
+	if resp.Data.MaxUses != 2 {
+		t.Errorf("Expected 2 uses, got %d", resp.Data.MaxUses)
+	}
+
+	// The code is good for exactly the uses it was created with
+	cfg := &config.Config{RegistrationMode: "invite"}
+	for i, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		sess := newFakeSession()
+		sess.ctx.values["fingerprint"] = fmt.Sprintf("SHA256:key%d", i)
+		_, err := registerUser(sess, d, cfg, email, resp.Data.Code)
+		if i < 2 && err != nil {
+			t.Errorf("%s: registerUser failed: %v", email, err)
+		}
+		if i == 2 && err == nil {
+			t.Errorf("%s: expected the invite to be used up", email)
+		}
+	}
+}
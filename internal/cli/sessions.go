@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/sessions"
+)
+
+// handleSessions lists and kills live SSH sessions. Users see their own;
+// admins see everyone's.
+func handleSessions(sess ssh.Session, args []string, d *db.Database, cfg *config.Config, reg *sessions.Registry, userID int, isJSON bool) {
+	positional := PositionalArgs(args)
+	admin := policy.New(d, cfg).IsAdmin(userID)
+
+	var err error
+	switch {
+	case len(positional) == 0 || positional[0] == "ls":
+		handleSessionsLs(sess, d, reg, userID, admin, isJSON)
+		return
+	case positional[0] == "kill" && len(positional) == 2:
+		err = sessionKill(sess, d, reg, userID, admin, positional[1], isJSON)
+	default:
+		err = errors.New("Usage: sessions [ls|kill <id>]")
+	}
+
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+	}
+}
+
+func handleSessionsLs(sess ssh.Session, d *db.Database, reg *sessions.Registry, userID int, admin, isJSON bool) {
+	type sessionInfo struct {
+		sessions.Info
+		Email   string `json:"email,omitempty"`
+		Current bool   `json:"current"`
+	}
+	var list []sessionInfo
+
+	current := sessions.IDOf(sess)
+	emails := make(map[int]string)
+	for _, info := range reg.List() {
+		if !admin && info.UserID != userID {
+			continue
+		}
+		email, ok := emails[info.UserID]
+		if !ok {
+			d.Conn.QueryRow("SELECT COALESCE(email, '') FROM users WHERE id = ?", info.UserID).Scan(&email)
+			emails[info.UserID] = email
+		}
+		list = append(list, sessionInfo{Info: info, Email: email, Current: info.ID == current})
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"sessions": list}, nil)
+		return
+	}
+
+	fmt.Fprintf(sess, "%-9s %-30s %-15s %-22s %-10s %-10s %-10s\n", "ID", "USER", "TARGET", "REMOTE", "DURATION", "IN", "OUT")
+	fmt.Fprintf(sess, "%-9s %-30s %-15s %-22s %-10s %-10s %-10s\n", "--", "----", "------", "------", "--------", "--", "---")
+	for _, s := range list {
+		id := s.ID
+		if s.Current {
+			id += "*"
+		}
+		user := s.Email
+		if user == "" {
+			user = fmt.Sprintf("uid:%d", s.UserID)
+		}
+		duration := time.Since(s.Started).Truncate(time.Second).String()
+		fmt.Fprintf(sess, "%-9s %-30s %-15s %-22s %-10s %-10s %-10s\n", id, user, s.Target, s.RemoteIP, duration, formatBytes(s.BytesIn), formatBytes(s.BytesOut))
+	}
+}
+
+// sessionKill closes the connection behind a session. Other users' sessions
+// are reported as not found unless the caller is an admin.
+func sessionKill(sess ssh.Session, d *db.Database, reg *sessions.Registry, userID int, admin bool, id string, isJSON bool) error {
+	target, ok := reg.Get(id)
+	if !ok || (!admin && target.UserID != userID) {
+		return fmt.Errorf("session '%s' not found", id)
+	}
+	info := target.Info()
+
+	remoteIP, _ := sess.Context().Value("remote_ip").(string)
+	d.LogAudit("session_kill", userID, "", remoteIP, fmt.Sprintf("session=%s target_user=%d target=%s remote=%s", id, info.UserID, info.Target, info.RemoteIP))
+
+	// Report before killing, in case it's this session's own connection
+	if isJSON {
+		WriteJSON(sess, true, fmt.Sprintf("Session '%s' killed", id), map[string]string{"id": id}, nil)
+	} else {
+		fmt.Fprintf(sess, "Session '%s' killed\n", id)
+	}
+	if err := reg.Kill(id); err != nil && err != sessions.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
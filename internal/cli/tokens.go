@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/service"
+)
+
+// handleTokens manages the bearer tokens used by the HTTP API
+func handleTokens(sess ssh.Session, args []string, d *db.Database, cfg *config.Config, userID int, isJSON bool) {
+	positional := PositionalArgs(args)
+	svc := service.New(d, nil, nil, cfg)
+
+	var err error
+	switch {
+	case len(positional) == 0 || positional[0] == "ls":
+		handleTokensLs(sess, svc, isJSON)
+		return
+	case positional[0] == "create" && len(positional) == 2:
+		err = tokenCreate(sess, svc, positional[1], FlagValue(args, "--expires"), isJSON)
+	case positional[0] == "revoke" && len(positional) == 2:
+		if err = svc.RevokeToken(subjectOf(sess), positional[1]); err == nil {
+			if isJSON {
+				WriteJSON(sess, true, fmt.Sprintf("Token '%s' revoked", positional[1]), nil, nil)
+			} else {
+				fmt.Fprintf(sess, "Token '%s' revoked\n", positional[1])
+			}
+		}
+	default:
+		err = errors.New("Usage: tokens [ls|create <name> [--expires=90d]|revoke <name>]")
+	}
+
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+	}
+}
+
+func tokenCreate(sess ssh.Session, svc *service.Service, name, expires string, isJSON bool) error {
+	var ttl time.Duration
+	if expires != "" {
+		var err error
+		if ttl, err = ParseDuration(expires); err != nil {
+			return fmt.Errorf("invalid --expires '%s'", expires)
+		}
+	}
+
+	secret, tok, err := svc.CreateToken(subjectOf(sess), name, ttl)
+	if err != nil {
+		return err
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, fmt.Sprintf("Token '%s' created", name), map[string]interface{}{
+			"token":      secret,
+			"name":       tok.Name,
+			"expires_at": tok.Expires,
+		}, nil)
+		return nil
+	}
+	fmt.Fprintln(sess, secret)
+	fmt.Fprintf(sess.Stderr(), "Token '%s' created. It won't be shown again; send it as 'Authorization: Bearer <token>'.\n", name)
+	return nil
+}
+
+func handleTokensLs(sess ssh.Session, svc *service.Service, isJSON bool) {
+	tokens, err := svc.ListTokens(subjectOf(sess))
+	if err != nil {
+		if isJSON {
+			WriteJSON(sess, false, "", nil, err)
+		} else {
+			fmt.Fprintf(sess, "Error: %v\n", err)
+		}
+		return
+	}
+
+	if isJSON {
+		WriteJSON(sess, true, "", map[string]interface{}{"tokens": tokens}, nil)
+		return
+	}
+
+	fmt.Fprintf(sess, "%-25s %-20s %-20s %-20s %-16s\n", "NAME", "CREATED", "EXPIRES", "LAST USED", "FROM")
+	fmt.Fprintf(sess, "%-25s %-20s %-20s %-20s %-16s\n", "----", "-------", "-------", "---------", "----")
+	for _, t := range tokens {
+		fmt.Fprintf(sess, "%-25s %-20s %-20s %-20s %-16s\n", t.Name, t.Created, orDash(t.Expires), orDash(t.LastUsed), orDash(t.LastUsedIP))
+	}
+}
@@ -1,29 +1,157 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
-	SSHPort        int
-	HostKeyPath    string
-	DBPath         string
-	Domain         string
-	IdleTimeout    int
-	MaxConnections int
-	CaddyURL       string
+	SSHPort           int
+	HostKeyPath       string
+	DBPath            string
+	Domain            string
+	IdleTimeout       int
+	MaxConnections    int
+	MaxSessionsPerKey int // concurrent sessions one key or certificate may hold
+	CaddyURL          string
+	DockerNetwork     string // network shared by app containers and Caddy
+	DialByIP          bool   // dial container IPs instead of names (Caddy on the host)
+	SecretKey         string // encrypts secret app env values at rest
+
+	// Self-service signup for unknown SSH keys: "disabled", "invite" or "open"
+	RegistrationMode    string
+	AllowedEmailDomains []string // if set, signup emails must use one of these domains
+
+	// OpenSSH user certificates signed by these CAs are accepted in place of
+	// registered keys. A principal maps to the user with that email, or to
+	// principal@CertPrincipalDomain if it has no "@".
+	UserCAKeysPath      string
+	CertPrincipalDomain string
+	CertAutoProvision   bool // create users for unknown principals
+
+	// The gateway's own CA for `keys sign`, and the longest TTL it will issue
+	CAKeyPath  string
+	CertMaxTTL int // seconds
+
+	KeyForgeURLs []string // forges `keys import` may fetch <user>.keys from; the first is the default
+
+	// Bare git repos for `git push` deploys, one per app, and the branch
+	// whose pushes are built and deployed
+	GitRepoDir      string
+	GitDeployBranch string
+
+	// Redeploys start the new container beside the old one and switch Caddy
+	// over once HealthCheck passes ("bluegreen"), or replace the container in
+	// place ("recreate"). Apps can override HealthCheck with `deploy-config`.
+	DeployStrategy string
+	HealthCheck    string // tcp, http:/<path> or none
+	HealthTimeout  int    // seconds to wait for the health check
+	DrainSeconds   int    // how long the old container keeps running after the switch
+
+	// Clients are banned after BanMaxFailures rejected keys in 10 minutes, for
+	// BanDuration seconds, doubling on each repeat up to BanMaxDuration
+	BanMaxFailures      int
+	BanDuration         int
+	BanMaxDuration      int
+	RateLimitIPv6Prefix int // IPv6 clients are limited per prefix of this length, 0 per address
+
+	AdminEmails       []string // users always treated as admins, to bootstrap is_admin
+	ReconcileInterval int      // seconds between SQLite/Docker/Caddy reconciles, 0 disables
+
+	// Per-app resource limits applied when `new` omits a flag, and the
+	// highest values a user may request. A max of 0 means no ceiling.
+	DefaultMemoryMB int
+	MaxMemoryMB     int
+	DefaultCPUs     float64
+	MaxCPUs         float64
+	DefaultPids     int
+	MaxPids         int
+
+	// Per-user quotas. 0 means unlimited.
+	QuotaMaxApps  int
+	QuotaMemoryMB int
+
+	// HTTP server for health checks and private app login
+	HTTPPort     int
+	AuthHost     string // public host serving the login pages
+	AuthUpstream string // address Caddy dials to reach the HTTP server
+	AuthSecret   string // signs login cookies; random per process if empty
+
+	// SMTP server for emailed magic login links. Disabled if SMTPHost is empty.
+	SMTPHost string
+	SMTPPort int
+	SMTPUser string
+	SMTPPass string
+	SMTPFrom string
 }
 
 func Load() *Config {
+	domain := getEnv("DOMAIN", "ssh.rnzlive.com")
+	httpPort := getEnvInt("HTTP_PORT", 8080)
+
 	return &Config{
-		SSHPort:        getEnvInt("SSH_PORT", 2222),
-		HostKeyPath:    getEnv("SSH_HOST_KEY_PATH", "ssh_host_key"),
-		DBPath:         getEnv("DB_PATH", "poor-exe.db"),
-		Domain:         getEnv("DOMAIN", "ssh.rnzlive.com"),
-		IdleTimeout:    getEnvInt("IDLE_TIMEOUT", 1800), // 30 minutes
-		MaxConnections: getEnvInt("MAX_CONNECTIONS", 100),
-		CaddyURL:       getEnv("CADDY_URL", "http://localhost:2019"),
+		SSHPort:           getEnvInt("SSH_PORT", 2222),
+		HostKeyPath:       getEnv("SSH_HOST_KEY_PATH", "ssh_host_key"),
+		DBPath:            getEnv("DB_PATH", "poor-exe.db"),
+		Domain:            domain,
+		IdleTimeout:       getEnvInt("IDLE_TIMEOUT", 1800), // 30 minutes
+		MaxConnections:    getEnvInt("MAX_CONNECTIONS", 100),
+		MaxSessionsPerKey: getEnvInt("MAX_SESSIONS_PER_KEY", 10),
+		CaddyURL:          getEnv("CADDY_URL", "http://localhost:2019"),
+		DockerNetwork:     getEnv("DOCKER_NETWORK", "poor-exe"),
+		DialByIP:          getEnv("UPSTREAM_DIAL", "name") == "ip",
+		SecretKey:         getEnv("SECRET_KEY", ""),
+
+		RegistrationMode:    getEnv("REGISTRATION_MODE", "disabled"),
+		AllowedEmailDomains: getEnvList("ALLOWED_EMAIL_DOMAINS"),
+
+		UserCAKeysPath:      getEnv("USER_CA_KEYS", ""),
+		CertPrincipalDomain: getEnv("CERT_PRINCIPAL_DOMAIN", ""),
+		CertAutoProvision:   getEnv("CERT_AUTO_PROVISION", "false") == "true",
+
+		CAKeyPath:  getEnv("SSH_CA_KEY_PATH", "ssh_user_ca_key"),
+		CertMaxTTL: getEnvInt("CERT_MAX_TTL", 7*24*3600), // 7 days
+
+		KeyForgeURLs: splitList(getEnv("KEY_FORGE_URLS", "https://github.com,https://gitlab.com")),
+
+		GitRepoDir:      getEnv("GIT_REPO_DIR", "repos"),
+		GitDeployBranch: getEnv("GIT_DEPLOY_BRANCH", "main"),
+
+		DeployStrategy: getEnv("DEPLOY_STRATEGY", "bluegreen"),
+		HealthCheck:    getEnv("HEALTH_CHECK", "tcp"),
+		HealthTimeout:  getEnvInt("HEALTH_TIMEOUT", 60),
+		DrainSeconds:   getEnvInt("DRAIN_SECONDS", 10),
+
+		BanMaxFailures:      getEnvInt("BAN_MAX_FAILURES", 10),
+		BanDuration:         getEnvInt("BAN_DURATION", 900),       // 15 minutes
+		BanMaxDuration:      getEnvInt("BAN_MAX_DURATION", 86400), // 1 day
+		RateLimitIPv6Prefix: getEnvInt("RATE_LIMIT_IPV6_PREFIX", 64),
+
+		AdminEmails:       getEnvList("ADMIN_EMAILS"),
+		ReconcileInterval: getEnvInt("RECONCILE_INTERVAL", 300),
+
+		DefaultMemoryMB: getEnvInt("DEFAULT_MEMORY_MB", 512),
+		MaxMemoryMB:     getEnvInt("MAX_MEMORY_MB", 2048),
+		DefaultCPUs:     getEnvFloat("DEFAULT_CPUS", 1.0),
+		MaxCPUs:         getEnvFloat("MAX_CPUS", 2.0),
+		DefaultPids:     getEnvInt("DEFAULT_PIDS", 256),
+		MaxPids:         getEnvInt("MAX_PIDS", 1024),
+
+		QuotaMaxApps:  getEnvInt("QUOTA_MAX_APPS", 10),
+		QuotaMemoryMB: getEnvInt("QUOTA_MEMORY_MB", 4096),
+
+		HTTPPort:     httpPort,
+		AuthHost:     getEnv("AUTH_HOST", "auth."+domain),
+		AuthUpstream: getEnv("AUTH_UPSTREAM", fmt.Sprintf("localhost:%d", httpPort)),
+		AuthSecret:   getEnv("AUTH_SECRET", ""),
+
+		SMTPHost: getEnv("SMTP_HOST", ""),
+		SMTPPort: getEnvInt("SMTP_PORT", 587),
+		SMTPUser: getEnv("SMTP_USER", ""),
+		SMTPPass: getEnv("SMTP_PASS", ""),
+		SMTPFrom: getEnv("SMTP_FROM", "poor-exe@"+domain),
 	}
 }
 
@@ -42,3 +170,27 @@ func getEnvInt(key string, fallback int) int {
 	}
 	return fallback
 }
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if value, ok := os.LookupEnv(key); ok {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return fallback
+}
+
+// getEnvList splits a comma-separated variable, dropping empty entries
+func getEnvList(key string) []string {
+	return splitList(os.Getenv(key))
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
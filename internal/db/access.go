@@ -0,0 +1,62 @@
+package db
+
+import (
+	"database/sql"
+)
+
+// Roles a user can hold on an app, from least to most privileged. The app's
+// creator is always its owner; org members get their org role.
+const (
+	RoleViewer    = "viewer"
+	RoleDeveloper = "developer"
+	RoleOwner     = "owner"
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleDeveloper: 2, RoleOwner: 3}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// RoleAtLeast reports whether role grants everything min does
+func RoleAtLeast(role, min string) bool {
+	return roleRank[role] >= roleRank[min] && roleRank[role] > 0
+}
+
+// AppRole returns the app's ID and the user's role on it, or "" if none
+func (db *Database) AppRole(userID int, appName string) (int, string, error) {
+	var appID, ownerID int
+	var orgID sql.NullInt64
+	err := db.Conn.QueryRow("SELECT id, user_id, org_id FROM apps WHERE name = ?", appName).Scan(&appID, &ownerID, &orgID)
+	if err != nil {
+		return 0, "", err
+	}
+	if ownerID == userID {
+		return appID, RoleOwner, nil
+	}
+	if !orgID.Valid {
+		return appID, "", nil
+	}
+
+	var role string
+	err = db.Conn.QueryRow("SELECT role FROM org_members WHERE org_id = ? AND user_id = ?", orgID.Int64, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return appID, "", nil
+	}
+	return appID, role, err
+}
+
+// OrgRole returns the org's ID and the user's role in it, or "" if not a member
+func (db *Database) OrgRole(userID int, orgName string) (int, string, error) {
+	var orgID int
+	if err := db.Conn.QueryRow("SELECT id FROM orgs WHERE name = ?", orgName).Scan(&orgID); err != nil {
+		return 0, "", err
+	}
+	var role string
+	err := db.Conn.QueryRow("SELECT role FROM org_members WHERE org_id = ? AND user_id = ?", orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return orgID, "", nil
+	}
+	return orgID, role, err
+}
@@ -2,14 +2,12 @@ package db
 
 import (
 	"database/sql"
-	_ "embed"
+	"fmt"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/rnzor/poor_man_exe/internal/secrets"
 )
 
-//go:embed schema.sql
-var schemaSQL string
-
 type Database struct {
 	Conn *sql.DB
 }
@@ -27,11 +25,6 @@ func Connect(path string) (*Database, error) {
 	return &Database{Conn: db}, nil
 }
 
-func (db *Database) Init() error {
-	_, err := db.Conn.Exec(schemaSQL)
-	return err
-}
-
 func (db *Database) Close() error {
 	return db.Conn.Close()
 }
@@ -43,3 +36,29 @@ func (db *Database) LogAudit(event string, userID int, appName, sourceIP, detail
 		event, userID, appName, sourceIP, details,
 	)
 }
+
+// AppEnv returns an app's environment as KEY=VALUE pairs, decrypting secrets
+func (db *Database) AppEnv(appID int, box *secrets.Box) ([]string, error) {
+	rows, err := db.Conn.Query("SELECT key, value, is_secret FROM app_env WHERE app_id = ? ORDER BY key", appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var env []string
+	for rows.Next() {
+		var key, value string
+		var isSecret bool
+		if err := rows.Scan(&key, &value, &isSecret); err != nil {
+			return nil, err
+		}
+		if isSecret {
+			value, err = box.Decrypt(value)
+			if err != nil {
+				return nil, fmt.Errorf("decrypting %s: %w", key, err)
+			}
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, rows.Err()
+}
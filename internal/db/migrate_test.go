@@ -0,0 +1,64 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	d, err := Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatalf("Migrations failed: %v", err)
+	}
+
+	applied, err := d.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("Expected %d migrations applied, got %d", len(migrations), len(applied))
+	}
+
+	// Second run is a no-op
+	applied, err = d.Migrate()
+	if err != nil || len(applied) != 0 {
+		t.Errorf("Expected no-op second run, got %d applied, err %v", len(applied), err)
+	}
+
+	// A database touched by a newer binary is refused
+	latest := migrations[len(migrations)-1].Version
+	d.Conn.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, 'future')", latest+1)
+	if _, err := d.Migrate(); err == nil {
+		t.Error("Expected error for schema newer than binary")
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	d, err := Connect(filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+
+	// Databases created before migrations existed already have the baseline tables
+	migrations, _ := Migrations()
+	if _, err := d.Conn.Exec(migrations[0].SQL); err != nil {
+		t.Fatalf("Creating legacy schema failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO apps (name) VALUES ('legacy')")
+
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate on legacy database failed: %v", err)
+	}
+
+	var memory int
+	if err := d.Conn.QueryRow("SELECT memory_mb FROM apps WHERE name = 'legacy'").Scan(&memory); err != nil {
+		t.Errorf("Expected new columns on legacy apps table: %v", err)
+	}
+}
@@ -1,3 +1,6 @@
+-- Baseline schema. Uses IF NOT EXISTS so databases created before
+-- versioned migrations existed adopt it without changes.
+
 -- Users
 CREATE TABLE IF NOT EXISTS users (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -0,0 +1,4 @@
+-- Per-app resource limits (0 = unlimited)
+ALTER TABLE apps ADD COLUMN memory_mb INTEGER DEFAULT 0;
+ALTER TABLE apps ADD COLUMN cpus REAL DEFAULT 0;
+ALTER TABLE apps ADD COLUMN pids_limit INTEGER DEFAULT 0;
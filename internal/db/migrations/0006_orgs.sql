@@ -0,0 +1,19 @@
+-- Organizations that own apps together
+CREATE TABLE orgs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE NOT NULL,
+    created_by INTEGER REFERENCES users(id),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Org Members (role: owner, developer, viewer)
+CREATE TABLE org_members (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    org_id INTEGER REFERENCES orgs(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL DEFAULT 'developer',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(org_id, user_id)
+);
+
+ALTER TABLE apps ADD COLUMN org_id INTEGER REFERENCES orgs(id);
@@ -0,0 +1,8 @@
+-- Key expiry, usage tracking and per-key restrictions
+ALTER TABLE public_keys ADD COLUMN expires_at DATETIME;
+ALTER TABLE public_keys ADD COLUMN last_used_at DATETIME;
+ALTER TABLE public_keys ADD COLUMN last_used_ip TEXT;
+-- OpenSSH authorized_keys options, e.g. from="10.0.0.0/8",restrict
+ALTER TABLE public_keys ADD COLUMN options TEXT NOT NULL DEFAULT '';
+-- Comma-separated apps the key is limited to; empty means all
+ALTER TABLE public_keys ADD COLUMN apps TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,10 @@
+-- Temporary bans for clients with repeated failed logins, keyed on IP or
+-- IPv6 prefix. ban_count drives escalation and is kept after expiry.
+CREATE TABLE bans (
+    client TEXT PRIMARY KEY,
+    reason TEXT,
+    ban_count INTEGER NOT NULL DEFAULT 1,
+    banned_until DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
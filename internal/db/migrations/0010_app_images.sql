@@ -0,0 +1,11 @@
+-- Images built for each app by deploys, numbered per app
+CREATE TABLE app_images (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    app_id INTEGER NOT NULL REFERENCES apps(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    image TEXT NOT NULL,
+    source TEXT NOT NULL,
+    user_id INTEGER REFERENCES users(id),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(app_id, version)
+);
@@ -0,0 +1,19 @@
+-- Every configuration an app's container has been created from, so it can
+-- be rolled back to. env is a JSON snapshot of app_env, secrets still
+-- encrypted.
+CREATE TABLE releases (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    app_id INTEGER NOT NULL REFERENCES apps(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    image TEXT NOT NULL,
+    image_id TEXT,
+    env TEXT NOT NULL DEFAULT '[]',
+    memory_mb INTEGER DEFAULT 0,
+    cpus REAL DEFAULT 0,
+    pids_limit INTEGER DEFAULT 0,
+    http_port INTEGER DEFAULT 80,
+    reason TEXT NOT NULL,
+    user_id INTEGER REFERENCES users(id),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(app_id, version)
+);
@@ -0,0 +1,2 @@
+-- Per-app health check for blue/green redeploys; empty uses HEALTH_CHECK
+ALTER TABLE apps ADD COLUMN health_check TEXT NOT NULL DEFAULT '';
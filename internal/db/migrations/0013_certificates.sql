@@ -0,0 +1,12 @@
+-- Certificates issued by `keys sign`. Only serials recorded here are
+-- accepted, so a certificate can be revoked before it expires.
+CREATE TABLE certificates (
+    serial TEXT PRIMARY KEY, -- uint64, which doesn't fit an INTEGER
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    fingerprint TEXT NOT NULL,
+    key_id TEXT NOT NULL,
+    apps TEXT NOT NULL DEFAULT '',
+    expires_at DATETIME NOT NULL,
+    revoked_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,3 @@
+-- authorized_keys options inherited from the key or certificate that signed
+-- the certificate, e.g. from="10.0.0.0/8"
+ALTER TABLE certificates ADD COLUMN options TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,190 @@
+package policy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+// Action is something a user can attempt, checked against a resource
+type Action string
+
+const (
+	AppCreate    Action = "app.create"    // create an app (in an org: developer)
+	AppRead      Action = "app.read"      // describe, logs
+	AppExec      Action = "app.exec"      // shell or command in the container
+	AppLifecycle Action = "app.lifecycle" // start, stop, restart
+	AppEnv       Action = "app.env"       // read and change env vars
+	AppDeploy    Action = "app.deploy"    // build and roll out new code
+	AppDelete    Action = "app.delete"
+	ShareWrite   Action = "share.write" // visibility, port, allowlist
+	OrgRead      Action = "org.read"
+	OrgManage    Action = "org.manage"
+	TokenManage  Action = "token.manage" // create and revoke API tokens
+	Admin        Action = "admin"
+)
+
+// appRoles is the minimum role on an app required for each app action
+var appRoles = map[Action]string{
+	AppRead:      db.RoleViewer,
+	AppExec:      db.RoleDeveloper,
+	AppLifecycle: db.RoleDeveloper,
+	AppEnv:       db.RoleDeveloper,
+	AppDeploy:    db.RoleDeveloper,
+	AppDelete:    db.RoleOwner,
+	ShareWrite:   db.RoleOwner,
+}
+
+// orgRoles is the minimum role in an org required for each org action
+var orgRoles = map[Action]string{
+	OrgRead:   db.RoleViewer,
+	AppCreate: db.RoleDeveloper,
+	OrgManage: db.RoleOwner,
+}
+
+// Subject is who is asking
+type Subject struct {
+	UserID   int
+	RemoteIP string
+	Apps     []string // if set, the only apps this session may touch
+}
+
+// SubjectFromContext builds the subject from the values the SSH
+// authenticator stores on the connection
+func SubjectFromContext(ctx context.Context) Subject {
+	userID, _ := ctx.Value("user_id").(int)
+	remoteIP, _ := ctx.Value("remote_ip").(string)
+	apps, _ := ctx.Value("allowed_apps").([]string)
+	return Subject{UserID: userID, RemoteIP: remoteIP, Apps: apps}
+}
+
+// Restricted reports whether the subject is limited to specific apps
+func (s Subject) Restricted() bool {
+	return len(s.Apps) > 0
+}
+
+// DeniedError is returned for every denial so callers can render it uniformly
+type DeniedError struct {
+	Action   Action
+	Resource string // app or org name, empty for global actions
+	Kind     string // "app", "org" or ""
+}
+
+func (e *DeniedError) Error() string {
+	switch e.Kind {
+	case "app":
+		// Same message as a missing app so names don't leak
+		return fmt.Sprintf("app '%s' not found or access denied", e.Resource)
+	case "org":
+		return fmt.Sprintf("org '%s' not found or access denied", e.Resource)
+	default:
+		return fmt.Sprintf("permission denied: %s", e.Action)
+	}
+}
+
+// Engine decides whether a subject may perform an action on a resource.
+// Every denial is written to the audit log.
+type Engine struct {
+	DB  *db.Database
+	Cfg *config.Config
+}
+
+func New(d *db.Database, cfg *config.Config) *Engine {
+	return &Engine{DB: d, Cfg: cfg}
+}
+
+// AuthorizeApp checks an app action and returns the app's ID
+func (e *Engine) AuthorizeApp(sub Subject, action Action, appName string) (int, error) {
+	min, ok := appRoles[action]
+	if !ok {
+		return 0, fmt.Errorf("policy: %s is not an app action", action)
+	}
+	if sub.Restricted() && !slices.Contains(sub.Apps, appName) {
+		return 0, e.deny(sub, action, "app", appName)
+	}
+	appID, role, err := e.DB.AppRole(sub.UserID, appName)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == sql.ErrNoRows || !db.RoleAtLeast(role, min) {
+		return 0, e.deny(sub, action, "app", appName)
+	}
+	return appID, nil
+}
+
+// AuthorizeOrg checks an org action and returns the org's ID
+func (e *Engine) AuthorizeOrg(sub Subject, action Action, orgName string) (int, error) {
+	min, ok := orgRoles[action]
+	if !ok {
+		return 0, fmt.Errorf("policy: %s is not an org action", action)
+	}
+	if sub.Restricted() {
+		return 0, e.deny(sub, action, "org", orgName)
+	}
+	orgID, role, err := e.DB.OrgRole(sub.UserID, orgName)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == sql.ErrNoRows || !db.RoleAtLeast(role, min) {
+		return 0, e.deny(sub, action, "org", orgName)
+	}
+	return orgID, nil
+}
+
+// Authorize checks an action that isn't scoped to an app or org
+func (e *Engine) Authorize(sub Subject, action Action) error {
+	if sub.Restricted() {
+		return e.deny(sub, action, "", "")
+	}
+	switch action {
+	case AppCreate:
+		// Any authenticated user may create personal apps; quotas apply separately
+		return nil
+	case TokenManage:
+		// Tokens carry the user's full access, so app-limited keys were
+		// already refused above
+		return nil
+	case Admin:
+		if e.IsAdmin(sub.UserID) {
+			return nil
+		}
+	}
+	return e.deny(sub, action, "", "")
+}
+
+// IsAdmin reports whether the user has is_admin set or is listed in ADMIN_EMAILS
+func (e *Engine) IsAdmin(userID int) bool {
+	var email sql.NullString
+	var admin bool
+	e.DB.Conn.QueryRow("SELECT email, is_admin FROM users WHERE id = ?", userID).Scan(&email, &admin)
+	if admin {
+		return true
+	}
+	if email.String == "" {
+		return false
+	}
+	for _, a := range e.Cfg.AdminEmails {
+		if strings.EqualFold(a, email.String) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Engine) deny(sub Subject, action Action, kind, resource string) error {
+	appName := ""
+	if kind == "app" {
+		appName = resource
+	}
+	details := "action=" + string(action)
+	if kind == "org" {
+		details += " org=" + resource
+	}
+	e.DB.LogAudit("access_denied", sub.UserID, appName, sub.RemoteIP, details)
+	return &DeniedError{Action: action, Resource: resource, Kind: kind}
+}
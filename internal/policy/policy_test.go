@@ -0,0 +1,72 @@
+package policy
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+func TestAuthorizeApp(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	// 1 owns the org app, 2 is a viewer in the org, 3 is a stranger
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'owner@x.com'), (2, 'viewer@x.com'), (3, 'other@x.com')")
+	d.Conn.Exec("INSERT INTO orgs (id, name, created_by) VALUES (1, 'acme', 1)")
+	d.Conn.Exec("INSERT INTO org_members (org_id, user_id, role) VALUES (1, 1, 'owner'), (1, 2, 'viewer')")
+	d.Conn.Exec("INSERT INTO apps (name, user_id, org_id) VALUES ('bloggy', 1, 1)")
+
+	e := New(d, &config.Config{AdminEmails: []string{"other@x.com"}})
+	tests := []struct {
+		user   int
+		action Action
+		allow  bool
+	}{
+		{1, AppDelete, true},
+		{2, AppRead, true},
+		{2, AppExec, false},
+		{2, ShareWrite, false},
+		{3, AppRead, false},
+	}
+	for _, tt := range tests {
+		_, err := e.AuthorizeApp(Subject{UserID: tt.user}, tt.action, "bloggy")
+		if (err == nil) != tt.allow {
+			t.Errorf("user %d %s: expected allow=%v, got %v", tt.user, tt.action, tt.allow, err)
+		}
+		var denied *DeniedError
+		if err != nil && !errors.As(err, &denied) {
+			t.Errorf("user %d %s: expected DeniedError, got %T", tt.user, tt.action, err)
+		}
+	}
+
+	if _, err := e.AuthorizeApp(Subject{UserID: 1}, AppRead, "missing"); err == nil {
+		t.Error("Expected denial for missing app")
+	}
+	if _, err := e.AuthorizeApp(Subject{UserID: 1, Apps: []string{"other"}}, AppRead, "bloggy"); err == nil {
+		t.Error("Expected app-restricted subject to be denied other apps")
+	}
+	if _, err := e.AuthorizeOrg(Subject{UserID: 2}, OrgManage, "acme"); err == nil {
+		t.Error("Expected viewer to be denied org.manage")
+	}
+	if err := e.Authorize(Subject{UserID: 3}, Admin); err != nil {
+		t.Errorf("Expected ADMIN_EMAILS user to be admin, got %v", err)
+	}
+	if err := e.Authorize(Subject{UserID: 1}, Admin); err == nil {
+		t.Error("Expected non-admin to be denied")
+	}
+
+	var denials int
+	d.Conn.QueryRow("SELECT COUNT(*) FROM audit_log WHERE event = 'access_denied'").Scan(&denials)
+	if denials != 7 {
+		t.Errorf("Expected 7 audited denials, got %d", denials)
+	}
+}
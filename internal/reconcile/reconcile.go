@@ -0,0 +1,217 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/rnzor/poor_man_exe/internal/caddy"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/runner"
+)
+
+// Runner is the part of runner.DockerRunner reconciling reads, so tests can
+// stand in for Docker
+type Runner interface {
+	ListApps(ctx context.Context) ([]runner.AppContainer, error)
+	Upstream(ctx context.Context, appName string, port int, dialByIP bool) (string, error)
+}
+
+// Proxy is the part of caddy.Client reconciling compares and repairs
+type Proxy interface {
+	ListRoutes() (map[string]json.RawMessage, error)
+	RouteCurrent(installed json.RawMessage, appName, domain, upstream string, public bool) bool
+	UpsertRoute(appName, domain, upstream string, public bool) error
+	UpsertAuthRoute(authHost string) error
+	DeleteRoute(appName string) error
+}
+
+// Reconciler brings SQLite, Docker and Caddy back in agreement. The apps
+// table is the source of truth: routes are recreated or dropped to match it,
+// and containers it doesn't know about are only reported, never removed.
+type Reconciler struct {
+	DB     *db.Database
+	Runner Runner
+	Caddy  Proxy
+	Cfg    *config.Config
+}
+
+func New(d *db.Database, r Runner, c Proxy, cfg *config.Config) *Reconciler {
+	return &Reconciler{DB: d, Runner: r, Caddy: c, Cfg: cfg}
+}
+
+// Report lists the drift found, and what was done about it unless DryRun
+type Report struct {
+	DryRun            bool     `json:"dry_run"`
+	OrphanContainers  []string `json:"orphan_containers"`  // container exists, no app row
+	MissingContainers []string `json:"missing_containers"` // app row exists, no container
+	StatusUpdated     []string `json:"status_updated"`     // app status synced from Docker
+	RoutesRestored    []string `json:"routes_restored"`    // app had no Caddy route
+	RoutesUpdated     []string `json:"routes_updated"`     // app route had a stale upstream or settings
+	RoutesRemoved     []string `json:"routes_removed"`     // Caddy route for unknown app
+	Errors            []string `json:"errors"`
+}
+
+// Drift reports whether anything was out of sync
+func (rep *Report) Drift() bool {
+	return len(rep.OrphanContainers)+len(rep.MissingContainers)+len(rep.StatusUpdated)+
+		len(rep.RoutesRestored)+len(rep.RoutesUpdated)+len(rep.RoutesRemoved) > 0
+}
+
+func (rep *Report) errorf(format string, args ...interface{}) {
+	rep.Errors = append(rep.Errors, fmt.Sprintf(format, args...))
+}
+
+type appRow struct {
+	name     string
+	status   string
+	port     int
+	isPublic bool
+}
+
+// Run compares the three sources of truth and, unless dryRun, repairs drift
+func (rc *Reconciler) Run(ctx context.Context, dryRun bool) (*Report, error) {
+	rep := &Report{DryRun: dryRun}
+
+	apps, err := rc.loadApps()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := rc.Runner.ListApps(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+	installed, routesErr := rc.Caddy.ListRoutes()
+	if routesErr != nil {
+		// Caddy being down shouldn't stop the Docker side from reconciling
+		rep.errorf("listing caddy routes: %v", routesErr)
+	}
+
+	states := make(map[string]string)
+	for _, c := range containers {
+		states[c.AppName] = c.Status
+		if _, ok := apps[c.AppName]; !ok {
+			rep.OrphanContainers = append(rep.OrphanContainers, c.AppName)
+		}
+	}
+
+	for name, app := range apps {
+		state, ok := states[name]
+		if !ok {
+			state = "missing"
+			rep.MissingContainers = append(rep.MissingContainers, name)
+		}
+		if state != app.status {
+			rep.StatusUpdated = append(rep.StatusUpdated, fmt.Sprintf("%s: %s -> %s", name, app.status, state))
+			if !dryRun {
+				if _, err := rc.DB.Conn.Exec("UPDATE apps SET status = ? WHERE name = ?", state, name); err != nil {
+					rep.errorf("updating status of %s: %v", name, err)
+				}
+			}
+		}
+	}
+
+	if routesErr != nil {
+		rep.sort()
+		return rep, nil
+	}
+
+	routes := make(map[string]json.RawMessage)
+	authRoute := false
+	for id, route := range installed {
+		if id == caddy.AuthRouteID {
+			authRoute = true
+			continue
+		}
+		name := strings.TrimPrefix(id, caddy.RoutePrefix)
+		routes[name] = route
+		if _, ok := apps[name]; !ok {
+			rep.RoutesRemoved = append(rep.RoutesRemoved, name)
+			if !dryRun {
+				if err := rc.Caddy.DeleteRoute(name); err != nil {
+					rep.errorf("removing route for %s: %v", name, err)
+				}
+			}
+		}
+	}
+
+	if !authRoute {
+		rep.RoutesRestored = append(rep.RoutesRestored, rc.Cfg.AuthHost)
+		if !dryRun {
+			if err := rc.Caddy.UpsertAuthRoute(rc.Cfg.AuthHost); err != nil {
+				rep.errorf("restoring auth route: %v", err)
+			}
+		}
+	}
+
+	for name, app := range apps {
+		if _, ok := states[name]; !ok {
+			continue // nothing to route to
+		}
+		route, exists := routes[name]
+		if exists && states[name] != "running" {
+			continue // a stopped container may have no address to compare
+		}
+		upstream, err := rc.Runner.Upstream(ctx, name, app.port, rc.Cfg.DialByIP)
+		if err != nil {
+			rep.errorf("resolving upstream for %s: %v", name, err)
+			continue
+		}
+		if !exists {
+			rep.RoutesRestored = append(rep.RoutesRestored, name)
+		} else if !rc.Caddy.RouteCurrent(route, name, rc.Cfg.Domain, upstream, app.isPublic) {
+			rep.RoutesUpdated = append(rep.RoutesUpdated, name)
+		} else {
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		if err := rc.Caddy.UpsertRoute(name, rc.Cfg.Domain, upstream, app.isPublic); err != nil {
+			rep.errorf("updating route for %s: %v", name, err)
+		}
+	}
+
+	rep.sort()
+	return rep, nil
+}
+
+func (rep *Report) sort() {
+	for _, list := range [][]string{rep.OrphanContainers, rep.MissingContainers, rep.StatusUpdated, rep.RoutesRestored, rep.RoutesUpdated, rep.RoutesRemoved} {
+		sort.Strings(list)
+	}
+}
+
+func (rc *Reconciler) loadApps() (map[string]appRow, error) {
+	rows, err := rc.DB.Conn.Query("SELECT name, status, http_port, is_public FROM apps")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apps := make(map[string]appRow)
+	for rows.Next() {
+		var a appRow
+		if err := rows.Scan(&a.name, &a.status, &a.port, &a.isPublic); err != nil {
+			return nil, err
+		}
+		apps[a.name] = a
+	}
+	return apps, rows.Err()
+}
+
+// Log writes a summary of the report to the server log
+func (rep *Report) Log() {
+	if !rep.Drift() && len(rep.Errors) == 0 {
+		return
+	}
+	log.Printf("Reconcile: orphan containers=%v missing containers=%v status updated=%v routes restored=%v routes updated=%v routes removed=%v",
+		rep.OrphanContainers, rep.MissingContainers, rep.StatusUpdated, rep.RoutesRestored, rep.RoutesUpdated, rep.RoutesRemoved)
+	for _, e := range rep.Errors {
+		log.Printf("Reconcile error: %s", e)
+	}
+}
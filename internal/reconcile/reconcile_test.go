@@ -0,0 +1,180 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/caddy"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/runner"
+)
+
+// fakeRunner serves containers and their current addresses
+type fakeRunner struct {
+	containers []runner.AppContainer
+	addrs      map[string]string
+}
+
+func (f *fakeRunner) ListApps(ctx context.Context) ([]runner.AppContainer, error) {
+	return f.containers, nil
+}
+
+func (f *fakeRunner) Upstream(ctx context.Context, appName string, port int, dialByIP bool) (string, error) {
+	return fmt.Sprintf("%s:%d", f.addrs[appName], port), nil
+}
+
+// fakeProxy keeps routes as their upstream and visibility, and records
+// every change made to them
+type fakeProxy struct {
+	routes map[string]json.RawMessage
+	calls  []string
+}
+
+type fakeRoute struct {
+	Upstream string `json:"upstream"`
+	Public   bool   `json:"public"`
+}
+
+func (f *fakeProxy) route(upstream string, public bool) json.RawMessage {
+	raw, _ := json.Marshal(fakeRoute{upstream, public})
+	return raw
+}
+
+func (f *fakeProxy) ListRoutes() (map[string]json.RawMessage, error) {
+	routes := make(map[string]json.RawMessage)
+	for id, r := range f.routes {
+		routes[id] = r
+	}
+	return routes, nil
+}
+
+func (f *fakeProxy) RouteCurrent(installed json.RawMessage, appName, domain, upstream string, public bool) bool {
+	return string(installed) == string(f.route(upstream, public))
+}
+
+func (f *fakeProxy) UpsertRoute(appName, domain, upstream string, public bool) error {
+	f.calls = append(f.calls, "upsert "+appName)
+	f.routes[caddy.RoutePrefix+appName] = f.route(upstream, public)
+	return nil
+}
+
+func (f *fakeProxy) UpsertAuthRoute(authHost string) error {
+	f.calls = append(f.calls, "upsert auth")
+	f.routes[caddy.AuthRouteID] = f.route("gateway", true)
+	return nil
+}
+
+func (f *fakeProxy) DeleteRoute(appName string) error {
+	f.calls = append(f.calls, "delete "+appName)
+	delete(f.routes, caddy.RoutePrefix+appName)
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com')")
+	d.Conn.Exec(`INSERT INTO apps (name, user_id, status, http_port, is_public) VALUES
+		('bloggy', 1, 'running', 80, TRUE),
+		('moved', 1, 'running', 80, TRUE),
+		('unrouted', 1, 'running', 3000, FALSE),
+		('halted', 1, 'running', 80, TRUE),
+		('gone', 1, 'running', 80, TRUE)`)
+
+	r := &fakeRunner{
+		containers: []runner.AppContainer{
+			{AppName: "bloggy", Status: "running"},
+			{AppName: "moved", Status: "running"},
+			{AppName: "unrouted", Status: "running"},
+			{AppName: "halted", Status: "stopped"},
+			{AppName: "orphan", Status: "running"},
+		},
+		addrs: map[string]string{"bloggy": "10.0.0.2", "moved": "10.0.0.9", "unrouted": "10.0.0.4", "halted": "10.0.0.5"},
+	}
+	p := &fakeProxy{routes: map[string]json.RawMessage{}}
+	p.routes[caddy.RoutePrefix+"bloggy"] = p.route("10.0.0.2:80", true)
+	p.routes[caddy.RoutePrefix+"moved"] = p.route("10.0.0.3:80", true) // before a restart
+	p.routes[caddy.RoutePrefix+"halted"] = p.route("10.0.0.5:80", true)
+	p.routes[caddy.RoutePrefix+"ghost"] = p.route("10.0.0.6:80", true)
+	rc := New(d, r, p, &config.Config{Domain: "example.com", AuthHost: "auth.example.com"})
+
+	want := &Report{
+		DryRun:            true,
+		OrphanContainers:  []string{"orphan"},
+		MissingContainers: []string{"gone"},
+		StatusUpdated:     []string{"gone: running -> missing", "halted: running -> stopped"},
+		RoutesRestored:    []string{"auth.example.com", "unrouted"},
+		RoutesUpdated:     []string{"moved"},
+		RoutesRemoved:     []string{"ghost"},
+	}
+	statuses := func() map[string]string {
+		m := map[string]string{}
+		rows, _ := d.Conn.Query("SELECT name, status FROM apps")
+		defer rows.Close()
+		for rows.Next() {
+			var name, status string
+			rows.Scan(&name, &status)
+			m[name] = status
+		}
+		return m
+	}
+
+	// A dry run reports the drift and touches nothing
+	rep, err := rc.Run(context.Background(), true)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !reflect.DeepEqual(rep, want) {
+		t.Errorf("Unexpected dry run report:\n got %+v\nwant %+v", rep, want)
+	}
+	if len(p.calls) != 0 {
+		t.Errorf("Expected a dry run to leave Caddy alone, got %v", p.calls)
+	}
+	if s := statuses(); s["gone"] != "running" || s["halted"] != "running" {
+		t.Errorf("Expected a dry run to leave statuses alone, got %v", s)
+	}
+
+	// A real run repairs the same drift
+	rep, err = rc.Run(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want.DryRun = false
+	if !reflect.DeepEqual(rep, want) {
+		t.Errorf("Unexpected report:\n got %+v\nwant %+v", rep, want)
+	}
+	if s := statuses(); s["gone"] != "missing" || s["halted"] != "stopped" || s["bloggy"] != "running" {
+		t.Errorf("Expected statuses to follow Docker, got %v", s)
+	}
+	if _, ok := p.routes[caddy.RoutePrefix+"ghost"]; ok {
+		t.Error("Expected the route for an unknown app to be removed")
+	}
+	if got := p.routes[caddy.RoutePrefix+"moved"]; string(got) != string(p.route("10.0.0.9:80", true)) {
+		t.Errorf("Expected the stale upstream to be replaced, got %s", got)
+	}
+	if _, ok := p.routes[caddy.RoutePrefix+"unrouted"]; !ok {
+		t.Error("Expected the missing route to be restored")
+	}
+
+	// Orphan containers and apps without one are only ever reported, so
+	// they're all that's left
+	p.calls = nil
+	rep, err = rc.Run(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !reflect.DeepEqual(rep, &Report{OrphanContainers: []string{"orphan"}, MissingContainers: []string{"gone"}}) || len(p.calls) != 0 {
+		t.Errorf("Expected only the orphan and missing container to remain, got %+v and calls %v", rep, p.calls)
+	}
+}
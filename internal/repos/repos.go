@@ -0,0 +1,148 @@
+// Package repos keeps a bare git repository per app for push deploys and
+// serves git's SSH commands against them.
+package repos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Git's SSH transport commands
+const (
+	ReceivePack = "git-receive-pack" // git push
+	UploadPack  = "git-upload-pack"  // git fetch and clone
+)
+
+// Store holds the repositories under Dir as <app>.git. Pushes to Branch
+// are deployed.
+type Store struct {
+	Dir    string
+	Branch string
+}
+
+func New(dir, branch string) *Store {
+	return &Store{Dir: dir, Branch: branch}
+}
+
+// DeployRef is the ref whose updates trigger a deploy
+func (s *Store) DeployRef() string {
+	return "refs/heads/" + s.Branch
+}
+
+// ParseCommand recognises the command git runs over SSH, e.g.
+// git-receive-pack 'bloggy.git', and returns the service and app name
+func ParseCommand(command []string) (service, app string, ok bool) {
+	if len(command) != 2 || (command[0] != ReceivePack && command[0] != UploadPack) {
+		return "", "", false
+	}
+	app = strings.TrimPrefix(command[1], "~")
+	app = strings.Trim(app, "/")
+	app = strings.TrimSuffix(app, ".git")
+	if app == "" || strings.ContainsAny(app, "/\\") || strings.HasPrefix(app, ".") {
+		return command[0], "", false
+	}
+	return command[0], app, true
+}
+
+// Path returns where the app's repository lives
+func (s *Store) Path(app string) string {
+	return filepath.Join(s.Dir, app+".git")
+}
+
+// Init creates the app's bare repository if it doesn't exist yet. Pushes
+// can't delete branches: the deploy branch always matches what is running.
+func (s *Store) Init(app string) error {
+	if _, err := os.Stat(s.Path(app)); err != nil {
+		if err := os.MkdirAll(s.Dir, 0o750); err != nil {
+			return err
+		}
+		if err := s.git(context.Background(), "", "init", "--quiet", "--bare", "--initial-branch="+s.Branch, s.Path(app)); err != nil {
+			return err
+		}
+	}
+	return s.git(context.Background(), app, "config", "receive.denyDeletes", "true")
+}
+
+// Remove deletes the app's repository
+func (s *Store) Remove(app string) error {
+	return os.RemoveAll(s.Path(app))
+}
+
+// Ref returns the commit a ref points at, or "" if it doesn't exist
+func (s *Store) Ref(app, ref string) string {
+	out, err := exec.Command("git", "--git-dir", s.Path(app), "rev-parse", "--verify", "--quiet", ref+"^{commit}").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// ResetRef points ref back at commit, or deletes it if commit is empty
+func (s *Store) ResetRef(app, ref, commit string) error {
+	if commit == "" {
+		return s.git(context.Background(), app, "update-ref", "-d", ref)
+	}
+	return s.git(context.Background(), app, "update-ref", ref, commit)
+}
+
+// Archive writes the tree of commit to w as a tar, for use as a build context
+func (s *Store) Archive(ctx context.Context, app, commit string, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, "git", "--git-dir", s.Path(app), "archive", "--format=tar", commit)
+	cmd.Stdout = w
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git archive: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Serve runs a git service against the app's repository, speaking git's
+// wire protocol over stdin and stdout
+func (s *Store) Serve(ctx context.Context, service, app string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if service != ReceivePack && service != UploadPack {
+		return fmt.Errorf("unsupported git service: %s", service)
+	}
+	cmd := exec.CommandContext(ctx, "git", strings.TrimPrefix(service, "git-"), s.Path(app))
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// The SSH client may keep its side open after the exchange, so don't
+	// let Wait block on copying stdin
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(in, stdin)
+		in.Close()
+	}()
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("%s exited with status %d", service, exitErr.ExitCode())
+	}
+	return err
+}
+
+func (s *Store) git(ctx context.Context, app string, args ...string) error {
+	full := args
+	if app != "" {
+		full = append([]string{"--git-dir", s.Path(app)}, args...)
+	}
+	out, err := exec.CommandContext(ctx, "git", full...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
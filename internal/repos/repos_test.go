@@ -0,0 +1,116 @@
+package repos
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		command []string
+		service string
+		app     string
+		ok      bool
+	}{
+		{[]string{"git-receive-pack", "bloggy"}, ReceivePack, "bloggy", true},
+		{[]string{"git-receive-pack", "/bloggy.git"}, ReceivePack, "bloggy", true},
+		{[]string{"git-upload-pack", "~/bloggy.git/"}, UploadPack, "bloggy", true},
+		{[]string{"git-upload-pack", "../etc"}, UploadPack, "", false},
+		{[]string{"git-receive-pack", "a/b"}, ReceivePack, "", false},
+		{[]string{"git-receive-pack", ".git"}, ReceivePack, "", false},
+		{[]string{"git-upload-archive", "bloggy"}, "", "", false},
+		{[]string{"ls"}, "", "", false},
+	}
+	for _, tt := range tests {
+		service, app, ok := ParseCommand(tt.command)
+		if service != tt.service || app != tt.app || ok != tt.ok {
+			t.Errorf("ParseCommand(%q) = %q, %q, %v; want %q, %q, %v", tt.command, service, app, ok, tt.service, tt.app, tt.ok)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	store := New(filepath.Join(t.TempDir(), "repos"), "main")
+	if err := store.Init("bloggy"); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if err := store.Init("bloggy"); err != nil {
+		t.Fatalf("Init should be idempotent: %v", err)
+	}
+	ref := store.DeployRef()
+	if got := store.Ref("bloggy", ref); got != "" {
+		t.Errorf("Expected no commit on a new repo, got %q", got)
+	}
+
+	work := t.TempDir()
+	os.WriteFile(filepath.Join(work, "Dockerfile"), []byte("FROM alpine\n"), 0o644)
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", work, "-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v: %s", args, err, out)
+		}
+	}
+	git("init", "--quiet")
+	git("add", ".")
+	git("commit", "--quiet", "-m", "first")
+	git("push", "--quiet", store.Path("bloggy"), "HEAD:main")
+
+	commit := store.Ref("bloggy", ref)
+	if len(commit) != 40 {
+		t.Fatalf("Expected main to point at a commit, got %q", commit)
+	}
+
+	// Pushes can't delete branches, including a deploy branch that isn't
+	// the repository's HEAD (e.g. after GIT_DEPLOY_BRANCH changed)
+	git("push", "--quiet", store.Path("bloggy"), "HEAD:prod")
+	for _, branch := range []string{"main", "prod"} {
+		cmd := exec.Command("git", "-C", work, "push", "--quiet", store.Path("bloggy"), ":"+branch)
+		if out, err := cmd.CombinedOutput(); err == nil {
+			t.Errorf("Expected deleting %s to fail, got %s", branch, out)
+		}
+		if got := store.Ref("bloggy", "refs/heads/"+branch); got != commit {
+			t.Errorf("Expected %s to still point at %s, got %q", branch, commit, got)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := store.Archive(context.Background(), "bloggy", commit, &buf); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			names = append(names, hdr.Name)
+		}
+	}
+	if len(names) != 1 || names[0] != "Dockerfile" {
+		t.Errorf("Expected the archive to contain the Dockerfile, got %v", names)
+	}
+
+	if err := store.ResetRef("bloggy", ref, ""); err != nil {
+		t.Fatalf("ResetRef failed: %v", err)
+	}
+	if got := store.Ref("bloggy", ref); got != "" {
+		t.Errorf("Expected main to be deleted, got %q", got)
+	}
+
+	if err := store.Remove("bloggy"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := os.Stat(store.Path("bloggy")); !os.IsNotExist(err) {
+		t.Errorf("Expected the repository to be gone, got %v", err)
+	}
+}
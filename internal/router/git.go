@@ -0,0 +1,86 @@
+package router
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/repos"
+	"github.com/rnzor/poor_man_exe/internal/service"
+)
+
+// HandleGit serves git push and fetch against the app's repository. A push
+// that moves the deploy branch builds its Dockerfile and redeploys the app;
+// if that fails the branch is moved back so the repository keeps matching
+// what is running. Everything meant for the user goes to stderr, since
+// stdout carries git's protocol.
+func (r *Router) HandleGit(sess ssh.Session, gitService, appName string) {
+	stderr := sess.Stderr()
+	fail := func(format string, args ...interface{}) {
+		fmt.Fprintf(stderr, "Error: "+format+"\n", args...)
+		sess.Exit(1)
+	}
+
+	svc := service.New(r.DB, r.Runner, r.Caddy, r.Cfg)
+	sub := policy.SubjectFromContext(sess.Context())
+	action := policy.AppRead
+	if gitService == repos.ReceivePack {
+		action = policy.AppDeploy
+	}
+	if _, err := svc.Policy.AuthorizeApp(sub, action, appName); err != nil {
+		fail("%v", err)
+		return
+	}
+
+	store := repos.New(r.Cfg.GitRepoDir, r.Cfg.GitDeployBranch)
+	if err := store.Init(appName); err != nil {
+		fail("preparing repository: %v", err)
+		return
+	}
+	ref := store.DeployRef()
+	before := store.Ref(appName, ref)
+
+	if err := store.Serve(sess.Context(), gitService, appName, sess, sess, stderr); err != nil {
+		fail("%v", err)
+		return
+	}
+	if gitService != repos.ReceivePack {
+		sess.Exit(0)
+		return
+	}
+
+	after := store.Ref(appName, ref)
+	if after == "" {
+		fmt.Fprintf(stderr, "%s deleted, nothing to deploy. Push to %s to deploy.\n", ref, r.Cfg.GitDeployBranch)
+		sess.Exit(0)
+		return
+	}
+	if after == before {
+		fmt.Fprintf(stderr, "%s unchanged, nothing to deploy. Push to %s to deploy.\n", ref, r.Cfg.GitDeployBranch)
+		sess.Exit(0)
+		return
+	}
+
+	fmt.Fprintf(stderr, "-----> Building %s from %s\n", appName, after[:12])
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(store.Archive(sess.Context(), appName, after, pw))
+	}()
+	built, warnings, err := svc.Deploy(sess.Context(), sub, appName, pr, "git "+after[:12], stderr)
+	pr.Close()
+	if err != nil {
+		if rerr := store.ResetRef(appName, ref, before); rerr != nil {
+			fmt.Fprintf(stderr, "Warning: failed to reset %s: %v\n", ref, rerr)
+		}
+		fail("%v", err)
+		return
+	}
+
+	for _, w := range warnings {
+		fmt.Fprintf(stderr, "Warning: %s\n", w)
+	}
+	fmt.Fprintf(stderr, "-----> Deployed %s version %d (%s)\n", appName, built.Version, built.Image)
+	fmt.Fprintf(stderr, "       https://%s.%s\n", appName, r.Cfg.Domain)
+	sess.Exit(0)
+}
@@ -1,62 +1,130 @@
 package router
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/auth"
 	"github.com/rnzor/poor_man_exe/internal/caddy"
 	"github.com/rnzor/poor_man_exe/internal/cli"
 	"github.com/rnzor/poor_man_exe/internal/config"
 	"github.com/rnzor/poor_man_exe/internal/db"
-	"github.com/rnzor/poor_man_exe/internal/runner"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/repos"
+	"github.com/rnzor/poor_man_exe/internal/sessions"
 )
 
+// Runner is the part of runner.DockerRunner sessions use, so tests can stand
+// in for Docker
+type Runner interface {
+	cli.Runner
+	Attach(ctx context.Context, appName string, cmd []string, stdin io.Reader, stdout, stderr io.Writer, sess ssh.Session) (int, error)
+}
+
 type Router struct {
-	DB     *db.Database
-	Runner *runner.DockerRunner
-	Cfg    *config.Config
-	Caddy  *caddy.Client
+	DB       *db.Database
+	Runner   Runner
+	Cfg      *config.Config
+	Caddy    *caddy.Client
+	Sessions *sessions.Registry
+}
+
+func NewRouter(d *db.Database, r Runner, cfg *config.Config, c *caddy.Client, reg *sessions.Registry) *Router {
+	return &Router{DB: d, Runner: r, Cfg: cfg, Caddy: c, Sessions: reg}
+}
+
+// isManagementUser reports whether an SSH username opens the CLI rather than an app
+func isManagementUser(username string) bool {
+	return username == "root" || username == "exedev" || username == "" || username == "poor-exe"
 }
 
-func NewRouter(d *db.Database, r *runner.DockerRunner, cfg *config.Config, c *caddy.Client) *Router {
-	return &Router{DB: d, Runner: r, Cfg: cfg, Caddy: c}
+// Target names what a session for username connects to, for the session registry
+func Target(username string) string {
+	switch {
+	case username == auth.RegisterUser:
+		return "register"
+	case isManagementUser(username):
+		return "cli"
+	default:
+		return username
+	}
 }
 
 func (r *Router) HandleSession(sess ssh.Session) {
 	username := sess.User()
 	command := sess.Command()
 
+	// Unknown keys admitted for signup can do nothing else
+	if registering, _ := sess.Context().Value("registering").(bool); registering {
+		cli.StartRegistration(sess, r.DB, r.Cfg)
+		return
+	}
+	if username == auth.RegisterUser {
+		fmt.Fprintln(sess, "This key is already registered. Connect as poor-exe@ instead.")
+		sess.Exit(1)
+		return
+	}
+
+	// Per-key options from authorized_keys
+	opts, _ := sess.Context().Value("key_options").(auth.KeyOptions)
+	if _, _, isPty := sess.Pty(); isPty && opts.NoPTY {
+		fmt.Fprintln(sess, "Error: this key may not allocate a PTY; connect with ssh -T")
+		sess.Exit(1)
+		return
+	}
+	isManagement := isManagementUser(username)
+	if opts.Command != "" {
+		if isManagement {
+			command = strings.Fields(opts.Command)
+		} else {
+			command = []string{"/bin/sh", "-c", opts.Command}
+		}
+	}
+
 	// If username is one of these, it's management mode
-	if username == "root" || username == "exedev" || username == "" || username == "poor-exe" {
+	if isManagement {
+		// git push/fetch; app-limited keys may use their apps' repositories
+		if gitService, appName, ok := repos.ParseCommand(command); ok {
+			r.HandleGit(sess, gitService, appName)
+			return
+		}
+
+		// Keys and certificates limited to apps only open app shells
+		if sub := policy.SubjectFromContext(sess.Context()); sub.Restricted() {
+			r.DB.LogAudit("access_denied", sub.UserID, "", sub.RemoteIP, "action=cli allowed_apps="+strings.Join(sub.Apps, ","))
+			fmt.Fprintf(sess, "Error: this key only grants access to: %s\n", strings.Join(sub.Apps, ", "))
+			sess.Exit(1)
+			return
+		}
 		if len(command) > 0 {
-			cli.ExecuteCommand(sess, command, r.DB, r.Runner, r.Caddy, r.Cfg)
+			cli.ExecuteCommand(sess, command, r.DB, r.Runner, r.Caddy, r.Cfg, r.Sessions)
 		} else {
-			cli.StartInteractiveCLI(sess, r.DB, r.Runner, r.Caddy, r.Cfg)
+			cli.StartInteractiveCLI(sess, r.DB, r.Runner, r.Caddy, r.Cfg, r.Sessions)
 		}
 		return
 	}
 
 	// Otherwise, username is the app name
-	r.AttachToApp(sess, username)
+	r.AttachToApp(sess, username, command)
 }
 
-func (r *Router) AttachToApp(sess ssh.Session, appName string) {
-	userID := sess.Context().Value("user_id").(int)
-
-	// Verify user has access to this app
-	var exists bool
-	err := r.DB.Conn.QueryRow("SELECT EXISTS(SELECT 1 FROM apps WHERE name = ? AND user_id = ?)", appName, userID).Scan(&exists)
-	if err != nil || !exists {
-		fmt.Fprintf(sess, "Error: App '%s' not found or access denied.\n", appName)
+// AttachToApp runs command (or a shell, if empty) in the app's container
+func (r *Router) AttachToApp(sess ssh.Session, appName string, command []string) {
+	sub := policy.SubjectFromContext(sess.Context())
+	if _, err := policy.New(r.DB, r.Cfg).AuthorizeApp(sub, policy.AppExec, appName); err != nil {
+		fmt.Fprintf(sess, "Error: %v\n", err)
 		sess.Exit(1)
 		return
 	}
 
-	// Attach to the container
-	err = r.Runner.Attach(sess.Context(), appName, sess, sess, sess.Stderr(), sess)
+	exitCode, err := r.Runner.Attach(sess.Context(), appName, command, sess, sess, sess.Stderr(), sess)
 	if err != nil {
-		fmt.Fprintf(sess, "Error attaching to app: %v\n", err)
+		fmt.Fprintf(sess.Stderr(), "Error attaching to app: %v\n", err)
 		sess.Exit(1)
 		return
 	}
+	sess.Exit(exitCode)
 }
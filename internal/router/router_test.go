@@ -0,0 +1,134 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rnzor/poor_man_exe/internal/auth"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+// fakeRunner runs nothing; it records what Attach was asked to run and
+// returns the exit code or error it was given. Other methods panic through
+// the nil embedded Runner.
+type fakeRunner struct {
+	Runner
+	exitCode int
+	err      error
+	attached [][]string
+}
+
+func (f *fakeRunner) Attach(ctx context.Context, appName string, cmd []string, stdin io.Reader, stdout, stderr io.Writer, sess ssh.Session) (int, error) {
+	f.attached = append(f.attached, append([]string{appName}, cmd...))
+	return f.exitCode, f.err
+}
+
+type fakeContext struct {
+	ssh.Context
+	values map[interface{}]interface{}
+}
+
+func (c *fakeContext) Value(key interface{}) interface{}       { return c.values[key] }
+func (c *fakeContext) Done() <-chan struct{}                   { return nil }
+func (c *fakeContext) Err() error                              { return nil }
+func (c *fakeContext) Deadline() (deadline time.Time, ok bool) { return }
+
+// fakeSession is an SSH session without a PTY for user, running args
+type fakeSession struct {
+	ssh.Session
+	ctx  *fakeContext
+	user string
+	args []string
+	out  bytes.Buffer
+	code int
+}
+
+func (s *fakeSession) Context() ssh.Context                    { return s.ctx }
+func (s *fakeSession) User() string                            { return s.user }
+func (s *fakeSession) Command() []string                       { return s.args }
+func (s *fakeSession) Pty() (ssh.Pty, <-chan ssh.Window, bool) { return ssh.Pty{}, nil, false }
+func (s *fakeSession) Write(p []byte) (int, error)             { return s.out.Write(p) }
+func (s *fakeSession) Stderr() io.ReadWriter                   { return &s.out }
+func (s *fakeSession) Exit(code int) error                     { s.code = code; return nil }
+
+func TestAttachToApp(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com'), (2, 'bob@example.com')")
+	d.Conn.Exec("INSERT INTO apps (name, user_id) VALUES ('bloggy', 1)")
+
+	fake := &fakeRunner{}
+	r := NewRouter(d, fake, &config.Config{}, nil, nil)
+	session := func(userID int, app string, args ...string) *fakeSession {
+		return &fakeSession{
+			ctx:  &fakeContext{values: map[interface{}]interface{}{"user_id": userID}},
+			user: app,
+			args: args,
+			code: -1,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		sess     *fakeSession
+		exitCode int
+		err      error
+		attached []string // nil if Attach mustn't be reached
+		code     int
+		output   string
+	}{
+		{"shell", session(1, "bloggy"), 0, nil, []string{"bloggy"}, 0, ""},
+		{"command", session(1, "bloggy", "ls", "-la", "/var/www"), 0, nil, []string{"bloggy", "ls", "-la", "/var/www"}, 0, ""},
+		{"exit code", session(1, "bloggy", "false"), 3, nil, []string{"bloggy", "false"}, 3, ""},
+		{"attach error", session(1, "bloggy", "true"), -1, errors.New("no such container"), []string{"bloggy", "true"}, 1, "no such container"},
+		{"not a member", session(2, "bloggy", "ls"), 0, nil, nil, 1, "not found or access denied"},
+		{"unknown app", session(1, "ghost", "ls"), 0, nil, nil, 1, "not found or access denied"},
+	}
+	for _, tt := range tests {
+		fake.exitCode, fake.err, fake.attached = tt.exitCode, tt.err, nil
+		r.HandleSession(tt.sess)
+
+		if tt.attached == nil && len(fake.attached) != 0 {
+			t.Errorf("%s: expected nothing to run, got %v", tt.name, fake.attached)
+		}
+		if tt.attached != nil && (len(fake.attached) != 1 || !reflect.DeepEqual(fake.attached[0], tt.attached)) {
+			t.Errorf("%s: expected %v to run, got %v", tt.name, tt.attached, fake.attached)
+		}
+		if tt.sess.code != tt.code {
+			t.Errorf("%s: expected exit code %d, got %d", tt.name, tt.code, tt.sess.code)
+		}
+		if !strings.Contains(tt.sess.out.String(), tt.output) {
+			t.Errorf("%s: expected output mentioning %q, got %q", tt.name, tt.output, tt.sess.out.String())
+		}
+	}
+
+	var denials int
+	d.Conn.QueryRow("SELECT COUNT(*) FROM audit_log WHERE event = 'access_denied'").Scan(&denials)
+	if denials != 2 {
+		t.Errorf("Expected 2 denials in the audit log, got %d", denials)
+	}
+
+	// A forced command from authorized_keys replaces whatever was asked for
+	fake.exitCode, fake.err, fake.attached = 0, nil, nil
+	sess := session(1, "bloggy", "rm", "-rf", "/")
+	sess.ctx.values["key_options"] = auth.KeyOptions{Command: "tail -f /var/log/app.log"}
+	r.HandleSession(sess)
+	if want := []string{"bloggy", "/bin/sh", "-c", "tail -f /var/log/app.log"}; len(fake.attached) != 1 || !reflect.DeepEqual(fake.attached[0], want) {
+		t.Errorf("Expected the forced command to run, got %v", fake.attached)
+	}
+}
@@ -0,0 +1,143 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/client"
+)
+
+// A blue/green redeploy starts the new version in a "next" container beside
+// the app's current one, checks its health, points Caddy at it and then
+// promotes it to the app's usual container name.
+
+func nextContainerName(appName string) string {
+	return fmt.Sprintf("poor-exe-%s_next", appName)
+}
+
+// StartNext creates and starts the next container for spec, replacing any
+// leftover from an earlier attempt. It returns the container's ip:port.
+func (r *DockerRunner) StartNext(ctx context.Context, spec AppSpec, port int) (string, error) {
+	if err := r.RemoveNext(ctx, spec.Name); err != nil {
+		return "", err
+	}
+	if err := r.createContainer(ctx, spec, nextContainerName(spec.Name)); err != nil {
+		r.RemoveNext(context.Background(), spec.Name)
+		return "", err
+	}
+	return r.containerAddr(ctx, nextContainerName(spec.Name), port)
+}
+
+// RemoveNext removes the app's next container, if any
+func (r *DockerRunner) RemoveNext(ctx context.Context, appName string) error {
+	_, err := r.Cli.ContainerRemove(ctx, nextContainerName(appName), client.ContainerRemoveOptions{Force: true})
+	if err != nil && !cerrdefs.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// PromoteNext removes the app's current container and renames the next one
+// in its place
+func (r *DockerRunner) PromoteNext(ctx context.Context, appName string) error {
+	if err := r.RemoveApp(ctx, appName); err != nil {
+		return err
+	}
+	_, err := r.Cli.ContainerRename(ctx, nextContainerName(appName), client.ContainerRenameOptions{NewName: fmt.Sprintf("poor-exe-%s", appName)})
+	return err
+}
+
+// IsRunning reports whether the app's container is running
+func (r *DockerRunner) IsRunning(ctx context.Context, appName string) bool {
+	inspect, err := r.Cli.ContainerInspect(ctx, fmt.Sprintf("poor-exe-%s", appName), client.ContainerInspectOptions{})
+	return err == nil && inspect.Container.State != nil && inspect.Container.State.Running
+}
+
+// HealthCheck decides when a new container is ready for traffic: "tcp" waits
+// for the port to accept connections, "http:<path>" for a non-error response
+// to a GET of path, and "none" only for the container to keep running.
+type HealthCheck struct {
+	Kind string // tcp, http or none
+	Path string
+}
+
+func ParseHealthCheck(s string) (HealthCheck, error) {
+	switch {
+	case s == "tcp" || s == "none":
+		return HealthCheck{Kind: s}, nil
+	case strings.HasPrefix(s, "http:/"):
+		return HealthCheck{Kind: "http", Path: strings.TrimPrefix(s, "http:")}, nil
+	}
+	return HealthCheck{}, fmt.Errorf("invalid health check %q: use tcp, http:/<path> or none", s)
+}
+
+func (h HealthCheck) String() string {
+	if h.Kind == "http" {
+		return "http:" + h.Path
+	}
+	return h.Kind
+}
+
+// WaitHealthy polls the app's next container at addr until check passes, it
+// stops running, or timeout elapses
+func (r *DockerRunner) WaitHealthy(ctx context.Context, appName, addr string, check HealthCheck, timeout time.Duration) error {
+	deadline, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// With no check, the container just has to stay up for a moment
+	settle := time.Now().Add(2 * time.Second)
+	httpClient := &http.Client{
+		Timeout: 2 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	lastErr := errors.New("no response yet")
+	for {
+		inspect, err := r.Cli.ContainerInspect(ctx, nextContainerName(appName), client.ContainerInspectOptions{})
+		if err != nil {
+			return err
+		}
+		if state := inspect.Container.State; state != nil && !state.Running {
+			return fmt.Errorf("container exited with code %d", state.ExitCode)
+		}
+
+		switch check.Kind {
+		case "none":
+			if time.Now().After(settle) {
+				return nil
+			}
+		case "tcp":
+			conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+			if err == nil {
+				conn.Close()
+				return nil
+			}
+			lastErr = err
+		case "http":
+			resp, err := httpClient.Get("http://" + addr + check.Path)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode < 400 {
+					return nil
+				}
+				err = fmt.Errorf("GET %s returned %s", check.Path, resp.Status)
+			}
+			lastErr = err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.Done():
+			return fmt.Errorf("%s health check did not pass within %s: %v", check, timeout, lastErr)
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package runner
+
+import "testing"
+
+func TestParseHealthCheck(t *testing.T) {
+	tests := []struct {
+		in   string
+		want HealthCheck
+		ok   bool
+	}{
+		{"tcp", HealthCheck{Kind: "tcp"}, true},
+		{"none", HealthCheck{Kind: "none"}, true},
+		{"http:/healthz", HealthCheck{Kind: "http", Path: "/healthz"}, true},
+		{"http:healthz", HealthCheck{}, false},
+		{"http", HealthCheck{}, false},
+		{"", HealthCheck{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseHealthCheck(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseHealthCheck(%q) = %+v, %v", tt.in, got, err)
+		}
+		if tt.ok && got.String() != tt.in {
+			t.Errorf("Expected %q to round trip, got %q", tt.in, got.String())
+		}
+	}
+}
@@ -2,88 +2,373 @@ package runner
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	cerrdefs "github.com/containerd/errdefs"
 	"github.com/gliderlabs/ssh"
+	"github.com/moby/moby/api/pkg/stdcopy"
 	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/jsonstream"
+	"github.com/moby/moby/api/types/mount"
+	"github.com/moby/moby/api/types/network"
 	"github.com/moby/moby/client"
 )
 
 type DockerRunner struct {
 	Cli *client.Client
+	// Network is the Docker network app containers join. Caddy reaches apps
+	// through it, either by container name or by the container's IP on it.
+	Network string
 }
 
-func NewDockerRunner() (*DockerRunner, error) {
+func NewDockerRunner(network string) (*DockerRunner, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, err
 	}
-	return &DockerRunner{Cli: cli}, nil
+	return &DockerRunner{Cli: cli, Network: network}, nil
 }
 
-func (r *DockerRunner) CreateApp(ctx context.Context, name, image string, userID int) error {
-	containerName := fmt.Sprintf("poor-exe-%s", name)
-
-	// Pull image if not present (ignore errors, image may exist locally)
-	pullResp, err := r.Cli.ImagePull(ctx, image, client.ImagePullOptions{})
+// EnsureNetwork creates the app network if it does not exist yet
+func (r *DockerRunner) EnsureNetwork(ctx context.Context) error {
+	_, err := r.Cli.NetworkInspect(ctx, r.Network, client.NetworkInspectOptions{})
 	if err == nil {
-		pullResp.Wait(ctx)
-		pullResp.Close()
+		return nil
+	}
+	if !cerrdefs.IsNotFound(err) {
+		return err
+	}
+	_, err = r.Cli.NetworkCreate(ctx, r.Network, client.NetworkCreateOptions{
+		Driver: "bridge",
+		Labels: map[string]string{"poor-exe": "true"},
+	})
+	return err
+}
+
+// Upstream returns the address Caddy should dial to reach an app's port.
+// With dialByIP the container's address on the app network is used, for a
+// Caddy running on the host; otherwise the container name, for a Caddy that
+// has joined the app network itself.
+func (r *DockerRunner) Upstream(ctx context.Context, appName string, port int, dialByIP bool) (string, error) {
+	containerName := fmt.Sprintf("poor-exe-%s", appName)
+	if !dialByIP {
+		return fmt.Sprintf("%s:%d", containerName, port), nil
+	}
+	return r.containerAddr(ctx, containerName, port)
+}
+
+// containerAddr returns the container's ip:port on the app network
+func (r *DockerRunner) containerAddr(ctx context.Context, containerName string, port int) (string, error) {
+	inspect, err := r.Cli.ContainerInspect(ctx, containerName, client.ContainerInspectOptions{})
+	if err != nil {
+		return "", err
+	}
+	if inspect.Container.NetworkSettings != nil {
+		if ep, ok := inspect.Container.NetworkSettings.Networks[r.Network]; ok && ep.IPAddress.IsValid() {
+			return net.JoinHostPort(ep.IPAddress.String(), strconv.Itoa(port)), nil
+		}
+	}
+	return "", fmt.Errorf("container %s has no address on network %s", containerName, r.Network)
+}
+
+// Limits caps the resources an app container may use. Zero means unlimited.
+type Limits struct {
+	MemoryMB int64   `json:"memory_mb"`
+	CPUs     float64 `json:"cpus"`
+	Pids     int64   `json:"pids"`
+}
+
+// AppSpec describes everything needed to (re)create an app container
+type AppSpec struct {
+	Name   string
+	Image  string
+	UserID int
+	Env    []string
+	Limits Limits
+	// Volumes are attached at their paths; RecreateApp carries over the
+	// old container's volumes when this is nil
+	Volumes []Volume
+	// Pull, if set, receives progress while the image is pulled
+	Pull func(PullEvent)
+}
+
+// Volume is a Docker volume mounted into an app container
+type Volume struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// LocalImagePrefix names images built by the gateway. They only exist
+// locally, so they are never pulled.
+const LocalImagePrefix = "poor-exe/"
+
+func (r *DockerRunner) CreateApp(ctx context.Context, spec AppSpec) error {
+	return r.createContainer(ctx, spec, fmt.Sprintf("poor-exe-%s", spec.Name))
+}
+
+// createContainer creates and starts a container for spec
+func (r *DockerRunner) createContainer(ctx context.Context, spec AppSpec, containerName string) error {
+	id, err := r.newContainer(ctx, spec, containerName)
+	if err != nil {
+		return err
+	}
+	_, err = r.Cli.ContainerStart(ctx, id, client.ContainerStartOptions{})
+	return err
+}
+
+// newContainer pulls the image and creates, but doesn't start, a container
+// for spec. It returns the container's ID.
+func (r *DockerRunner) newContainer(ctx context.Context, spec AppSpec, containerName string) (string, error) {
+	// Pull the latest image; a failed pull is fine if a copy exists locally.
+	// Gateway builds and pinned image IDs only exist locally.
+	if !strings.HasPrefix(spec.Image, LocalImagePrefix) && !strings.HasPrefix(spec.Image, "sha256:") {
+		if err := r.PullImage(ctx, spec.Image, spec.Pull); err != nil && (ctx.Err() != nil || !r.ImageExists(ctx, spec.Image)) {
+			return "", err
+		}
+	}
+
+	resources := container.Resources{
+		Memory:   spec.Limits.MemoryMB * 1024 * 1024,
+		NanoCPUs: int64(spec.Limits.CPUs * 1e9),
+	}
+	if spec.Limits.Pids > 0 {
+		resources.PidsLimit = &spec.Limits.Pids
+	}
+	var mounts []mount.Mount
+	for _, v := range spec.Volumes {
+		mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Source: v.Name, Target: v.Path})
 	}
 
 	resp, err := r.Cli.ContainerCreate(ctx, client.ContainerCreateOptions{
 		Name: containerName,
 		Config: &container.Config{
-			Image: image,
+			Image: spec.Image,
+			Env:   spec.Env,
 			Labels: map[string]string{
 				"poor-exe": "true",
-				"user_id":  fmt.Sprintf("%d", userID),
-				"app_name": name,
+				"user_id":  fmt.Sprintf("%d", spec.UserID),
+				"app_name": spec.Name,
 			},
-			Tty: true,
+			// No TTY, so logs keep stdout and stderr apart. An open stdin
+			// keeps images whose command is a shell (e.g. alpine) running.
+			OpenStdin: true,
+		},
+		HostConfig: &container.HostConfig{
+			Resources:   resources,
+			NetworkMode: container.NetworkMode(r.Network),
+			Mounts:      mounts,
 		},
+		NetworkingConfig: &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				r.Network: {Aliases: []string{spec.Name}},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// BuildImage builds the Dockerfile in a tar build context and tags the
+// result. The build output is written to out as it arrives.
+func (r *DockerRunner) BuildImage(ctx context.Context, buildContext io.Reader, tag string, labels map[string]string, out io.Writer) error {
+	resp, err := r.Cli.ImageBuild(ctx, buildContext, client.ImageBuildOptions{
+		Tags:        []string{tag},
+		Remove:      true,
+		ForceRemove: true,
+		Labels:      labels,
 	})
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg jsonstream.Message
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if msg.Stream != "" {
+			io.WriteString(out, msg.Stream)
+		} else if msg.Status != "" && msg.Progress == nil {
+			fmt.Fprintln(out, msg.Status)
+		}
+	}
+}
+
+// RemoveApp force-removes an app's container. A container that is already
+// gone is not an error.
+func (r *DockerRunner) RemoveApp(ctx context.Context, name string) error {
+	containerName := fmt.Sprintf("poor-exe-%s", name)
+	_, err := r.Cli.ContainerRemove(ctx, containerName, client.ContainerRemoveOptions{Force: true})
+	if err != nil && !cerrdefs.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// RecreateApp replaces an app's container with a fresh one, e.g. to apply
+// changed environment variables. Volumes are kept; other data in the old
+// container is lost. The new container is created under the app's next name
+// and only swapped in once it has started, so on error the old one is left
+// in place (and running again, if it was).
+func (r *DockerRunner) RecreateApp(ctx context.Context, spec AppSpec) error {
+	if spec.Volumes == nil {
+		volumes, err := r.AppVolumes(ctx, spec.Name)
+		if err != nil {
+			return err
+		}
+		spec.Volumes = volumes
+	}
+	if err := r.RemoveNext(ctx, spec.Name); err != nil {
+		return err
+	}
+	id, err := r.newContainer(ctx, spec, nextContainerName(spec.Name))
+	if err != nil {
+		r.RemoveNext(context.Background(), spec.Name)
+		return err
+	}
 
-	if _, err := r.Cli.ContainerStart(ctx, resp.ID, client.ContainerStartOptions{}); err != nil {
+	// Stop the old container first so the two never share volumes
+	containerName := fmt.Sprintf("poor-exe-%s", spec.Name)
+	wasRunning := r.IsRunning(ctx, spec.Name)
+	if wasRunning {
+		if _, err := r.Cli.ContainerStop(ctx, containerName, client.ContainerStopOptions{}); err != nil {
+			r.RemoveNext(context.Background(), spec.Name)
+			return err
+		}
+	}
+	if _, err := r.Cli.ContainerStart(ctx, id, client.ContainerStartOptions{}); err != nil {
+		r.RemoveNext(context.Background(), spec.Name)
+		if wasRunning {
+			r.Cli.ContainerStart(context.Background(), containerName, client.ContainerStartOptions{})
+		}
 		return err
 	}
+	return r.PromoteNext(context.Background(), spec.Name)
+}
 
+// AppVolumes lists the volumes mounted into an app's container, including
+// anonymous ones created for the image's VOLUME paths. A missing container
+// has none.
+func (r *DockerRunner) AppVolumes(ctx context.Context, appName string) ([]Volume, error) {
+	inspect, err := r.Cli.ContainerInspect(ctx, fmt.Sprintf("poor-exe-%s", appName), client.ContainerInspectOptions{})
+	if cerrdefs.IsNotFound(err) {
+		return []Volume{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	volumes := []Volume{}
+	for _, m := range inspect.Container.Mounts {
+		if m.Type == mount.TypeVolume && m.Name != "" {
+			volumes = append(volumes, Volume{Name: m.Name, Path: m.Destination})
+		}
+	}
+	return volumes, nil
+}
+
+// AppImageID returns the ID of the image an app's container runs, which
+// stays valid when its tag is later moved
+func (r *DockerRunner) AppImageID(ctx context.Context, appName string) (string, error) {
+	inspect, err := r.Cli.ContainerInspect(ctx, fmt.Sprintf("poor-exe-%s", appName), client.ContainerInspectOptions{})
+	if err != nil {
+		return "", err
+	}
+	return inspect.Container.Image, nil
+}
+
+// ImageExists reports whether an image is available locally
+func (r *DockerRunner) ImageExists(ctx context.Context, ref string) bool {
+	_, err := r.Cli.ImageInspect(ctx, ref)
+	return err == nil
+}
+
+// ImageApp returns the app a gateway-built image was built for, however ref
+// names it (tag, full or short ID). ok is false for any other image, or one
+// that doesn't exist locally.
+func (r *DockerRunner) ImageApp(ctx context.Context, ref string) (app string, ok bool) {
+	img, err := r.Cli.ImageInspect(ctx, ref)
+	if err != nil || img.Config == nil || img.Config.Labels["poor-exe"] != "true" {
+		return "", false
+	}
+	app, ok = img.Config.Labels["app_name"]
+	return app, ok
+}
+
+// RemoveAppImages removes every image built for an app, whatever it is
+// tagged as
+func (r *DockerRunner) RemoveAppImages(ctx context.Context, appName string) error {
+	result, err := r.Cli.ImageList(ctx, client.ImageListOptions{
+		All:     true,
+		Filters: make(client.Filters).Add("label", "poor-exe=true", "app_name="+appName),
+	})
+	if err != nil {
+		return err
+	}
+	for _, img := range result.Items {
+		_, err := r.Cli.ImageRemove(ctx, img.ID, client.ImageRemoveOptions{Force: true})
+		if err != nil && !cerrdefs.IsNotFound(err) {
+			return err
+		}
+	}
 	return nil
 }
 
-func (r *DockerRunner) Attach(ctx context.Context, appName string, stdin io.Reader, stdout, stderr io.Writer, sess ssh.Session) error {
+// Attach runs cmd inside an app container, wired to the given streams. An
+// empty cmd opens /bin/sh. A TTY is only allocated when the SSH client asked
+// for one; otherwise stdout and stderr are kept separate so the gateway can be
+// scripted. It returns the command's exit code.
+func (r *DockerRunner) Attach(ctx context.Context, appName string, cmd []string, stdin io.Reader, stdout, stderr io.Writer, sess ssh.Session) (int, error) {
 	containerName := fmt.Sprintf("poor-exe-%s", appName)
 
+	if len(cmd) == 0 {
+		cmd = []string{"/bin/sh"}
+	}
+	pty, windowChanges, isPty := sess.Pty()
+
 	execConfig := client.ExecCreateOptions{
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
-		TTY:          true,
-		Cmd:          []string{"/bin/sh"},
+		TTY:          isPty,
+		Cmd:          cmd,
+	}
+	if isPty {
+		execConfig.Env = []string{"TERM=" + pty.Term}
+		execConfig.ConsoleSize = client.ConsoleSize{Height: uint(pty.Window.Height), Width: uint(pty.Window.Width)}
 	}
 
 	execIDResp, err := r.Cli.ExecCreate(ctx, containerName, execConfig)
 	if err != nil {
-		return err
+		return -1, err
 	}
 
 	execStartConfig := client.ExecAttachOptions{
-		TTY: true,
+		TTY:         isPty,
+		ConsoleSize: execConfig.ConsoleSize,
 	}
 
 	resp, err := r.Cli.ExecAttach(ctx, execIDResp.ID, execStartConfig)
 	if err != nil {
-		return err
+		return -1, err
 	}
 	defer resp.Close()
 
 	// Handle window resize if it's a TTY
-	_, windowChanges, isPty := sess.Pty()
 	if isPty {
 		go func() {
 			for {
@@ -117,23 +402,147 @@ func (r *DockerRunner) Attach(ctx context.Context, appName string, stdin io.Read
 		}
 	}()
 
-	// Bridge data
-	errCh := make(chan error, 2)
+	// Bridge data. Stdin EOF only half-closes the exec so commands like
+	// `cat` see end of input; the session ends when the output does.
 	go func() {
-		io.Copy(resp.Conn, sess)
-		errCh <- nil
+		io.Copy(resp.Conn, stdin)
+		resp.CloseWrite()
 	}()
+	outCh := make(chan error, 1)
 	go func() {
-		io.Copy(sess, resp.Conn)
-		errCh <- nil
+		var err error
+		if isPty {
+			_, err = io.Copy(stdout, resp.Reader)
+		} else {
+			_, err = stdcopy.StdCopy(stdout, stderr, resp.Reader)
+		}
+		outCh <- err
 	}()
 
 	select {
-	case err := <-errCh:
-		return err
+	case err := <-outCh:
+		if err != nil {
+			return -1, err
+		}
 	case <-ctx.Done():
-		return ctx.Err()
+		return -1, ctx.Err()
+	}
+
+	inspect, err := r.Cli.ExecInspect(ctx, execIDResp.ID, client.ExecInspectOptions{})
+	if err != nil {
+		return -1, err
+	}
+	return inspect.ExitCode, nil
+}
+
+// StartApp starts a stopped app container
+func (r *DockerRunner) StartApp(ctx context.Context, appName string) error {
+	containerName := fmt.Sprintf("poor-exe-%s", appName)
+	_, err := r.Cli.ContainerStart(ctx, containerName, client.ContainerStartOptions{})
+	return err
+}
+
+// StopApp gracefully stops an app container, killing it after timeout seconds
+func (r *DockerRunner) StopApp(ctx context.Context, appName string, timeout int) error {
+	containerName := fmt.Sprintf("poor-exe-%s", appName)
+	_, err := r.Cli.ContainerStop(ctx, containerName, client.ContainerStopOptions{Timeout: &timeout})
+	return err
+}
+
+// RestartApp stops and starts an app container in place, keeping its filesystem
+func (r *DockerRunner) RestartApp(ctx context.Context, appName string, timeout int) error {
+	containerName := fmt.Sprintf("poor-exe-%s", appName)
+	_, err := r.Cli.ContainerRestart(ctx, containerName, client.ContainerRestartOptions{Timeout: &timeout})
+	return err
+}
+
+// LogOptions filters the output of Logs
+type LogOptions struct {
+	Follow     bool
+	Timestamps bool
+	Since      string // RFC3339 timestamp or relative duration like "10m"
+	Tail       string // number of lines from the end, or "all"
+}
+
+// Logs copies an app container's output to stdout and stderr. For non-TTY
+// containers the Docker stream is demultiplexed; TTY containers only have a
+// single stream, which goes to stdout. In follow mode it returns once ctx is
+// cancelled.
+func (r *DockerRunner) Logs(ctx context.Context, appName string, opts LogOptions, stdout, stderr io.Writer) error {
+	containerName := fmt.Sprintf("poor-exe-%s", appName)
+
+	inspect, err := r.Cli.ContainerInspect(ctx, containerName, client.ContainerInspectOptions{})
+	if err != nil {
+		return err
+	}
+	tty := inspect.Container.Config != nil && inspect.Container.Config.Tty
+
+	rc, err := r.Cli.ContainerLogs(ctx, containerName, client.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     opts.Follow,
+		Timestamps: opts.Timestamps,
+		Since:      opts.Since,
+		Tail:       opts.Tail,
+	})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if tty {
+		_, err = io.Copy(stdout, rc)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, rc)
+	}
+
+	// The session going away is the normal way to end a follow
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// AppContainer is a poor-exe managed container as seen by Docker
+type AppContainer struct {
+	AppName string
+	ID      string
+	Status  string // see AppStatus
+}
+
+// AppStatus maps a Docker container state onto the status the registry
+// records: running or stopped
+func AppStatus(state string) string {
+	switch state {
+	case "running", "restarting":
+		return "running"
+	}
+	return "stopped"
+}
+
+// ListApps returns every container carrying the poor-exe=true label, running or not
+func (r *DockerRunner) ListApps(ctx context.Context) ([]AppContainer, error) {
+	result, err := r.Cli.ContainerList(ctx, client.ContainerListOptions{
+		All:     true,
+		Filters: make(client.Filters).Add("label", "poor-exe=true"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var apps []AppContainer
+	for _, c := range result.Items {
+		// Skip the next container of a redeploy in progress
+		if !slices.Contains(c.Names, "/poor-exe-"+c.Labels["app_name"]) {
+			continue
+		}
+		apps = append(apps, AppContainer{
+			AppName: c.Labels["app_name"],
+			ID:      c.ID,
+			Status:  AppStatus(string(c.State)),
+		})
 	}
+	return apps, nil
 }
 
 func (r *DockerRunner) GetAppStatus(ctx context.Context, appName string) (string, error) {
@@ -143,5 +552,5 @@ func (r *DockerRunner) GetAppStatus(ctx context.Context, appName string) (string
 		// If container not found, return that
 		return "stopped", nil
 	}
-	return string(inspect.Container.State.Status), nil
+	return AppStatus(string(inspect.Container.State.Status)), nil
 }
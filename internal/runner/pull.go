@@ -0,0 +1,84 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/client"
+)
+
+var (
+	ErrImageNotFound     = errors.New("image not found")
+	ErrImageUnauthorized = errors.New("not authorized to pull image")
+)
+
+// PullEvent is a progress update from an image pull. Layer is empty for
+// messages about the image as a whole.
+type PullEvent struct {
+	Layer   string `json:"layer,omitempty"`
+	Status  string `json:"status"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+}
+
+// PullImage pulls image from its registry, calling progress (if set) with
+// each layer's status changes and, at most once a second per layer, its
+// byte counts. Cancelling ctx aborts the pull.
+func (r *DockerRunner) PullImage(ctx context.Context, image string, progress func(PullEvent)) error {
+	resp, err := r.Cli.ImagePull(ctx, image, client.ImagePullOptions{})
+	if err != nil {
+		return pullError(ctx, image, err)
+	}
+
+	lastStatus := map[string]string{}
+	lastSent := map[string]time.Time{}
+	for msg, err := range resp.JSONMessages(ctx) {
+		if err != nil {
+			return pullError(ctx, image, err)
+		}
+		if msg.Error != nil {
+			return pullError(ctx, image, msg.Error)
+		}
+		if progress == nil || msg.Status == "" {
+			continue
+		}
+
+		ev := PullEvent{Layer: msg.ID, Status: msg.Status}
+		if msg.Progress != nil {
+			ev.Current, ev.Total = msg.Progress.Current, msg.Progress.Total
+		}
+		if lastStatus[ev.Layer] == ev.Status && time.Since(lastSent[ev.Layer]) < time.Second {
+			continue
+		}
+		lastStatus[ev.Layer], lastSent[ev.Layer] = ev.Status, time.Now()
+		progress(ev)
+	}
+	if ctx.Err() != nil {
+		return pullError(ctx, image, ctx.Err())
+	}
+	return nil
+}
+
+// pullError turns a registry failure into an error that says what to fix,
+// instead of the "No such image" a later container create would report
+func pullError(ctx context.Context, image string, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("pull of %s cancelled", image)
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case cerrdefs.IsNotFound(err) || strings.Contains(msg, "not found") || strings.Contains(msg, "manifest unknown") ||
+		strings.Contains(msg, "does not exist"):
+		// Docker Hub answers "repository does not exist or may require
+		// 'docker login'" for both cases
+		return fmt.Errorf("%w: %s (check the name and tag; private images need a registry login on the server)", ErrImageNotFound, image)
+	case cerrdefs.IsUnauthorized(err) || cerrdefs.IsPermissionDenied(err) || strings.Contains(msg, "unauthorized") ||
+		strings.Contains(msg, "authentication required") || strings.Contains(msg, "denied"):
+		return fmt.Errorf("%w: %s (the registry requires a login on the server)", ErrImageUnauthorized, image)
+	}
+	return fmt.Errorf("pulling %s: %w", image, err)
+}
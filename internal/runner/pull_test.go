@@ -0,0 +1,30 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPullError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want error
+	}{
+		{"manifest for nginx:latst not found: manifest unknown", ErrImageNotFound},
+		{"pull access denied for nginz, repository does not exist or may require 'docker login'", ErrImageNotFound},
+		{"unauthorized: authentication required", ErrImageUnauthorized},
+		{"denied: requested access to the resource is denied", ErrImageUnauthorized},
+	}
+	for _, tt := range tests {
+		if err := pullError(context.Background(), "img", errors.New(tt.msg)); !errors.Is(err, tt.want) {
+			t.Errorf("pullError(%q) = %v, want %v", tt.msg, err, tt.want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pullError(ctx, "img", ctx.Err()); errors.Is(err, ErrImageNotFound) || errors.Is(err, ErrImageUnauthorized) {
+		t.Errorf("cancelled pull classified as registry error: %v", err)
+	}
+}
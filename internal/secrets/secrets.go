@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// ErrNoKey is returned when encryption is attempted without a configured key
+var ErrNoKey = errors.New("no secret key configured (set SECRET_KEY)")
+
+// Box encrypts small values at rest with AES-256-GCM
+type Box struct {
+	aead cipher.AEAD
+}
+
+// NewBox derives an AES-256 key from the configured secret. An empty secret
+// yields a Box that refuses to encrypt or decrypt.
+func NewBox(secret string) *Box {
+	if secret == "" {
+		return &Box{}
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, _ := aes.NewCipher(key[:]) // 32-byte key never errors
+	aead, _ := cipher.NewGCM(block)
+	return &Box{aead: aead}
+}
+
+// Encrypt returns base64(nonce || ciphertext)
+func (b *Box) Encrypt(plaintext string) (string, error) {
+	if b.aead == nil {
+		return "", ErrNoKey
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt
+func (b *Box) Decrypt(encoded string) (string, error) {
+	if b.aead == nil {
+		return "", ErrNoKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	n := b.aead.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := b.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,34 @@
+package secrets
+
+import "testing"
+
+func TestBoxRoundTrip(t *testing.T) {
+	box := NewBox("correct horse battery staple")
+
+	enc, err := box.Encrypt("postgres://user:pw@db/app")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if enc == "postgres://user:pw@db/app" {
+		t.Error("Ciphertext should not equal plaintext")
+	}
+
+	dec, err := box.Decrypt(enc)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if dec != "postgres://user:pw@db/app" {
+		t.Errorf("Expected round trip, got %q", dec)
+	}
+
+	if _, err := NewBox("wrong key").Decrypt(enc); err == nil {
+		t.Error("Decrypt with wrong key should fail")
+	}
+}
+
+func TestBoxWithoutKey(t *testing.T) {
+	box := NewBox("")
+	if _, err := box.Encrypt("x"); err != ErrNoKey {
+		t.Errorf("Expected ErrNoKey, got %v", err)
+	}
+}
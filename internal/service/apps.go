@@ -0,0 +1,331 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/repos"
+	"github.com/rnzor/poor_man_exe/internal/runner"
+)
+
+// AppSummary is one row of an app listing
+type AppSummary struct {
+	Name    string        `json:"vm_name"`
+	Image   string        `json:"image"`
+	Status  string        `json:"status"`
+	Limits  runner.Limits `json:"limits"`
+	Created string        `json:"created_at"`
+}
+
+// AppDetail is everything describe shows about an app
+type AppDetail struct {
+	Name        string        `json:"vm_name"`
+	Image       string        `json:"image"`
+	Status      string        `json:"status"`
+	HTTPPort    int           `json:"http_port"`
+	IsPublic    bool          `json:"is_public"`
+	HealthCheck string        `json:"health_check,omitempty"`
+	Limits      runner.Limits `json:"limits"`
+	Org         string        `json:"org"`
+	Endpoint    string        `json:"endpoint"`
+	Created     string        `json:"created_at,omitempty"`
+}
+
+// NewApp is a request to create an app. Zero limits fall back to the server
+// defaults.
+type NewApp struct {
+	Name   string        `json:"name"`
+	Image  string        `json:"image"`
+	Org    string        `json:"org"`
+	Limits runner.Limits `json:"limits"`
+	// Pull, if set, receives progress while the image is pulled
+	Pull func(runner.PullEvent) `json:"-"`
+}
+
+// ListApps returns the subject's apps and those of its orgs, with the status
+// reported by Docker where available
+func (s *Service) ListApps(ctx context.Context, sub policy.Subject) ([]AppSummary, error) {
+	rows, err := s.DB.Conn.Query(`SELECT name, image, status, memory_mb, cpus, pids_limit, created_at FROM apps
+		WHERE user_id = ? OR org_id IN (SELECT org_id FROM org_members WHERE user_id = ?)`, sub.UserID, sub.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apps []AppSummary
+	for rows.Next() {
+		var app AppSummary
+		rows.Scan(&app.Name, &app.Image, &app.Status, &app.Limits.MemoryMB, &app.Limits.CPUs, &app.Limits.Pids, &app.Created)
+
+		// Sync with Docker, falling back to the registry
+		if status, err := s.Runner.GetAppStatus(ctx, app.Name); err == nil {
+			app.Status = status
+		}
+		apps = append(apps, app)
+	}
+	return apps, rows.Err()
+}
+
+func (s *Service) DescribeApp(ctx context.Context, sub policy.Subject, name string) (*AppDetail, error) {
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppRead, name)
+	if err != nil {
+		return nil, err
+	}
+
+	app := &AppDetail{Name: name, Endpoint: s.endpoint(name)}
+	err = s.DB.Conn.QueryRow(`SELECT a.image, a.status, a.http_port, a.is_public, a.health_check, a.memory_mb, a.cpus, a.pids_limit, a.created_at, COALESCE(o.name, '')
+		FROM apps a LEFT JOIN orgs o ON o.id = a.org_id WHERE a.id = ?`, appID).
+		Scan(&app.Image, &app.Status, &app.HTTPPort, &app.IsPublic, &app.HealthCheck, &app.Limits.MemoryMB, &app.Limits.CPUs, &app.Limits.Pids, &app.Created, &app.Org)
+	if err != nil {
+		return nil, err
+	}
+	if app.HealthCheck == "" {
+		app.HealthCheck = s.Cfg.HealthCheck
+	}
+	if status, err := s.Runner.GetAppStatus(ctx, name); err == nil {
+		app.Status = status
+	}
+	return app, nil
+}
+
+// CreateApp starts a container for the app and registers it. Failing to
+// route it through Caddy doesn't undo the app and is returned as a warning.
+func (s *Service) CreateApp(ctx context.Context, sub policy.Subject, req NewApp) (*AppDetail, []string, error) {
+	if req.Name == "" {
+		return nil, nil, errors.New("app name is required")
+	}
+	if req.Image == "" {
+		req.Image = "alpine:latest"
+	}
+
+	// Apps created in an org are shared with its members
+	var orgID interface{}
+	var err error
+	if req.Org != "" {
+		orgID, err = s.Policy.AuthorizeOrg(sub, policy.AppCreate, req.Org)
+	} else {
+		err = s.Policy.Authorize(sub, policy.AppCreate)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	limits, err := s.resolveLimits(req.Limits)
+	if err == nil {
+		err = s.checkQuota(sub.UserID, limits)
+	}
+	if err == nil {
+		err = s.authorizeImage(ctx, sub, req.Image)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.Runner.CreateApp(ctx, runner.AppSpec{Name: req.Name, Image: req.Image, UserID: sub.UserID, Limits: limits, Pull: req.Pull})
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating app: %w", err)
+	}
+
+	res, err := s.DB.Conn.Exec("INSERT INTO apps (name, image, user_id, org_id, status, memory_mb, cpus, pids_limit) VALUES (?, ?, ?, ?, 'running', ?, ?, ?)",
+		req.Name, req.Image, sub.UserID, orgID, limits.MemoryMB, limits.CPUs, limits.Pids)
+	if err != nil {
+		// Don't leave a container behind that the registry doesn't know about
+		s.Runner.RemoveApp(context.Background(), req.Name)
+		return nil, nil, fmt.Errorf("failed to register app, container removed: %w", err)
+	}
+
+	var warnings []string
+	appID, _ := res.LastInsertId()
+	if _, err := s.recordRelease(ctx, int(appID), req.Name, sub.UserID, "create"); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to record release: %v", err))
+	}
+	if err := s.SyncRoute(ctx, req.Name); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to configure HTTP proxy: %v", err))
+	}
+
+	details := "image=" + req.Image
+	if orgID != nil {
+		details += " org=" + req.Org
+	}
+	s.DB.LogAudit("app_create", sub.UserID, req.Name, sub.RemoteIP, details)
+
+	return &AppDetail{
+		Name:     req.Name,
+		Image:    req.Image,
+		Status:   "running",
+		HTTPPort: 80,
+		Limits:   limits,
+		Org:      req.Org,
+		Endpoint: s.endpoint(req.Name),
+	}, warnings, nil
+}
+
+// authorizeImage keeps apps from running another app's built image, which
+// holds its code. Those only exist locally, so besides their poor-exe/<app>
+// tags they can be named by any ID Docker resolves; the label the build put
+// on the image says which app it belongs to.
+func (s *Service) authorizeImage(ctx context.Context, sub policy.Subject, image string) error {
+	appName, built := s.Runner.ImageApp(ctx, image)
+	if name, ok := strings.CutPrefix(image, runner.LocalImagePrefix); ok && !built {
+		appName, _, _ = strings.Cut(name, ":")
+		built = true
+	}
+	if !built {
+		if strings.HasPrefix(image, "sha256:") {
+			return fmt.Errorf("image %s was not built by a deploy", image)
+		}
+		return nil
+	}
+	if _, err := s.Policy.AuthorizeApp(sub, policy.AppExec, appName); err != nil {
+		return fmt.Errorf("image %s belongs to app '%s': %w", image, appName, err)
+	}
+	return nil
+}
+
+// DeleteApp removes the app's container, built images, route, git repository
+// and registry entry
+func (s *Service) DeleteApp(ctx context.Context, sub policy.Subject, name string) ([]string, error) {
+	if _, err := s.Policy.AuthorizeApp(sub, policy.AppDelete, name); err != nil {
+		return nil, err
+	}
+
+	// Keep the registry entry if this fails so the app isn't orphaned; the
+	// user can retry
+	if err := s.Runner.RemoveApp(context.Background(), name); err != nil {
+		return nil, fmt.Errorf("failed to remove container: %w", err)
+	}
+
+	var warnings []string
+	if err := s.Runner.RemoveAppImages(context.Background(), name); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to remove built images: %v", err))
+	}
+	if err := s.Caddy.DeleteRoute(name); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to remove HTTP proxy: %v", err))
+	}
+	if s.Cfg.GitRepoDir != "" {
+		if err := repos.New(s.Cfg.GitRepoDir, s.Cfg.GitDeployBranch).Remove(name); err != nil {
+			warnings = append(warnings, fmt.Sprintf("failed to remove git repository: %v", err))
+		}
+	}
+
+	s.DB.Conn.Exec("DELETE FROM app_images WHERE app_id = (SELECT id FROM apps WHERE name = ?)", name)
+	s.DB.Conn.Exec("DELETE FROM releases WHERE app_id = (SELECT id FROM apps WHERE name = ?)", name)
+	if _, err := s.DB.Conn.Exec("DELETE FROM apps WHERE name = ?", name); err != nil {
+		return warnings, fmt.Errorf("removing app from registry: %w", err)
+	}
+
+	s.DB.LogAudit("app_delete", sub.UserID, name, sub.RemoteIP, "")
+	return warnings, nil
+}
+
+// Lifecycle starts, stops or restarts an app's container without recreating
+// it, so the container filesystem survives the bounce. It returns the app's
+// new status.
+func (s *Service) Lifecycle(ctx context.Context, sub policy.Subject, op, name string) (string, []string, error) {
+	var status string
+	switch op {
+	case "start", "restart":
+		status = "running"
+	case "stop":
+		status = "stopped"
+	default:
+		return "", nil, fmt.Errorf("unknown lifecycle operation: %s", op)
+	}
+
+	if _, err := s.Policy.AuthorizeApp(sub, policy.AppLifecycle, name); err != nil {
+		return "", nil, err
+	}
+
+	var err error
+	switch op {
+	case "start":
+		err = s.Runner.StartApp(ctx, name)
+	case "stop":
+		err = s.Runner.StopApp(ctx, name, 10)
+	case "restart":
+		err = s.Runner.RestartApp(ctx, name, 10)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to %s app '%s': %w", op, name, err)
+	}
+
+	var warnings []string
+	if _, err := s.DB.Conn.Exec("UPDATE apps SET status = ? WHERE name = ?", status, name); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to update registry: %v", err))
+	}
+	// A started container may come back with a new IP
+	if op != "stop" {
+		if err := s.SyncRoute(ctx, name); err != nil {
+			warnings = append(warnings, fmt.Sprintf("failed to update HTTP proxy: %v", err))
+		}
+	}
+
+	s.DB.LogAudit("app_"+op, sub.UserID, name, sub.RemoteIP, "")
+	return status, warnings, nil
+}
+
+// Logs copies the app's container output to stdout and stderr
+func (s *Service) Logs(ctx context.Context, sub policy.Subject, name string, opts runner.LogOptions, stdout, stderr io.Writer) error {
+	if _, err := s.Policy.AuthorizeApp(sub, policy.AppRead, name); err != nil {
+		return err
+	}
+	return s.Runner.Logs(ctx, name, opts, stdout, stderr)
+}
+
+func (s *Service) endpoint(name string) string {
+	return fmt.Sprintf("https://%s.%s", name, s.Cfg.Domain)
+}
+
+// resolveLimits fills unset limits with the server defaults and rejects
+// anything above the configured maximums
+func (s *Service) resolveLimits(limits runner.Limits) (runner.Limits, error) {
+	cfg := s.Cfg
+	if limits.MemoryMB == 0 {
+		limits.MemoryMB = int64(cfg.DefaultMemoryMB)
+	}
+	if limits.CPUs == 0 {
+		limits.CPUs = cfg.DefaultCPUs
+	}
+	if limits.Pids == 0 {
+		limits.Pids = int64(cfg.DefaultPids)
+	}
+
+	if limits.MemoryMB < 0 || limits.CPUs < 0 || limits.Pids < 0 {
+		return limits, errors.New("limits must be positive")
+	}
+	if cfg.MaxMemoryMB > 0 && limits.MemoryMB > int64(cfg.MaxMemoryMB) {
+		return limits, fmt.Errorf("memory %dMB exceeds server maximum of %dMB", limits.MemoryMB, cfg.MaxMemoryMB)
+	}
+	if cfg.MaxCPUs > 0 && limits.CPUs > cfg.MaxCPUs {
+		return limits, fmt.Errorf("cpus %g exceeds server maximum of %g", limits.CPUs, cfg.MaxCPUs)
+	}
+	if cfg.MaxPids > 0 && limits.Pids > int64(cfg.MaxPids) {
+		return limits, fmt.Errorf("pids %d exceeds server maximum of %d", limits.Pids, cfg.MaxPids)
+	}
+	return limits, nil
+}
+
+// checkQuota enforces the per-user app count and total memory quotas for a
+// new app with the given limits. Admins aren't held to them.
+func (s *Service) checkQuota(userID int, limits runner.Limits) error {
+	if s.Policy.IsAdmin(userID) {
+		return nil
+	}
+	var count int
+	var memoryMB int64
+	err := s.DB.Conn.QueryRow("SELECT COUNT(*), COALESCE(SUM(memory_mb), 0) FROM apps WHERE user_id = ?", userID).Scan(&count, &memoryMB)
+	if err != nil {
+		return err
+	}
+	if s.Cfg.QuotaMaxApps > 0 && count >= s.Cfg.QuotaMaxApps {
+		return fmt.Errorf("quota exceeded: you already have %d of %d apps", count, s.Cfg.QuotaMaxApps)
+	}
+	if s.Cfg.QuotaMemoryMB > 0 && memoryMB+limits.MemoryMB > int64(s.Cfg.QuotaMemoryMB) {
+		return fmt.Errorf("quota exceeded: %dMB requested with %dMB of %dMB in use", limits.MemoryMB, memoryMB, s.Cfg.QuotaMemoryMB)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/caddy"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/runner"
+)
+
+func TestCreateAppQuota(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email, is_admin) VALUES (1, 'alice@example.com', FALSE), (2, 'root@example.com', TRUE)")
+	d.Conn.Exec("INSERT INTO apps (name, user_id, memory_mb) VALUES ('existing', 1, 512)")
+
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer admin.Close()
+
+	fake := &fakeRunner{}
+	svc := New(d, fake, caddy.NewClient(admin.URL, "gateway:8080"), &config.Config{
+		Domain:          "example.com",
+		DefaultMemoryMB: 256,
+		MaxMemoryMB:     1024,
+		QuotaMaxApps:    3,
+		QuotaMemoryMB:   1024,
+	})
+	alice := policy.Subject{UserID: 1}
+	root := policy.Subject{UserID: 2}
+
+	tests := []struct {
+		name     string
+		sub      policy.Subject
+		memoryMB int64
+		err      string
+	}{
+		// 512MB already in use leaves exactly 512MB of alice's quota
+		{"exact", alice, 512, ""},
+		{"over", alice, 1, "quota exceeded"},
+		// Admins aren't held to the quota, only to the server maximums
+		{"admin-1", root, 1024, ""},
+		{"admin-2", root, 1024, ""},
+		{"admin-max", root, 1025, "server maximum"},
+	}
+	for _, tt := range tests {
+		fake.calls = nil
+		_, _, err := svc.CreateApp(context.Background(), tt.sub, NewApp{Name: tt.name, Limits: runner.Limits{MemoryMB: tt.memoryMB}})
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: CreateApp failed: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected an error mentioning %q, got %v", tt.name, tt.err, err)
+		}
+		if len(fake.calls) != 0 {
+			t.Errorf("%s: expected no container to be created, got %v", tt.name, fake.calls)
+		}
+	}
+
+	// With memory unlimited the app count still applies; alice has
+	// existing and exact, and an app in the making
+	svc.Cfg.QuotaMemoryMB = 0
+	svc.Cfg.QuotaMaxApps = 2
+	if _, _, err := svc.CreateApp(context.Background(), alice, NewApp{Name: "third"}); err == nil || !strings.Contains(err.Error(), "2 of 2 apps") {
+		t.Errorf("Expected the app count quota to be enforced, got %v", err)
+	}
+	if _, _, err := svc.CreateApp(context.Background(), root, NewApp{Name: "third"}); err != nil {
+		t.Errorf("Expected admins to be exempt from the app count quota, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/auth"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Cert is a certificate issued by the gateway's CA
+type Cert struct {
+	Serial      uint64   `json:"serial"`
+	Fingerprint string   `json:"fingerprint"`
+	KeyID       string   `json:"key_id"`
+	Apps        []string `json:"apps,omitempty"`
+	Options     string   `json:"options,omitempty"`
+	Expires     string   `json:"expires_at"`
+	Revoked     string   `json:"revoked_at,omitempty"`
+	Created     string   `json:"created_at"`
+
+	// Certificate is the signed cert in authorized_keys format, only set
+	// when it is issued
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// SignKey issues a certificate for a public key (authorized_keys format)
+// that expires after ttl and, with apps, only opens shells in those apps.
+// The key must not be registered: a registered key logs in on its own, which
+// would make the certificate's limits meaningless. The certificate inherits
+// the restrictions of the credential the subject logged in with: it expires
+// no later and carries the same options.
+func (s *Service) SignKey(sub policy.Subject, keyLine string, apps []string, ttl time.Duration, inherit auth.Restrictions) (*Cert, error) {
+	if ttl <= 0 {
+		return nil, errors.New("certificate lifetime must be positive")
+	}
+	if max := time.Duration(s.Cfg.CertMaxTTL) * time.Second; ttl > max {
+		return nil, fmt.Errorf("certificate lifetime may be at most %s", max)
+	}
+	if !inherit.NotAfter.IsZero() {
+		if remaining := time.Until(inherit.NotAfter); remaining < ttl {
+			ttl = remaining
+		}
+		if ttl <= 0 {
+			return nil, errors.New("the key you logged in with has expired")
+		}
+	}
+
+	key, _, _, _, err := gossh.ParseAuthorizedKey(bytes.TrimSpace([]byte(keyLine)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if _, isCert := key.(*gossh.Certificate); isCert {
+		return nil, errors.New("pass the plain public key, not a certificate")
+	}
+	fingerprint := gossh.FingerprintSHA256(key)
+	var registered bool
+	s.DB.Conn.QueryRow("SELECT EXISTS(SELECT 1 FROM public_keys WHERE fingerprint = ?)", fingerprint).Scan(&registered)
+	if registered {
+		return nil, fmt.Errorf("key %s is registered and logs in without a certificate; sign a separate key", fingerprint)
+	}
+
+	// Only apps the user could open themselves can be delegated
+	var allowed []string
+	for _, app := range apps {
+		if app = strings.TrimSpace(app); app == "" {
+			continue
+		}
+		if _, err := s.Policy.AuthorizeApp(sub, policy.AppExec, app); err != nil {
+			return nil, err
+		}
+		allowed = append(allowed, app)
+	}
+
+	ca, err := auth.LoadCA(s.Cfg.CAKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("gateway CA unavailable: %v", err)
+	}
+	keyID := fingerprint
+	var email string
+	if s.DB.Conn.QueryRow("SELECT email FROM users WHERE id = ?", sub.UserID).Scan(&email) == nil {
+		keyID = email + " " + fingerprint
+	}
+	cert, err := auth.IssueCert(ca, key, sub.UserID, keyID, allowed, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	issued := &Cert{
+		Serial:      cert.Serial,
+		Fingerprint: fingerprint,
+		KeyID:       keyID,
+		Apps:        allowed,
+		Options:     inherit.Options,
+		Expires:     time.Unix(int64(cert.ValidBefore), 0).UTC().Format("2006-01-02 15:04:05"),
+		Created:     time.Now().UTC().Format("2006-01-02 15:04:05"),
+		Certificate: strings.TrimSpace(string(gossh.MarshalAuthorizedKey(cert))),
+	}
+	_, err = s.DB.Conn.Exec(`INSERT INTO certificates (serial, user_id, fingerprint, key_id, apps, options, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, strconv.FormatUint(cert.Serial, 10), sub.UserID, fingerprint, keyID,
+		strings.Join(allowed, ","), inherit.Options, issued.Expires, issued.Created)
+	if err != nil {
+		return nil, fmt.Errorf("recording certificate: %w", err)
+	}
+
+	s.DB.LogAudit("cert_issued", sub.UserID, "", sub.RemoteIP,
+		fmt.Sprintf("serial=%d key_id=%q ttl=%s apps=%s", cert.Serial, keyID, ttl, strings.Join(allowed, ",")))
+	return issued, nil
+}
+
+// ListCerts returns the certificates issued to the subject that haven't
+// expired yet, newest first
+func (s *Service) ListCerts(sub policy.Subject) ([]Cert, error) {
+	rows, err := s.DB.Conn.Query(`SELECT serial, fingerprint, key_id, apps, options, expires_at, COALESCE(revoked_at, ''), created_at
+		FROM certificates WHERE user_id = ? AND expires_at > datetime('now') ORDER BY created_at DESC`, sub.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var certs []Cert
+	for rows.Next() {
+		var c Cert
+		var serial, apps string
+		if err := rows.Scan(&serial, &c.Fingerprint, &c.KeyID, &apps, &c.Options, &c.Expires, &c.Revoked, &c.Created); err != nil {
+			return nil, err
+		}
+		c.Serial, _ = strconv.ParseUint(serial, 10, 64)
+		if apps != "" {
+			c.Apps = strings.Split(apps, ",")
+		}
+		certs = append(certs, c)
+	}
+	return certs, rows.Err()
+}
+
+// RevokeCert stops one of the subject's certificates from logging in
+func (s *Service) RevokeCert(sub policy.Subject, serial string) error {
+	if _, err := strconv.ParseUint(serial, 10, 64); err != nil {
+		return fmt.Errorf("invalid serial '%s'", serial)
+	}
+	var revoked sql.NullString
+	err := s.DB.Conn.QueryRow("SELECT revoked_at FROM certificates WHERE serial = ? AND user_id = ?", serial, sub.UserID).Scan(&revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("certificate not found")
+	} else if err != nil {
+		return err
+	}
+	if revoked.Valid {
+		return errors.New("certificate is already revoked")
+	}
+	if _, err := s.DB.Conn.Exec("UPDATE certificates SET revoked_at = CURRENT_TIMESTAMP WHERE serial = ?", serial); err != nil {
+		return err
+	}
+	s.DB.LogAudit("cert_revoked", sub.UserID, "", sub.RemoteIP, "serial="+serial)
+	return nil
+}
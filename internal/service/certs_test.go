@@ -0,0 +1,63 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/auth"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+)
+
+func TestSignKey(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com')")
+
+	caPath := filepath.Join(t.TempDir(), "ca_key")
+	if _, err := auth.LoadOrCreateCA(caPath); err != nil {
+		t.Fatalf("LoadOrCreateCA failed: %v", err)
+	}
+	svc := New(d, nil, nil, &config.Config{CAKeyPath: caPath, CertMaxTTL: 7 * 24 * 3600})
+	sub := policy.Subject{UserID: 1}
+
+	registered := newAuthorizedKey(t, "laptop")
+	if _, err := importKeys(d, 1, []byte(registered), keyRow{}); err != nil {
+		t.Fatalf("importKeys failed: %v", err)
+	}
+	if _, err := svc.SignKey(sub, registered, nil, time.Hour, auth.Restrictions{}); err == nil {
+		t.Error("Expected a registered key to be refused")
+	}
+
+	// A key that expires in an hour and only works from one network can't
+	// sign its way out of either
+	limits := auth.Restrictions{Options: `from="10.0.0.0/8"`, NotAfter: time.Now().Add(time.Hour)}
+	contractor := newAuthorizedKey(t, "contractor")
+	cert, err := svc.SignKey(sub, contractor, nil, 8*time.Hour, limits)
+	if err != nil {
+		t.Fatalf("SignKey failed: %v", err)
+	}
+	expires, _ := time.Parse("2006-01-02 15:04:05", cert.Expires)
+	if expires.After(limits.NotAfter) {
+		t.Errorf("Expected expiry capped at %s, got %s", limits.NotAfter, expires)
+	}
+
+	certs, err := svc.ListCerts(sub)
+	if err != nil || len(certs) != 1 || certs[0].Options != limits.Options {
+		t.Fatalf("Expected one cert with inherited options, got %+v %v", certs, err)
+	}
+
+	// Nor can the signed key be registered to escape the certificate
+	results, _ := importKeys(d, 1, []byte(contractor), keyRow{})
+	if len(results) != 1 || results[0].Status != "in_use" {
+		t.Errorf("Expected signed key to be refused, got %+v", results)
+	}
+}
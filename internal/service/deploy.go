@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/runner"
+)
+
+// AppImage is one version of an app built and deployed by Deploy
+type AppImage struct {
+	Version int    `json:"version"`
+	Image   string `json:"image"`
+	Source  string `json:"source"`
+	By      string `json:"deployed_by"`
+	Created string `json:"created_at"`
+}
+
+// Deploy builds the Dockerfile in a tar build context (optionally gzipped),
+// tags the image poor-exe/<app>:<n> with the app's next version number and
+// recreates the app's container from it. Source records where the context
+// came from, e.g. a git commit. Build output goes to out. If the build or
+// the new container fails, the previous version keeps running.
+func (s *Service) Deploy(ctx context.Context, sub policy.Subject, appName string, buildContext io.Reader, source string, out io.Writer) (*AppImage, []string, error) {
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppDeploy, appName)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock, err := lockApp(appName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	spec, err := s.loadAppSpec(appID)
+	if err == nil {
+		spec.Volumes, err = s.Runner.AppVolumes(ctx, appName)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var version int
+	if err := s.DB.Conn.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM app_images WHERE app_id = ?", appID).Scan(&version); err != nil {
+		return nil, nil, err
+	}
+
+	image := fmt.Sprintf("%s%s:%d", runner.LocalImagePrefix, appName, version)
+	labels := map[string]string{"poor-exe": "true", "app_name": appName}
+	if err := s.Runner.BuildImage(ctx, buildContext, image, labels, out); err != nil {
+		return nil, nil, fmt.Errorf("build failed: %w", err)
+	}
+
+	spec.Image = image
+	warnings, err := s.rollout(ctx, spec, 0, out)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	built := &AppImage{Version: version, Image: image, Source: source, Created: time.Now().UTC().Format("2006-01-02 15:04:05")}
+	s.DB.Conn.QueryRow("SELECT email FROM users WHERE id = ?", sub.UserID).Scan(&built.By)
+	_, err = s.DB.Conn.Exec("INSERT INTO app_images (app_id, version, image, source, user_id, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		appID, version, image, source, sub.UserID, built.Created)
+	if err == nil {
+		_, err = s.DB.Conn.Exec("UPDATE apps SET image = ? WHERE id = ?", image, appID)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("recording deployed image: %w", err)
+	}
+	s.DB.LogAudit("app_deploy", sub.UserID, appName, sub.RemoteIP, fmt.Sprintf("image=%s source=%s", image, source))
+
+	if _, err := s.recordRelease(ctx, appID, appName, sub.UserID, "deploy "+image); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to record release: %v", err))
+	}
+	if err := s.SyncRoute(ctx, appName); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to update HTTP proxy: %v", err))
+	}
+	return built, warnings, nil
+}
+
+// ListImages returns the versions deployed to an app, newest first
+func (s *Service) ListImages(sub policy.Subject, appName string) ([]AppImage, error) {
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppRead, appName)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.Conn.Query(`SELECT i.version, i.image, i.source, COALESCE(u.email, ''), i.created_at
+		FROM app_images i LEFT JOIN users u ON u.id = i.user_id WHERE i.app_id = ? ORDER BY i.version DESC`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []AppImage
+	for rows.Next() {
+		var img AppImage
+		if err := rows.Scan(&img.Version, &img.Image, &img.Source, &img.By, &img.Created); err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+// DeployConfig holds the per-app settings that govern redeploys
+type DeployConfig struct {
+	HealthCheck string `json:"health_check"`
+	// Default is set when the app uses the server's HEALTH_CHECK
+	Default bool `json:"default"`
+}
+
+// GetDeployConfig returns the app's redeploy settings, with defaults filled in
+func (s *Service) GetDeployConfig(sub policy.Subject, appName string) (*DeployConfig, error) {
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppRead, appName)
+	if err != nil {
+		return nil, err
+	}
+	var conf DeployConfig
+	if err := s.DB.Conn.QueryRow("SELECT health_check FROM apps WHERE id = ?", appID).Scan(&conf.HealthCheck); err != nil {
+		return nil, err
+	}
+	if conf.HealthCheck == "" {
+		conf.HealthCheck, conf.Default = s.Cfg.HealthCheck, true
+	}
+	return &conf, nil
+}
+
+// SetDeployConfig changes the app's redeploy settings, given as name=value.
+// "health" is the check a blue/green redeploy waits for before switching
+// traffic; "default" goes back to the server's HEALTH_CHECK.
+func (s *Service) SetDeployConfig(sub policy.Subject, appName string, settings map[string]string) error {
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppDeploy, appName)
+	if err != nil {
+		return err
+	}
+	if len(settings) == 0 {
+		return fmt.Errorf("usage: deploy-config <app> health=<tcp|http:/path|none|default>")
+	}
+
+	for name := range settings {
+		if name != "health" {
+			return fmt.Errorf("unknown deploy setting: %s", name)
+		}
+	}
+
+	check := settings["health"]
+	if check == "" {
+		return errors.New("health needs a value")
+	}
+	stored := check
+	if check == "default" {
+		stored = ""
+	} else if _, err := runner.ParseHealthCheck(check); err != nil {
+		return err
+	}
+	if _, err := s.DB.Conn.Exec("UPDATE apps SET health_check = ? WHERE id = ?", stored, appID); err != nil {
+		return err
+	}
+	s.DB.LogAudit("deploy_config", sub.UserID, appName, sub.RemoteIP, "health="+check)
+	return nil
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+)
+
+func TestImageHistory(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com'), (2, 'bob@example.com')")
+	d.Conn.Exec("INSERT INTO apps (id, name, user_id) VALUES (1, 'bloggy', 1)")
+	d.Conn.Exec(`INSERT INTO app_images (app_id, version, image, source, user_id) VALUES
+		(1, 1, 'poor-exe/bloggy:1', 'upload', 1), (1, 2, 'poor-exe/bloggy:2', 'git 0123456789ab', 1)`)
+
+	svc := New(d, nil, nil, &config.Config{})
+	images, err := svc.ListImages(policy.Subject{UserID: 1}, "bloggy")
+	if err != nil {
+		t.Fatalf("ListImages failed: %v", err)
+	}
+	if len(images) != 2 || images[0].Version != 2 || images[0].By != "alice@example.com" {
+		t.Errorf("Expected newest version first, got %+v", images)
+	}
+
+	// Other users can neither read the history nor deploy; the build is never started
+	var denied *policy.DeniedError
+	if _, err := svc.ListImages(policy.Subject{UserID: 2}, "bloggy"); !errors.As(err, &denied) {
+		t.Errorf("Expected ListImages to be denied, got %v", err)
+	}
+	if _, _, err := svc.Deploy(context.Background(), policy.Subject{UserID: 2}, "bloggy", strings.NewReader(""), "upload", io.Discard); !errors.As(err, &denied) {
+		t.Errorf("Expected Deploy to be denied, got %v", err)
+	}
+
+	// A deploy already running for the app is refused
+	deploying.Store("bloggy", true)
+	defer deploying.Delete("bloggy")
+	if _, _, err := svc.Deploy(context.Background(), policy.Subject{UserID: 1}, "bloggy", strings.NewReader(""), "upload", io.Discard); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("Expected concurrent deploy to be refused, got %v", err)
+	}
+}
+
+func TestDeployConfig(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com'), (2, 'bob@example.com'), (3, 'carol@example.com')")
+	d.Conn.Exec("INSERT INTO orgs (id, name) VALUES (1, 'acme')")
+	d.Conn.Exec("INSERT INTO org_members (org_id, user_id, role) VALUES (1, 1, 'owner'), (1, 2, 'developer'), (1, 3, 'viewer')")
+	d.Conn.Exec("INSERT INTO apps (id, name, user_id, org_id) VALUES (1, 'bloggy', 1, 1)")
+
+	svc := New(d, nil, nil, &config.Config{HealthCheck: "tcp"})
+	conf, err := svc.GetDeployConfig(policy.Subject{UserID: 3}, "bloggy")
+	if err != nil || conf.HealthCheck != "tcp" || !conf.Default {
+		t.Fatalf("Expected the server default, got %+v %v", conf, err)
+	}
+
+	// Developers set it like they deploy; viewers can only read it
+	if err := svc.SetDeployConfig(policy.Subject{UserID: 2}, "bloggy", map[string]string{"health": "http:/healthz"}); err != nil {
+		t.Fatalf("SetDeployConfig failed: %v", err)
+	}
+	if conf, _ := svc.GetDeployConfig(policy.Subject{UserID: 1}, "bloggy"); conf.HealthCheck != "http:/healthz" || conf.Default {
+		t.Errorf("Expected the app's own check, got %+v", conf)
+	}
+	var denied *policy.DeniedError
+	if err := svc.SetDeployConfig(policy.Subject{UserID: 3}, "bloggy", map[string]string{"health": "none"}); !errors.As(err, &denied) {
+		t.Errorf("Expected a viewer to be denied, got %v", err)
+	}
+
+	for _, bad := range []map[string]string{{"health": "udp"}, {"health": ""}, {"strategy": "recreate"}, {}} {
+		if err := svc.SetDeployConfig(policy.Subject{UserID: 1}, "bloggy", bad); err == nil {
+			t.Errorf("Expected %v to be refused", bad)
+		}
+	}
+
+	if err := svc.SetDeployConfig(policy.Subject{UserID: 1}, "bloggy", map[string]string{"health": "default"}); err != nil {
+		t.Fatalf("SetDeployConfig failed: %v", err)
+	}
+	if conf, _ := svc.GetDeployConfig(policy.Subject{UserID: 1}, "bloggy"); !conf.Default {
+		t.Errorf("Expected the server default again, got %+v", conf)
+	}
+}
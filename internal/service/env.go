@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/secrets"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EnvVar is one environment variable of an app
+type EnvVar struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Secret  bool   `json:"secret"`
+	Updated string `json:"updated_at"`
+}
+
+// ListEnv returns the app's environment with values masked unless show is set
+func (s *Service) ListEnv(sub policy.Subject, appName string, show bool) ([]EnvVar, error) {
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppEnv, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.Conn.Query("SELECT key, value, is_secret, updated_at FROM app_env WHERE app_id = ? ORDER BY key", appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	box := secrets.NewBox(s.Cfg.SecretKey)
+	var vars []EnvVar
+	for rows.Next() {
+		var v EnvVar
+		rows.Scan(&v.Key, &v.Value, &v.Secret, &v.Updated)
+		switch {
+		case !show:
+			v.Value = "********"
+		case v.Secret:
+			if v.Value, err = box.Decrypt(v.Value); err != nil {
+				v.Value = "<undecryptable>"
+			}
+		}
+		vars = append(vars, v)
+	}
+	return vars, rows.Err()
+}
+
+// SetEnv stores KEY=VALUE pairs, encrypted when secret is set, and returns
+// the keys it set. The change takes effect when the container is recreated.
+func (s *Service) SetEnv(sub policy.Subject, appName string, pairs []string, secret bool) ([]string, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("usage: env set <app> KEY=VAL... [--secret] [--recreate]")
+	}
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppEnv, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	box := secrets.NewBox(s.Cfg.SecretKey)
+	var keys []string
+	for _, kv := range pairs {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || !envKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid assignment %q, expected KEY=VALUE", kv)
+		}
+		if secret {
+			enc, err := box.Encrypt(value)
+			if err != nil {
+				return nil, err
+			}
+			value = enc
+		}
+		_, err := s.DB.Conn.Exec(`INSERT INTO app_env (app_id, key, value, is_secret) VALUES (?, ?, ?, ?)
+			ON CONFLICT(app_id, key) DO UPDATE SET value = excluded.value, is_secret = excluded.is_secret, updated_at = CURRENT_TIMESTAMP`,
+			appID, key, value, secret)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	// Keys only, never values
+	s.DB.LogAudit("env_set", sub.UserID, appName, sub.RemoteIP, strings.Join(keys, ","))
+	return keys, nil
+}
+
+// UnsetEnv removes variables from the app's environment
+func (s *Service) UnsetEnv(sub policy.Subject, appName string, keys []string) error {
+	if len(keys) == 0 {
+		return errors.New("usage: env unset <app> KEY... [--recreate]")
+	}
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppEnv, appName)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := s.DB.Conn.Exec("DELETE FROM app_env WHERE app_id = ? AND key = ?", appID, key); err != nil {
+			return err
+		}
+	}
+	s.DB.LogAudit("env_unset", sub.UserID, appName, sub.RemoteIP, strings.Join(keys, ","))
+	return nil
+}
+
+// ApplyEnv recreates the app's container, since env is baked in at creation.
+// It is replaced in place rather than rolled out blue/green, since the image
+// hasn't changed and many apps serve nothing a health check could see.
+func (s *Service) ApplyEnv(ctx context.Context, sub policy.Subject, appName string) ([]string, error) {
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppEnv, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockApp(appName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	spec, err := s.loadAppSpec(appID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Runner.RecreateApp(ctx, spec); err != nil {
+		return nil, fmt.Errorf("failed to recreate container, kept the previous one: %w", err)
+	}
+	s.DB.LogAudit("app_recreate", sub.UserID, appName, sub.RemoteIP, "env change")
+
+	var warnings []string
+	if _, err := s.recordRelease(ctx, appID, appName, sub.UserID, "env change"); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to record release: %v", err))
+	}
+	if err := s.SyncRoute(ctx, appName); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to update HTTP proxy: %v", err))
+	}
+	return warnings, nil
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/auth"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// MaxKeysSize bounds how much of a keys file or stdin is read
+const MaxKeysSize = 64 << 10
+
+var forgeUserPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Key is one registered SSH key
+type Key struct {
+	Fingerprint string   `json:"fingerprint"`
+	Comment     string   `json:"comment"`
+	Created     string   `json:"created_at"`
+	Expires     string   `json:"expires_at,omitempty"`
+	LastUsed    string   `json:"last_used_at,omitempty"`
+	LastUsedIP  string   `json:"last_used_ip,omitempty"`
+	Options     string   `json:"options,omitempty"`
+	Apps        []string `json:"apps,omitempty"`
+}
+
+// KeyResult is the outcome of adding one key from an import
+type KeyResult struct {
+	Line        int    `json:"line"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+	Status      string `json:"status"` // added, duplicate, in_use or invalid
+	Error       string `json:"error,omitempty"`
+}
+
+// KeyLimits are restrictions applied to every key added in one import
+type KeyLimits struct {
+	Expires time.Duration // zero for never
+	Apps    []string
+	// Inherit holds the limits of the credential the import runs under.
+	// Added keys expire no later and carry the same options.
+	Inherit auth.Restrictions
+}
+
+// keyRow is KeyLimits as stored
+type keyRow struct {
+	ExpiresAt string // UTC "2006-01-02 15:04:05", empty for never
+	Apps      []string
+	Options   string // replaces the options on each line if set
+}
+
+func (s *Service) ListKeys(sub policy.Subject) ([]Key, error) {
+	rows, err := s.DB.Conn.Query(`SELECT fingerprint, COALESCE(comment, ''), created_at, COALESCE(expires_at, ''),
+		COALESCE(last_used_at, ''), COALESCE(last_used_ip, ''), options, apps
+		FROM public_keys WHERE user_id = ? ORDER BY id`, sub.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []Key
+	for rows.Next() {
+		var k Key
+		var apps string
+		rows.Scan(&k.Fingerprint, &k.Comment, &k.Created, &k.Expires, &k.LastUsed, &k.LastUsedIP, &k.Options, &apps)
+		if apps != "" {
+			k.Apps = strings.Split(apps, ",")
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// ImportKeys adds every key in an authorized_keys stream to the subject's
+// account. source describes where the keys came from, for the audit log.
+// Keys can only be limited to apps the subject could open themselves, and
+// can't outlive or shed the options of the key the subject logged in with.
+func (s *Service) ImportKeys(sub policy.Subject, data []byte, source string, limits KeyLimits) ([]KeyResult, int, error) {
+	row := keyRow{Options: limits.Inherit.Options}
+	if limits.Expires < 0 {
+		return nil, 0, errors.New("key expiry must be in the future")
+	}
+	if notAfter := limits.Inherit.NotAfter; !notAfter.IsZero() {
+		remaining := time.Until(notAfter)
+		if remaining <= 0 {
+			return nil, 0, errors.New("the key you logged in with has expired")
+		}
+		if limits.Expires == 0 || limits.Expires > remaining {
+			limits.Expires = remaining
+		}
+	}
+	if limits.Expires > 0 {
+		row.ExpiresAt = time.Now().UTC().Add(limits.Expires).Format("2006-01-02 15:04:05")
+	}
+	for _, app := range limits.Apps {
+		if app = strings.TrimSpace(app); app == "" {
+			continue
+		}
+		if _, err := s.Policy.AuthorizeApp(sub, policy.AppExec, app); err != nil {
+			return nil, 0, err
+		}
+		row.Apps = append(row.Apps, app)
+	}
+
+	results, err := importKeys(s.DB, sub.UserID, data, row)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(results) == 0 {
+		return nil, 0, errors.New("no keys found")
+	}
+
+	added := 0
+	for _, res := range results {
+		if res.Status == "added" {
+			added++
+		}
+	}
+	s.DB.LogAudit("keys_import", sub.UserID, "", sub.RemoteIP, fmt.Sprintf("source=%s added=%d of=%d", source, added, len(results)))
+	return results, added, nil
+}
+
+// RemoveKey deletes one of the subject's keys
+func (s *Service) RemoveKey(sub policy.Subject, fingerprint string) error {
+	result, err := s.DB.Conn.Exec("DELETE FROM public_keys WHERE user_id = ? AND fingerprint = ?", sub.UserID, fingerprint)
+	if err != nil {
+		return fmt.Errorf("removing key: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.New("key not found")
+	}
+	s.DB.LogAudit("keys_remove", sub.UserID, "", sub.RemoteIP, "fingerprint="+fingerprint)
+	return nil
+}
+
+// ForgeKeys fetches a user's public keys from a forge. arg is a username on
+// the first configured forge or a full <user>.keys URL on any of them.
+func (s *Service) ForgeKeys(ctx context.Context, arg string) ([]byte, string, error) {
+	url, err := forgeKeysURL(s.Cfg.KeyForgeURLs, arg)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := fetchKeys(ctx, url)
+	return data, url, err
+}
+
+// importKeys parses an authorized_keys stream and registers each new key for
+// the user, skipping keys already registered to anyone. Options on a line
+// (from=, command=, restrict) are kept with the key.
+func importKeys(d *db.Database, userID int, data []byte, limits keyRow) ([]KeyResult, error) {
+	var results []KeyResult
+	seen := make(map[string]bool)
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		res := KeyResult{Line: i + 1}
+
+		pubKey, comment, options, _, err := gossh.ParseAuthorizedKey([]byte(line))
+		if err == nil {
+			if _, isCert := pubKey.(*gossh.Certificate); isCert {
+				err = errors.New("certificates can't be registered; use the CA's key")
+			}
+		}
+		if err == nil {
+			_, err = auth.ParseKeyOptions(strings.Join(options, ","))
+		}
+		if err == nil && limits.Options != "" && len(options) > 0 {
+			err = errors.New("key options can't be set when the key you logged in with has its own")
+		}
+		if err != nil {
+			res.Status, res.Error = "invalid", err.Error()
+			results = append(results, res)
+			continue
+		}
+		res.Fingerprint, res.Comment = gossh.FingerprintSHA256(pubKey), comment
+
+		if seen[res.Fingerprint] {
+			res.Status, res.Error = "duplicate", "repeated in input"
+			results = append(results, res)
+			continue
+		}
+		seen[res.Fingerprint] = true
+
+		var owner int
+		var signed bool
+		err = d.Conn.QueryRow("SELECT user_id FROM public_keys WHERE fingerprint = ?", res.Fingerprint).Scan(&owner)
+		if err == sql.ErrNoRows {
+			d.Conn.QueryRow("SELECT EXISTS(SELECT 1 FROM certificates WHERE fingerprint = ? AND revoked_at IS NULL AND expires_at > datetime('now'))",
+				res.Fingerprint).Scan(&signed)
+		}
+		switch {
+		case signed:
+			// Registering it would let the key in without its certificate's limits
+			res.Status, res.Error = "in_use", "has an active gateway certificate; revoke it first"
+		case err == nil && owner == userID:
+			res.Status, res.Error = "duplicate", "already on your account"
+		case err == nil:
+			res.Status, res.Error = "in_use", "registered to another account"
+		case err != sql.ErrNoRows:
+			return nil, err
+		default:
+			keyData := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(pubKey)))
+			if comment != "" {
+				keyData += " " + comment
+			}
+			var expiresAt interface{}
+			if limits.ExpiresAt != "" {
+				expiresAt = limits.ExpiresAt
+			}
+			keyOptions := strings.Join(options, ",")
+			if limits.Options != "" {
+				keyOptions = limits.Options
+			}
+			if _, err := d.Conn.Exec(`INSERT INTO public_keys (user_id, fingerprint, key_data, comment, expires_at, options, apps)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`, userID, res.Fingerprint, keyData, comment, expiresAt,
+				keyOptions, strings.Join(limits.Apps, ",")); err != nil {
+				return nil, err
+			}
+			res.Status = "added"
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// forgeKeysURL resolves a forge username, or a full .keys URL on one of the
+// configured forges, to the URL of that user's public keys
+func forgeKeysURL(forges []string, arg string) (string, error) {
+	if len(forges) == 0 {
+		return "", errors.New("key import from forges is disabled")
+	}
+	if strings.Contains(arg, "://") {
+		for _, base := range forges {
+			if strings.HasPrefix(arg, strings.TrimSuffix(base, "/")+"/") && strings.HasSuffix(arg, ".keys") {
+				return arg, nil
+			}
+		}
+		return "", fmt.Errorf("only <user>.keys URLs on %s can be imported", strings.Join(forges, ", "))
+	}
+	if !forgeUserPattern.MatchString(arg) {
+		return "", fmt.Errorf("invalid username '%s'", arg)
+	}
+	return strings.TrimSuffix(forges[0], "/") + "/" + arg + ".keys", nil
+}
+
+func fetchKeys(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MaxKeysSize))
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/auth"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newAuthorizedKey(t *testing.T, comment string) string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := gossh.NewPublicKey(pub)
+	return strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))) + " " + comment
+}
+
+func TestImportKeysFromForge(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com'), (2, 'bob@example.com')")
+
+	laptop := newAuthorizedKey(t, "laptop")
+	desktop := newAuthorizedKey(t, "desktop")
+	bobs := newAuthorizedKey(t, "bob")
+	if _, err := importKeys(d, 2, []byte(bobs), keyRow{}); err != nil {
+		t.Fatalf("importKeys failed: %v", err)
+	}
+
+	// Stand-in for https://github.com/<user>.keys
+	forge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/alice.keys" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(laptop + "\n" + desktop + "\n" + laptop + "\nnot-a-key\n" + bobs + "\n"))
+	}))
+	defer forge.Close()
+
+	url, err := forgeKeysURL([]string{forge.URL}, "alice")
+	if err != nil {
+		t.Fatalf("forgeKeysURL failed: %v", err)
+	}
+	data, err := fetchKeys(context.Background(), url)
+	if err != nil {
+		t.Fatalf("fetchKeys failed: %v", err)
+	}
+	results, err := importKeys(d, 1, data, keyRow{})
+	if err != nil {
+		t.Fatalf("importKeys failed: %v", err)
+	}
+
+	want := []string{"added", "added", "duplicate", "invalid", "in_use"}
+	if len(results) != len(want) {
+		t.Fatalf("Expected %d results, got %+v", len(want), results)
+	}
+	for i, res := range results {
+		if res.Status != want[i] {
+			t.Errorf("Line %d: expected %s, got %s (%s)", res.Line, want[i], res.Status, res.Error)
+		}
+	}
+
+	// Importing again only finds duplicates
+	results, _ = importKeys(d, 1, []byte(laptop), keyRow{})
+	if len(results) != 1 || results[0].Status != "duplicate" {
+		t.Errorf("Expected duplicate on re-import, got %+v", results)
+	}
+
+	// Line options and command limits are stored with the key
+	limited := `from="10.0.0.0/8",restrict ` + newAuthorizedKey(t, "ci")
+	results, _ = importKeys(d, 1, []byte(limited), keyRow{ExpiresAt: "2030-01-01 00:00:00", Apps: []string{"bloggy"}})
+	var options, apps, expires string
+	d.Conn.QueryRow("SELECT options, apps, expires_at FROM public_keys WHERE fingerprint = ?", results[0].Fingerprint).Scan(&options, &apps, &expires)
+	if options != `from="10.0.0.0/8",restrict` || apps != "bloggy" || expires == "" {
+		t.Errorf("Unexpected stored limits: options=%q apps=%q expires=%q", options, apps, expires)
+	}
+	results, _ = importKeys(d, 1, []byte(`permitopen="x:1" `+newAuthorizedKey(t, "bad")), keyRow{})
+	if results[0].Status != "invalid" {
+		t.Errorf("Expected unsupported option to be invalid, got %s", results[0].Status)
+	}
+
+	if _, err := fetchKeys(context.Background(), forge.URL+"/nobody.keys"); err == nil {
+		t.Error("Expected error for missing user")
+	}
+	if _, err := forgeKeysURL([]string{forge.URL}, "http://evil.example/alice.keys"); err == nil {
+		t.Error("Expected URL outside configured forges to be refused")
+	}
+}
+
+func TestImportKeysInheritsRestrictions(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com')")
+	svc := New(d, nil, nil, &config.Config{})
+	sub := policy.Subject{UserID: 1}
+
+	// A session from a key that expires in an hour and only works from one
+	// network can't add a key without those limits
+	notAfter := time.Now().Add(time.Hour)
+	limits := KeyLimits{Expires: 30 * 24 * time.Hour, Inherit: auth.Restrictions{Options: `from="10.0.0.0/8"`, NotAfter: notAfter}}
+	results, added, err := svc.ImportKeys(sub, []byte(newAuthorizedKey(t, "laptop")), "args", limits)
+	if err != nil || added != 1 {
+		t.Fatalf("ImportKeys failed: %v %+v", err, results)
+	}
+	var options, expires string
+	d.Conn.QueryRow("SELECT options, expires_at FROM public_keys WHERE fingerprint = ?", results[0].Fingerprint).Scan(&options, &expires)
+	if options != `from="10.0.0.0/8"` {
+		t.Errorf("Expected the session key's options, got %q", options)
+	}
+	if got, _ := time.Parse("2006-01-02 15:04:05", expires); got.After(notAfter) {
+		t.Errorf("Expected the key to expire by %s, got %q", notAfter.UTC(), expires)
+	}
+
+	// Nor one with options of its own, which could undo the inherited ones
+	results, _, _ = svc.ImportKeys(sub, []byte(`from="*" `+newAuthorizedKey(t, "desktop")), "args", limits)
+	if len(results) != 1 || results[0].Status != "invalid" {
+		t.Errorf("Expected line options to be refused, got %+v", results)
+	}
+
+	limits.Inherit.NotAfter = time.Now().Add(-time.Minute)
+	if _, _, err := svc.ImportKeys(sub, []byte(newAuthorizedKey(t, "phone")), "args", limits); err == nil {
+		t.Error("Expected an expired session key to be refused")
+	}
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/runner"
+	"github.com/rnzor/poor_man_exe/internal/secrets"
+)
+
+// Release is a configuration an app's container was created from: the
+// image, environment, limits and port
+type Release struct {
+	Version  int           `json:"version"`
+	Image    string        `json:"image"`
+	ImageID  string        `json:"image_id,omitempty"`
+	EnvKeys  []string      `json:"env_keys"`
+	Limits   runner.Limits `json:"limits"`
+	HTTPPort int           `json:"http_port"`
+	Reason   string        `json:"reason"`
+	By       string        `json:"deployed_by"`
+	Created  string        `json:"created_at"`
+
+	env []envEntry
+}
+
+// envEntry is an app_env row as stored, with secrets still encrypted
+type envEntry struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret"`
+}
+
+const releaseColumns = `r.version, r.image, COALESCE(r.image_id, ''), r.env, r.memory_mb, r.cpus, r.pids_limit, r.http_port,
+	r.reason, COALESCE(u.email, ''), r.created_at FROM releases r LEFT JOIN users u ON u.id = r.user_id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRelease(row rowScanner) (*Release, error) {
+	var rel Release
+	var env string
+	err := row.Scan(&rel.Version, &rel.Image, &rel.ImageID, &env, &rel.Limits.MemoryMB, &rel.Limits.CPUs, &rel.Limits.Pids,
+		&rel.HTTPPort, &rel.Reason, &rel.By, &rel.Created)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(env), &rel.env); err != nil {
+		return nil, fmt.Errorf("release %d: bad env snapshot: %w", rel.Version, err)
+	}
+	rel.EnvKeys = []string{}
+	for _, e := range rel.env {
+		rel.EnvKeys = append(rel.EnvKeys, e.Key)
+	}
+	return &rel, nil
+}
+
+// recordRelease snapshots the app's registry entry and environment after
+// its container was (re)created, and returns the new release's version
+func (s *Service) recordRelease(ctx context.Context, appID int, appName string, userID int, reason string) (int, error) {
+	var image string
+	var port int
+	var limits runner.Limits
+	err := s.DB.Conn.QueryRow("SELECT image, http_port, memory_mb, cpus, pids_limit FROM apps WHERE id = ?", appID).
+		Scan(&image, &port, &limits.MemoryMB, &limits.CPUs, &limits.Pids)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := s.DB.Conn.Query("SELECT key, value, is_secret FROM app_env WHERE app_id = ? ORDER BY key", appID)
+	if err != nil {
+		return 0, err
+	}
+	env := []envEntry{}
+	for rows.Next() {
+		var e envEntry
+		if err := rows.Scan(&e.Key, &e.Value, &e.Secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		env = append(env, e)
+	}
+	rows.Close()
+	snapshot, _ := json.Marshal(env)
+
+	// The image ID pins the exact image even if the tag moves later
+	imageID, _ := s.Runner.AppImageID(ctx, appName)
+
+	var version int
+	if err := s.DB.Conn.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM releases WHERE app_id = ?", appID).Scan(&version); err != nil {
+		return 0, err
+	}
+	_, err = s.DB.Conn.Exec(`INSERT INTO releases (app_id, version, image, image_id, env, memory_mb, cpus, pids_limit, http_port, reason, user_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		appID, version, image, imageID, string(snapshot), limits.MemoryMB, limits.CPUs, limits.Pids, port, reason, userID,
+		time.Now().UTC().Format("2006-01-02 15:04:05"))
+	return version, err
+}
+
+// ListReleases returns an app's releases, newest first
+func (s *Service) ListReleases(sub policy.Subject, appName string) ([]Release, error) {
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppRead, appName)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.Conn.Query("SELECT "+releaseColumns+" WHERE r.app_id = ? ORDER BY r.version DESC", appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var releases []Release
+	for rows.Next() {
+		rel, err := scanRelease(rows)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, *rel)
+	}
+	return releases, rows.Err()
+}
+
+// Rollback recreates the app's container from an earlier release, restoring
+// its image, environment, limits and port in the registry. Version 0 means
+// the release before the current one. Volumes and the Caddy route are kept.
+// The rollback is itself recorded as a new release, which is returned.
+func (s *Service) Rollback(ctx context.Context, sub policy.Subject, appName string, version int) (*Release, []string, error) {
+	appID, err := s.Policy.AuthorizeApp(sub, policy.AppDeploy, appName)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock, err := lockApp(appName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	var target *Release
+	if version == 0 {
+		target, err = scanRelease(s.DB.Conn.QueryRow("SELECT "+releaseColumns+" WHERE r.app_id = ? ORDER BY r.version DESC LIMIT 1 OFFSET 1", appID))
+	} else {
+		target, err = scanRelease(s.DB.Conn.QueryRow("SELECT "+releaseColumns+" WHERE r.app_id = ? AND r.version = ?", appID, version))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		if version == 0 {
+			return nil, nil, fmt.Errorf("'%s' has no earlier release to roll back to", appName)
+		}
+		return nil, nil, fmt.Errorf("release %d of '%s' not found", version, appName)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	current, err := s.loadAppSpec(appID)
+	if err == nil {
+		current.Volumes, err = s.Runner.AppVolumes(ctx, appName)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spec := current
+	spec.Image = target.Image
+	if target.ImageID != "" && s.Runner.ImageExists(ctx, target.ImageID) {
+		spec.Image = target.ImageID
+	}
+	spec.Limits = target.Limits
+	spec.Env = nil
+	box := secrets.NewBox(s.Cfg.SecretKey)
+	for _, e := range target.env {
+		value := e.Value
+		if e.Secret {
+			if value, err = box.Decrypt(e.Value); err != nil {
+				return nil, nil, fmt.Errorf("decrypting %s: %w", e.Key, err)
+			}
+		}
+		spec.Env = append(spec.Env, e.Key+"="+value)
+	}
+
+	warnings, err := s.rollout(ctx, spec, target.HTTPPort, io.Discard)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rolling back to release %d: %w", target.Version, err)
+	}
+
+	if err := s.restoreRegistry(appID, target); err != nil {
+		return nil, nil, fmt.Errorf("rolled back container but failed to update registry: %w", err)
+	}
+
+	reason := fmt.Sprintf("rollback to %d", target.Version)
+	newVersion, err := s.recordRelease(ctx, appID, appName, sub.UserID, reason)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to record release: %v", err))
+	}
+	s.DB.LogAudit("app_rollback", sub.UserID, appName, sub.RemoteIP, fmt.Sprintf("release=%d image=%s", target.Version, target.Image))
+
+	if err := s.SyncRoute(ctx, appName); err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to update HTTP proxy: %v", err))
+	}
+
+	rel := *target
+	rel.Version, rel.Reason, rel.Created = newVersion, reason, time.Now().UTC().Format("2006-01-02 15:04:05")
+	s.DB.Conn.QueryRow("SELECT email FROM users WHERE id = ?", sub.UserID).Scan(&rel.By)
+	return &rel, warnings, nil
+}
+
+// restoreRegistry makes the app's registry entry and environment match a
+// release
+func (s *Service) restoreRegistry(appID int, rel *Release) error {
+	tx, err := s.DB.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE apps SET image = ?, http_port = ?, memory_mb = ?, cpus = ?, pids_limit = ? WHERE id = ?",
+		rel.Image, rel.HTTPPort, rel.Limits.MemoryMB, rel.Limits.CPUs, rel.Limits.Pids, appID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM app_env WHERE app_id = ?", appID); err != nil {
+		return err
+	}
+	for _, e := range rel.env {
+		if _, err := tx.Exec("INSERT INTO app_env (app_id, key, value, is_secret) VALUES (?, ?, ?, ?)", appID, e.Key, e.Value, e.Secret); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
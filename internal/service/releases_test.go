@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+)
+
+func TestReleases(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com'), (2, 'bob@example.com')")
+	d.Conn.Exec("INSERT INTO apps (id, name, user_id, image, http_port) VALUES (1, 'bloggy', 1, 'poor-exe/bloggy:2', 8080)")
+	d.Conn.Exec("INSERT INTO app_env (app_id, key, value) VALUES (1, 'NEW', 'yes')")
+	d.Conn.Exec(`INSERT INTO releases (app_id, version, image, env, memory_mb, http_port, reason, user_id) VALUES
+		(1, 1, 'poor-exe/bloggy:1', '[{"key":"PORT","value":"3000","secret":false},{"key":"TOKEN","value":"sealed","secret":true}]', 256, 3000, 'create', 1),
+		(1, 2, 'poor-exe/bloggy:2', '[{"key":"NEW","value":"yes","secret":false}]', 512, 8080, 'deploy poor-exe/bloggy:2', 1)`)
+
+	svc := New(d, nil, nil, &config.Config{})
+	releases, err := svc.ListReleases(policy.Subject{UserID: 1}, "bloggy")
+	if err != nil {
+		t.Fatalf("ListReleases failed: %v", err)
+	}
+	if len(releases) != 2 || releases[0].Version != 2 || releases[1].By != "alice@example.com" {
+		t.Fatalf("Expected newest release first, got %+v", releases)
+	}
+	if keys := strings.Join(releases[1].EnvKeys, ","); keys != "PORT,TOKEN" {
+		t.Errorf("Expected env keys without values, got %q", keys)
+	}
+
+	var denied *policy.DeniedError
+	if _, err := svc.ListReleases(policy.Subject{UserID: 2}, "bloggy"); !errors.As(err, &denied) {
+		t.Errorf("Expected ListReleases to be denied, got %v", err)
+	}
+	if _, _, err := svc.Rollback(context.Background(), policy.Subject{UserID: 2}, "bloggy", 0); !errors.As(err, &denied) {
+		t.Errorf("Expected Rollback to be denied, got %v", err)
+	}
+	if _, _, err := svc.Rollback(context.Background(), policy.Subject{UserID: 1}, "bloggy", 7); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected unknown release to fail, got %v", err)
+	}
+
+	// Restoring a release puts its image, port, limits and env back in the registry
+	if err := svc.restoreRegistry(1, &releases[1]); err != nil {
+		t.Fatalf("restoreRegistry failed: %v", err)
+	}
+	var image string
+	var port int
+	var memoryMB int64
+	d.Conn.QueryRow("SELECT image, http_port, memory_mb FROM apps WHERE id = 1").Scan(&image, &port, &memoryMB)
+	if image != "poor-exe/bloggy:1" || port != 3000 || memoryMB != 256 {
+		t.Errorf("Expected release 1 in the registry, got %s %d %d", image, port, memoryMB)
+	}
+	var keys string
+	d.Conn.QueryRow("SELECT GROUP_CONCAT(key || ':' || value || ':' || is_secret) FROM (SELECT * FROM app_env WHERE app_id = 1 ORDER BY key)").Scan(&keys)
+	if keys != "PORT:3000:0,TOKEN:sealed:1" {
+		t.Errorf("Expected release 1's env with the secret still sealed, got %q", keys)
+	}
+
+	d.Conn.Exec("DELETE FROM releases WHERE version = 1")
+	if _, _, err := svc.Rollback(context.Background(), policy.Subject{UserID: 1}, "bloggy", 0); err == nil || !strings.Contains(err.Error(), "no earlier release") {
+		t.Errorf("Expected rollback without an earlier release to fail, got %v", err)
+	}
+}
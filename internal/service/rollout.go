@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/runner"
+)
+
+// deploying holds the apps with a rollout in progress, so two can't race
+// for the next container or a version number
+var deploying sync.Map
+
+// lockApp claims an app for a rollout; call the returned func to release it
+func lockApp(appName string) (func(), error) {
+	if _, busy := deploying.LoadOrStore(appName, true); busy {
+		return nil, fmt.Errorf("a deploy of '%s' is already running", appName)
+	}
+	return func() { deploying.Delete(appName) }, nil
+}
+
+// rollout moves an app onto a container created from spec, served on port
+// (the app's registered port if 0). With the blue/green strategy the new
+// container starts beside the running one and only gets traffic once its
+// health check passes; the old one is drained and removed after the switch.
+// Apps with volumes are always replaced in place, since two containers
+// writing the same volume at once can corrupt it; so are stopped apps, which
+// have no traffic to keep serving. A warning says when blue/green was skipped.
+// Otherwise the container is replaced in place, keeping the old one if the
+// new one fails to start. Either way an error means the old version is still
+// serving. Progress is written to out.
+func (s *Service) rollout(ctx context.Context, spec runner.AppSpec, port int, out io.Writer) ([]string, error) {
+	if spec.Volumes == nil {
+		volumes, err := s.Runner.AppVolumes(ctx, spec.Name)
+		if err != nil {
+			return nil, err
+		}
+		spec.Volumes = volumes
+	}
+
+	blueGreen := s.Cfg.DeployStrategy == "bluegreen"
+	var skipped string
+	if blueGreen && len(spec.Volumes) > 0 {
+		skipped = "the app has volumes, which two containers can't share"
+	} else if blueGreen && !s.Runner.IsRunning(ctx, spec.Name) {
+		skipped = "the app isn't running"
+	}
+	if !blueGreen || skipped != "" {
+		var warnings []string
+		if skipped != "" {
+			warnings = append(warnings, "blue/green skipped, the container was stopped and replaced: "+skipped)
+		}
+		if err := s.Runner.RecreateApp(ctx, spec); err != nil {
+			return nil, fmt.Errorf("failed to start new container, kept the previous one: %w", err)
+		}
+		return warnings, nil
+	}
+
+	var checkSpec string
+	var public bool
+	var registeredPort int
+	err := s.DB.Conn.QueryRow("SELECT health_check, is_public, http_port FROM apps WHERE name = ?", spec.Name).Scan(&checkSpec, &public, &registeredPort)
+	if err != nil {
+		return nil, err
+	}
+	if port == 0 {
+		port = registeredPort
+	}
+	if checkSpec == "" {
+		checkSpec = s.Cfg.HealthCheck
+	}
+	check, err := runner.ParseHealthCheck(checkSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(out, "-----> Starting new container beside the running one\n")
+	addr, err := s.Runner.StartNext(ctx, spec, port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start new container: %w", err)
+	}
+	fmt.Fprintf(out, "-----> Waiting up to %ds for %s health check on port %d\n", s.Cfg.HealthTimeout, check, port)
+	if err := s.Runner.WaitHealthy(ctx, spec.Name, addr, check, time.Duration(s.Cfg.HealthTimeout)*time.Second); err != nil {
+		s.Runner.RemoveNext(context.Background(), spec.Name)
+		return nil, fmt.Errorf("new container failed its health check, still serving the previous version: %w", err)
+	}
+
+	// Switch traffic in one route update. The container's IP survives the
+	// rename below, so this keeps working until the caller syncs the route.
+	if err := s.Caddy.UpsertRoute(spec.Name, s.Cfg.Domain, addr, public); err != nil {
+		s.Runner.RemoveNext(context.Background(), spec.Name)
+		return nil, fmt.Errorf("failed to switch HTTP proxy, still serving the previous version: %w", err)
+	}
+
+	// Past the switch there's no going back, so finish even if the client
+	// disconnects
+	fmt.Fprintf(out, "-----> Switched traffic; draining the previous container for %ds\n", s.Cfg.DrainSeconds)
+	time.Sleep(time.Duration(s.Cfg.DrainSeconds) * time.Second)
+	if err := s.Runner.PromoteNext(context.Background(), spec.Name); err != nil {
+		return []string{fmt.Sprintf("new version is serving but replacing the previous container failed: %v", err)}, nil
+	}
+	return nil, nil
+}
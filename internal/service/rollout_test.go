@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/runner"
+)
+
+// fakeRunner stands in for Docker. Methods a test doesn't override panic
+// through the nil embedded Runner.
+type fakeRunner struct {
+	Runner
+	running map[string]bool
+	volumes map[string][]runner.Volume
+	calls   []string
+}
+
+func (f *fakeRunner) IsRunning(ctx context.Context, appName string) bool {
+	return f.running[appName]
+}
+
+func (f *fakeRunner) AppVolumes(ctx context.Context, appName string) ([]runner.Volume, error) {
+	return f.volumes[appName], nil
+}
+
+func (f *fakeRunner) Upstream(ctx context.Context, appName string, port int, dialByIP bool) (string, error) {
+	return fmt.Sprintf("poor-exe-%s:%d", appName, port), nil
+}
+
+func (f *fakeRunner) RecreateApp(ctx context.Context, spec runner.AppSpec) error {
+	f.calls = append(f.calls, "recreate "+spec.Name)
+	return nil
+}
+
+func (f *fakeRunner) CreateApp(ctx context.Context, spec runner.AppSpec) error {
+	f.calls = append(f.calls, "create "+spec.Name)
+	return nil
+}
+
+func (f *fakeRunner) AppImageID(ctx context.Context, appName string) (string, error) {
+	return "sha256:" + appName, nil
+}
+
+func (f *fakeRunner) ImageApp(ctx context.Context, image string) (string, bool) {
+	return "", false
+}
+
+func TestRolloutFallsBackToRecreate(t *testing.T) {
+	fake := &fakeRunner{
+		running: map[string]bool{"bloggy": true, "db": true},
+		volumes: map[string][]runner.Volume{"db": {{Name: "pgdata", Path: "/var/lib/postgresql/data"}}},
+	}
+	svc := New(nil, fake, nil, &config.Config{DeployStrategy: "bluegreen"})
+
+	tests := []struct {
+		app     string
+		warning string
+	}{
+		{"db", "volumes"},
+		{"stopped", "isn't running"},
+	}
+	for _, tt := range tests {
+		fake.calls = nil
+		warnings, err := svc.rollout(context.Background(), runner.AppSpec{Name: tt.app}, 0, io.Discard)
+		if err != nil {
+			t.Fatalf("%s: rollout failed: %v", tt.app, err)
+		}
+		if len(fake.calls) != 1 || fake.calls[0] != "recreate "+tt.app {
+			t.Errorf("%s: expected the container to be recreated in place, got %v", tt.app, fake.calls)
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], tt.warning) {
+			t.Errorf("%s: expected a warning mentioning %q, got %v", tt.app, tt.warning, warnings)
+		}
+	}
+
+	// The recreate strategy is the operator's choice, so it isn't reported
+	svc.Cfg.DeployStrategy = "recreate"
+	fake.calls = nil
+	if warnings, err := svc.rollout(context.Background(), runner.AppSpec{Name: "bloggy"}, 0, io.Discard); err != nil || len(warnings) != 0 {
+		t.Errorf("Expected a silent recreate, got %v %v", warnings, err)
+	}
+	if len(fake.calls) != 1 || fake.calls[0] != "recreate bloggy" {
+		t.Errorf("Expected the container to be recreated in place, got %v", fake.calls)
+	}
+}
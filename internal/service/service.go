@@ -0,0 +1,87 @@
+// Package service implements the operations behind both the SSH CLI and the
+// HTTP API, so the two surfaces authorize, audit and fail the same way.
+package service
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/caddy"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+	"github.com/rnzor/poor_man_exe/internal/runner"
+	"github.com/rnzor/poor_man_exe/internal/secrets"
+)
+
+// Runner is the part of runner.DockerRunner the service drives, so tests can
+// stand in for Docker
+type Runner interface {
+	CreateApp(ctx context.Context, spec runner.AppSpec) error
+	RecreateApp(ctx context.Context, spec runner.AppSpec) error
+	RemoveApp(ctx context.Context, name string) error
+	StartApp(ctx context.Context, appName string) error
+	StopApp(ctx context.Context, appName string, timeout int) error
+	RestartApp(ctx context.Context, appName string, timeout int) error
+	GetAppStatus(ctx context.Context, appName string) (string, error)
+	IsRunning(ctx context.Context, appName string) bool
+	AppVolumes(ctx context.Context, appName string) ([]runner.Volume, error)
+	AppImageID(ctx context.Context, appName string) (string, error)
+	Upstream(ctx context.Context, appName string, port int, dialByIP bool) (string, error)
+	Logs(ctx context.Context, appName string, opts runner.LogOptions, stdout, stderr io.Writer) error
+
+	BuildImage(ctx context.Context, buildContext io.Reader, tag string, labels map[string]string, out io.Writer) error
+	ImageExists(ctx context.Context, ref string) bool
+	ImageApp(ctx context.Context, ref string) (app string, ok bool)
+	RemoveAppImages(ctx context.Context, appName string) error
+
+	StartNext(ctx context.Context, spec runner.AppSpec, port int) (string, error)
+	WaitHealthy(ctx context.Context, appName, addr string, check runner.HealthCheck, timeout time.Duration) error
+	PromoteNext(ctx context.Context, appName string) error
+	RemoveNext(ctx context.Context, appName string) error
+}
+
+// Service performs actions on behalf of a policy.Subject. Every method
+// authorizes the subject first and audits what it changed.
+type Service struct {
+	DB     *db.Database
+	Runner Runner
+	Caddy  *caddy.Client
+	Cfg    *config.Config
+	Policy *policy.Engine
+}
+
+func New(d *db.Database, r Runner, c *caddy.Client, cfg *config.Config) *Service {
+	return &Service{DB: d, Runner: r, Caddy: c, Cfg: cfg, Policy: policy.New(d, cfg)}
+}
+
+// SyncRoute points an app's Caddy route at its current container, using the
+// port and visibility from the registry. Call it whenever the container is
+// (re)created or those settings change.
+func (s *Service) SyncRoute(ctx context.Context, appName string) error {
+	var port int
+	var isPublic bool
+	err := s.DB.Conn.QueryRow("SELECT http_port, is_public FROM apps WHERE name = ?", appName).Scan(&port, &isPublic)
+	if err != nil {
+		return err
+	}
+
+	upstream, err := s.Runner.Upstream(ctx, appName, port, s.Cfg.DialByIP)
+	if err != nil {
+		return err
+	}
+	return s.Caddy.UpsertRoute(appName, s.Cfg.Domain, upstream, isPublic)
+}
+
+// loadAppSpec rebuilds the container spec for an existing app from the registry
+func (s *Service) loadAppSpec(appID int) (runner.AppSpec, error) {
+	var spec runner.AppSpec
+	err := s.DB.Conn.QueryRow("SELECT name, image, user_id, memory_mb, cpus, pids_limit FROM apps WHERE id = ?", appID).
+		Scan(&spec.Name, &spec.Image, &spec.UserID, &spec.Limits.MemoryMB, &spec.Limits.CPUs, &spec.Limits.Pids)
+	if err != nil {
+		return spec, err
+	}
+	spec.Env, err = s.DB.AppEnv(appID, secrets.NewBox(s.Cfg.SecretKey))
+	return spec, err
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/rnzor/poor_man_exe/internal/policy"
+)
+
+// Share changes who can reach an app over HTTP: its visibility, the container
+// port Caddy proxies to, or the email allowlist. arg is the port or email for
+// the commands that take one.
+func (s *Service) Share(ctx context.Context, sub policy.Subject, cmd, appName, arg string) error {
+	appID, err := s.Policy.AuthorizeApp(sub, policy.ShareWrite, appName)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "set-public", "set-private":
+		// Adds or drops the forward_auth check in front of the app
+		err = s.setRouted(ctx, appID, appName, "is_public", cmd == "set-public")
+	case "port":
+		port, convErr := strconv.Atoi(arg)
+		if arg == "" {
+			err = fmt.Errorf("usage: share port <vm> <port>")
+		} else if convErr != nil || port < 1 || port > 65535 {
+			err = fmt.Errorf("invalid port: %s", arg)
+		} else {
+			err = s.setRouted(ctx, appID, appName, "http_port", port)
+		}
+	case "add":
+		if arg == "" {
+			err = fmt.Errorf("usage: share add <vm> <email>")
+		} else {
+			_, err = s.DB.Conn.Exec("INSERT OR IGNORE INTO app_shares (app_id, email) VALUES (?, ?)", appID, arg)
+		}
+	case "remove":
+		if arg == "" {
+			err = fmt.Errorf("usage: share remove <vm> <email>")
+		} else {
+			_, err = s.DB.Conn.Exec("DELETE FROM app_shares WHERE app_id = ? AND email = ?", appID, arg)
+		}
+	default:
+		err = fmt.Errorf("unknown share command: %s", cmd)
+	}
+	if err != nil {
+		return err
+	}
+
+	details := cmd
+	if arg != "" {
+		details = cmd + " " + arg
+	}
+	s.DB.LogAudit("share_change", sub.UserID, appName, sub.RemoteIP, details)
+	return nil
+}
+
+// setRouted changes a setting the app's Caddy route is built from and syncs
+// the route. If Caddy can't be updated the old value is put back, so the
+// registry never claims, say, a private app that Caddy still serves openly.
+func (s *Service) setRouted(ctx context.Context, appID int, appName, column string, value interface{}) error {
+	var old interface{}
+	if err := s.DB.Conn.QueryRow("SELECT "+column+" FROM apps WHERE id = ?", appID).Scan(&old); err != nil {
+		return err
+	}
+	if _, err := s.DB.Conn.Exec("UPDATE apps SET "+column+" = ? WHERE id = ?", value, appID); err != nil {
+		return err
+	}
+	if err := s.SyncRoute(ctx, appName); err != nil {
+		if _, rerr := s.DB.Conn.Exec("UPDATE apps SET "+column+" = ? WHERE id = ?", old, appID); rerr != nil {
+			return fmt.Errorf("failed to update HTTP proxy: %v; restoring the previous setting also failed: %v", err, rerr)
+		}
+		return fmt.Errorf("failed to update HTTP proxy, setting left unchanged: %w", err)
+	}
+	return nil
+}
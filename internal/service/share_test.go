@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/caddy"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+	"github.com/rnzor/poor_man_exe/internal/policy"
+)
+
+func TestShareKeepsRegistryInSyncWithCaddy(t *testing.T) {
+	d, err := db.Connect(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	d.Conn.Exec("INSERT INTO users (id, email) VALUES (1, 'alice@example.com')")
+	d.Conn.Exec("INSERT INTO apps (id, name, user_id, is_public, http_port) VALUES (1, 'bloggy', 1, TRUE, 80)")
+
+	// Stand-in for Caddy's admin API
+	caddyUp := true
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !caddyUp {
+			http.Error(w, "down", http.StatusBadGateway)
+		}
+	}))
+	defer admin.Close()
+
+	svc := New(d, &fakeRunner{}, caddy.NewClient(admin.URL, "gateway:8080"), &config.Config{Domain: "example.com"})
+	sub := policy.Subject{UserID: 1}
+	settings := func() (public bool, port int) {
+		d.Conn.QueryRow("SELECT is_public, http_port FROM apps WHERE id = 1").Scan(&public, &port)
+		return
+	}
+	audits := func() (n int) {
+		d.Conn.QueryRow("SELECT COUNT(*) FROM audit_log WHERE event = 'share_change'").Scan(&n)
+		return
+	}
+
+	// While Caddy can't be updated nothing changes, so the app isn't
+	// recorded as private while still being served openly
+	caddyUp = false
+	if err := svc.Share(context.Background(), sub, "set-private", "bloggy", ""); err == nil {
+		t.Error("Expected set-private to fail while Caddy is down")
+	}
+	if err := svc.Share(context.Background(), sub, "port", "bloggy", "3000"); err == nil {
+		t.Error("Expected port to fail while Caddy is down")
+	}
+	if public, port := settings(); !public || port != 80 {
+		t.Errorf("Expected settings to be left unchanged, got public=%v port=%d", public, port)
+	}
+	if n := audits(); n != 0 {
+		t.Errorf("Expected no audit entries for failed changes, got %d", n)
+	}
+
+	caddyUp = true
+	if err := svc.Share(context.Background(), sub, "set-private", "bloggy", ""); err != nil {
+		t.Fatalf("set-private failed: %v", err)
+	}
+	if err := svc.Share(context.Background(), sub, "port", "bloggy", "3000"); err != nil {
+		t.Fatalf("port failed: %v", err)
+	}
+	if public, port := settings(); public || port != 3000 {
+		t.Errorf("Expected private on port 3000, got public=%v port=%d", public, port)
+	}
+	if n := audits(); n != 2 {
+		t.Errorf("Expected both changes to be audited, got %d", n)
+	}
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/policy"
+)
+
+// TokenPrefix makes API tokens recognisable to humans and secret scanners
+const TokenPrefix = "pxe_"
+
+// ErrInvalidToken is returned for unknown, revoked or expired API tokens
+var ErrInvalidToken = errors.New("invalid or expired API token")
+
+var tokenNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Token describes an API token; the secret itself is only shown on creation
+type Token struct {
+	Name       string `json:"name"`
+	Created    string `json:"created_at"`
+	Expires    string `json:"expires_at,omitempty"`
+	LastUsed   string `json:"last_used_at,omitempty"`
+	LastUsedIP string `json:"last_used_ip,omitempty"`
+}
+
+// CreateToken issues an API token acting as the subject. A zero ttl never
+// expires. Only the token's hash is stored.
+func (s *Service) CreateToken(sub policy.Subject, name string, ttl time.Duration) (string, *Token, error) {
+	if err := s.Policy.Authorize(sub, policy.TokenManage); err != nil {
+		return "", nil, err
+	}
+	if !tokenNamePattern.MatchString(name) {
+		return "", nil, fmt.Errorf("invalid token name '%s'", name)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	secret := TokenPrefix + hex.EncodeToString(buf)
+
+	tok := &Token{Name: name, Created: time.Now().UTC().Format("2006-01-02 15:04:05")}
+	var expiresAt interface{}
+	if ttl > 0 {
+		tok.Expires = time.Now().UTC().Add(ttl).Format("2006-01-02 15:04:05")
+		expiresAt = tok.Expires
+	}
+	_, err := s.DB.Conn.Exec("INSERT INTO api_tokens (user_id, name, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		sub.UserID, name, hashToken(secret), expiresAt, tok.Created)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return "", nil, fmt.Errorf("token '%s' already exists", name)
+		}
+		return "", nil, err
+	}
+
+	s.DB.LogAudit("token_create", sub.UserID, "", sub.RemoteIP, "name="+name)
+	return secret, tok, nil
+}
+
+func (s *Service) ListTokens(sub policy.Subject) ([]Token, error) {
+	if err := s.Policy.Authorize(sub, policy.TokenManage); err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.Conn.Query(`SELECT name, created_at, COALESCE(expires_at, ''), COALESCE(last_used_at, ''), COALESCE(last_used_ip, '')
+		FROM api_tokens WHERE user_id = ? ORDER BY id`, sub.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		var t Token
+		rows.Scan(&t.Name, &t.Created, &t.Expires, &t.LastUsed, &t.LastUsedIP)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken deletes one of the subject's tokens by name
+func (s *Service) RevokeToken(sub policy.Subject, name string) error {
+	if err := s.Policy.Authorize(sub, policy.TokenManage); err != nil {
+		return err
+	}
+	result, err := s.DB.Conn.Exec("DELETE FROM api_tokens WHERE user_id = ? AND name = ?", sub.UserID, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("token '%s' not found", name)
+	}
+	s.DB.LogAudit("token_revoke", sub.UserID, "", sub.RemoteIP, "name="+name)
+	return nil
+}
+
+// TokenSubject resolves an API token to the subject it acts as and records
+// its use. Tokens of disabled users are rejected like unknown ones.
+func (s *Service) TokenSubject(secret, remoteIP string) (policy.Subject, error) {
+	if !strings.HasPrefix(secret, TokenPrefix) {
+		return policy.Subject{}, ErrInvalidToken
+	}
+
+	var id, userID int
+	err := s.DB.Conn.QueryRow(`SELECT t.id, t.user_id FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ? AND (t.expires_at IS NULL OR t.expires_at > datetime('now'))
+		AND NOT COALESCE(u.disabled, FALSE)`, hashToken(secret)).Scan(&id, &userID)
+	if err == sql.ErrNoRows {
+		return policy.Subject{}, ErrInvalidToken
+	}
+	if err != nil {
+		return policy.Subject{}, err
+	}
+
+	s.DB.Conn.Exec("UPDATE api_tokens SET last_used_at = ?, last_used_ip = ? WHERE id = ?",
+		time.Now().UTC().Format("2006-01-02 15:04:05"), remoteIP, id)
+	return policy.Subject{UserID: userID, RemoteIP: remoteIP}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,197 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ErrNotFound is returned by Kill for unknown session IDs
+var ErrNotFound = errors.New("session not found")
+
+// Session is one live SSH session
+type Session struct {
+	ID          string
+	UserID      int
+	Fingerprint string
+	RemoteIP    string
+	Target      string // "cli", "register" or an app name
+	Started     time.Time
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	sess     ssh.Session
+}
+
+// Info is a snapshot of a Session for listing
+type Info struct {
+	ID          string    `json:"id"`
+	UserID      int       `json:"user_id"`
+	Fingerprint string    `json:"fingerprint"`
+	RemoteIP    string    `json:"remote_ip"`
+	Target      string    `json:"target"`
+	Started     time.Time `json:"started_at"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+}
+
+// Registry tracks live sessions and caps how many one key may hold
+type Registry struct {
+	MaxPerKey int
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewRegistry(maxPerKey int) *Registry {
+	return &Registry{MaxPerKey: maxPerKey, sessions: make(map[string]*Session)}
+}
+
+// Add registers sess once authentication is done. The caller must Remove it
+// when the session ends.
+func (r *Registry) Add(sess ssh.Session, target string) (*Session, error) {
+	ctx := sess.Context()
+	s := &Session{
+		Target:  target,
+		Started: time.Now(),
+		sess:    sess,
+	}
+	s.UserID, _ = ctx.Value("user_id").(int)
+	s.Fingerprint, _ = ctx.Value("fingerprint").(string)
+	s.RemoteIP, _ = ctx.Value("remote_ip").(string)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.MaxPerKey > 0 && s.Fingerprint != "" {
+		count := 0
+		for _, other := range r.sessions {
+			if other.Fingerprint == s.Fingerprint {
+				count++
+			}
+		}
+		if count >= r.MaxPerKey {
+			return nil, fmt.Errorf("too many sessions for this key (max %d)", r.MaxPerKey)
+		}
+	}
+	// IDs are short enough to type, so they can collide; draw until free
+	for s.ID == "" || r.sessions[s.ID] != nil {
+		s.ID = newID()
+	}
+	r.sessions[s.ID] = s
+	return s, nil
+}
+
+// Remove unregisters a session. Removing it again is a no-op.
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	delete(r.sessions, id)
+	r.mu.Unlock()
+}
+
+// List returns all live sessions, oldest first
+func (r *Registry) List() []Info {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]Info, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		out = append(out, s.Info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// Get returns a live session by ID
+func (r *Registry) Get(id string) (*Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// Kill closes the SSH connection carrying the session, ending every session
+// on it. The handler's Remove cleans up the registry entry.
+func (r *Registry) Kill(id string) error {
+	s, ok := r.Get(id)
+	if !ok {
+		return ErrNotFound
+	}
+	if conn, ok := s.sess.Context().Value(ssh.ContextKeyConn).(gossh.Conn); ok {
+		return conn.Close()
+	}
+	return s.sess.Close()
+}
+
+func (s *Session) Info() Info {
+	return Info{
+		ID:          s.ID,
+		UserID:      s.UserID,
+		Fingerprint: s.Fingerprint,
+		RemoteIP:    s.RemoteIP,
+		Target:      s.Target,
+		Started:     s.Started,
+		BytesIn:     s.bytesIn.Load(),
+		BytesOut:    s.bytesOut.Load(),
+	}
+}
+
+// Wrap returns sess with its traffic counted towards this session
+func (s *Session) Wrap(sess ssh.Session) ssh.Session {
+	return &countingSession{Session: sess, s: s}
+}
+
+type countingSession struct {
+	ssh.Session
+	s *Session
+}
+
+// IDOf returns the registry ID of a session passed through Wrap, or ""
+func IDOf(sess ssh.Session) string {
+	if c, ok := sess.(*countingSession); ok {
+		return c.s.ID
+	}
+	return ""
+}
+
+func (c *countingSession) Read(p []byte) (int, error) {
+	n, err := c.Session.Read(p)
+	c.s.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *countingSession) Write(p []byte) (int, error) {
+	n, err := c.Session.Write(p)
+	c.s.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (c *countingSession) Stderr() io.ReadWriter {
+	return &countingStderr{ReadWriter: c.Session.Stderr(), s: c.s}
+}
+
+type countingStderr struct {
+	io.ReadWriter
+	s *Session
+}
+
+func (c *countingStderr) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.s.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// newID returns a random session ID. Tests replace it to force collisions.
+var newID = func() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,124 @@
+package sessions
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// fakeContext carries only the values the authenticator sets
+type fakeContext struct {
+	ssh.Context
+	values map[string]interface{}
+}
+
+func (c fakeContext) Value(key interface{}) interface{} {
+	if k, ok := key.(string); ok {
+		return c.values[k]
+	}
+	return nil
+}
+
+type fakeSession struct {
+	ssh.Session
+	ctx fakeContext
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (s *fakeSession) Context() ssh.Context        { return s.ctx }
+func (s *fakeSession) Read(p []byte) (int, error)  { return s.in.Read(p) }
+func (s *fakeSession) Write(p []byte) (int, error) { return s.out.Write(p) }
+func (s *fakeSession) Stderr() io.ReadWriter       { return &s.out }
+
+func newFakeSession(userID int, fingerprint string) *fakeSession {
+	return &fakeSession{
+		ctx: fakeContext{values: map[string]interface{}{"user_id": userID, "fingerprint": fingerprint}},
+		in:  bytes.NewReader([]byte("hello")),
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry(2)
+
+	a, err := reg.Add(newFakeSession(1, "SHA256:a"), "cli")
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if _, err := reg.Add(newFakeSession(1, "SHA256:a"), "bloggy"); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if _, err := reg.Add(newFakeSession(1, "SHA256:a"), "cli"); err == nil {
+		t.Error("Expected 3rd session for the same key to be refused")
+	}
+	if _, err := reg.Add(newFakeSession(2, "SHA256:b"), "cli"); err != nil {
+		t.Errorf("Other keys should not count towards the cap: %v", err)
+	}
+
+	// Removing twice only frees one slot
+	reg.Remove(a.ID)
+	reg.Remove(a.ID)
+	if len(reg.List()) != 2 {
+		t.Errorf("Expected 2 sessions, got %d", len(reg.List()))
+	}
+	if _, err := reg.Add(newFakeSession(1, "SHA256:a"), "cli"); err != nil {
+		t.Errorf("Expected a slot after Remove: %v", err)
+	}
+	if _, err := reg.Add(newFakeSession(1, "SHA256:a"), "cli"); err == nil {
+		t.Error("Expected cap to hold after double Remove")
+	}
+
+	if err := reg.Kill("nope"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRegistryIDCollision(t *testing.T) {
+	ids := []string{"0000beef", "0000beef", "0000beef", "0000cafe"}
+	defer func(orig func() string) { newID = orig }(newID)
+	newID = func() string {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}
+
+	reg := NewRegistry(0)
+	a, err := reg.Add(newFakeSession(1, "SHA256:a"), "cli")
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	b, err := reg.Add(newFakeSession(2, "SHA256:b"), "cli")
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if a.ID != "0000beef" || b.ID != "0000cafe" {
+		t.Errorf("Expected a taken ID to be drawn again, got %s and %s", a.ID, b.ID)
+	}
+	if s, _ := reg.Get(a.ID); s != a {
+		t.Error("Expected the first session to keep its ID")
+	}
+	if len(reg.List()) != 2 {
+		t.Errorf("Expected 2 sessions, got %d", len(reg.List()))
+	}
+}
+
+func TestWrapCountsBytes(t *testing.T) {
+	reg := NewRegistry(0)
+	fake := newFakeSession(1, "SHA256:a")
+	s, _ := reg.Add(fake, "cli")
+	wrapped := s.Wrap(fake)
+
+	io.ReadAll(wrapped)
+	wrapped.Write([]byte("abc"))
+	wrapped.Stderr().Write([]byte("de"))
+
+	info := s.Info()
+	if info.BytesIn != 5 || info.BytesOut != 5 {
+		t.Errorf("Expected 5 bytes in and out, got %d/%d", info.BytesIn, info.BytesOut)
+	}
+	if IDOf(wrapped) != s.ID {
+		t.Errorf("IDOf = %q, want %q", IDOf(wrapped), s.ID)
+	}
+}
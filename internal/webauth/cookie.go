@@ -0,0 +1,54 @@
+package webauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadCookie = errors.New("invalid or expired session cookie")
+
+// cookieSigner produces tamper-proof "email|expiry" session values
+type cookieSigner struct {
+	key []byte
+}
+
+func (s cookieSigner) sign(email string, expires time.Time) string {
+	payload := email + "|" + strconv.FormatInt(expires.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + s.mac(payload)
+}
+
+func (s cookieSigner) verify(value string, now time.Time) (string, error) {
+	encoded, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", errBadCookie
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errBadCookie
+	}
+	payload := string(raw)
+	if !hmac.Equal([]byte(sig), []byte(s.mac(payload))) {
+		return "", errBadCookie
+	}
+
+	email, expiry, ok := strings.Cut(payload, "|")
+	if !ok {
+		return "", errBadCookie
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.After(time.Unix(unix, 0)) {
+		return "", errBadCookie
+	}
+	return email, nil
+}
+
+func (s cookieSigner) mac(payload string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,31 @@
+package webauth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCookieSigner(t *testing.T) {
+	s := cookieSigner{key: []byte("test-key")}
+	now := time.Now()
+	value := s.sign("dev@example.com", now.Add(time.Hour))
+
+	email, err := s.verify(value, now)
+	if err != nil || email != "dev@example.com" {
+		t.Fatalf("Expected valid cookie for dev@example.com, got %q, %v", email, err)
+	}
+
+	if _, err := s.verify(value, now.Add(2*time.Hour)); err == nil {
+		t.Error("Expired cookie should be rejected")
+	}
+
+	other := cookieSigner{key: []byte("other-key")}
+	if _, err := other.verify(value, now); err == nil {
+		t.Error("Cookie signed with another key should be rejected")
+	}
+
+	forged := s.sign("attacker@example.com", now.Add(time.Hour))
+	if _, err := s.verify(forged[:len(forged)-2]+value[len(value)-2:], now); err == nil {
+		t.Error("Tampered cookie should be rejected")
+	}
+}
@@ -0,0 +1,34 @@
+package webauth
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/rnzor/poor_man_exe/internal/config"
+)
+
+// sendMagicLink emails a login link through the configured SMTP server
+func sendMagicLink(cfg *config.Config, to, link string) error {
+	addr := fmt.Sprintf("%s:%d", cfg.SMTPHost, cfg.SMTPPort)
+
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPass, cfg.SMTPHost)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + cfg.SMTPFrom,
+		"To: " + to,
+		"Subject: Your login link for " + cfg.Domain,
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"Click the link below to log in. It expires in 15 minutes and can only be used once.",
+		"",
+		link,
+		"",
+		"If you did not request this, you can ignore this email.",
+	}, "\r\n")
+
+	return smtp.SendMail(addr, auth, cfg.SMTPFrom, []string{to}, []byte(msg))
+}
@@ -0,0 +1,62 @@
+package webauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+// LoginTokenTTL is how long a magic link or SSH-issued login URL stays valid
+const LoginTokenTTL = 15 * time.Minute
+
+var errBadToken = errors.New("login link is invalid, expired or already used")
+
+// IssueLoginToken creates a single-use login token for email. Only its hash
+// is stored, so a leaked database cannot be used to log in.
+func IssueLoginToken(d *db.Database, email string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	expires := time.Now().UTC().Add(LoginTokenTTL).Format("2006-01-02 15:04:05")
+	_, err := d.Conn.Exec("INSERT INTO login_tokens (token_hash, email, expires_at) VALUES (?, ?, ?)",
+		hashToken(token), email, expires)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeLoginToken marks a token used and returns the email it was issued for
+func consumeLoginToken(d *db.Database, token string) (string, error) {
+	hash := hashToken(token)
+	result, err := d.Conn.Exec(
+		"UPDATE login_tokens SET used_at = CURRENT_TIMESTAMP WHERE token_hash = ? AND used_at IS NULL AND expires_at > datetime('now')",
+		hash,
+	)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", errBadToken
+	}
+
+	var email string
+	err = d.Conn.QueryRow("SELECT email FROM login_tokens WHERE token_hash = ?", hash).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", errBadToken
+	}
+	return email, err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
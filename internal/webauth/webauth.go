@@ -0,0 +1,236 @@
+package webauth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rnzor/poor_man_exe/internal/caddy"
+	"github.com/rnzor/poor_man_exe/internal/config"
+	"github.com/rnzor/poor_man_exe/internal/db"
+)
+
+const (
+	cookieName = caddy.AuthCookie
+	cookieTTL  = 7 * 24 * time.Hour
+)
+
+// Server implements Caddy's forward_auth endpoint for private apps and the
+// login flow that issues the session cookie it checks.
+type Server struct {
+	DB     *db.Database
+	Cfg    *config.Config
+	signer cookieSigner
+}
+
+func NewServer(d *db.Database, cfg *config.Config) *Server {
+	key := []byte(cfg.AuthSecret)
+	if len(key) == 0 {
+		log.Printf("Warning: AUTH_SECRET not set, login sessions will not survive restarts")
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &Server{DB: d, Cfg: cfg, signer: cookieSigner{key: key}}
+}
+
+// Register mounts the auth endpoints on mux
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/auth/verify", s.handleVerify)
+	mux.HandleFunc("/auth/login", s.handleLogin)
+	mux.HandleFunc("/auth/callback", s.handleCallback)
+	mux.HandleFunc("/auth/logout", s.handleLogout)
+}
+
+// LoginURL returns the one-time login link for token, landing on redirect
+func LoginURL(cfg *config.Config, token, redirect string) string {
+	q := url.Values{"token": {token}}
+	if redirect != "" {
+		q.Set("rd", redirect)
+	}
+	return "https://" + cfg.AuthHost + "/auth/callback?" + q.Encode()
+}
+
+// handleVerify is called by Caddy before every request to a private app.
+// 200 lets the request through; anything else is returned to the browser.
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	host := stripPort(r.Header.Get("X-Forwarded-Host"))
+	appName, ok := strings.CutSuffix(host, "."+s.Cfg.Domain)
+	if !ok || appName == "" {
+		http.Error(w, "unknown host", http.StatusForbidden)
+		return
+	}
+
+	var appID int
+	var isPublic bool
+	var ownerEmail sql.NullString
+	err := s.DB.Conn.QueryRow(
+		"SELECT a.id, a.is_public, u.email FROM apps a LEFT JOIN users u ON u.id = a.user_id WHERE a.name = ?",
+		appName,
+	).Scan(&appID, &isPublic, &ownerEmail)
+	if err != nil {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	if isPublic {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	email := ""
+	if c, err := r.Cookie(cookieName); err == nil {
+		email, _ = s.signer.verify(c.Value, time.Now())
+	}
+	if email == "" {
+		original := "https://" + host + r.Header.Get("X-Forwarded-Uri")
+		http.Redirect(w, r, "https://"+s.Cfg.AuthHost+"/auth/login?rd="+url.QueryEscape(original), http.StatusFound)
+		return
+	}
+
+	if !s.canAccess(appID, ownerEmail.String, email) {
+		http.Error(w, "You ("+email+") do not have access to this app.", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set(caddy.UserHeader, email)
+	w.WriteHeader(http.StatusOK)
+}
+
+// canAccess allows the app owner, members of the app's org and anyone on
+// its app_shares allowlist
+func (s *Server) canAccess(appID int, ownerEmail, email string) bool {
+	if strings.EqualFold(ownerEmail, email) {
+		return true
+	}
+	var shared bool
+	s.DB.Conn.QueryRow(`SELECT EXISTS(SELECT 1 FROM app_shares WHERE app_id = ? AND lower(email) = lower(?))
+		OR EXISTS(SELECT 1 FROM apps a JOIN org_members m ON m.org_id = a.org_id JOIN users u ON u.id = m.user_id
+			WHERE a.id = ? AND lower(u.email) = lower(?))`,
+		appID, email, appID, email,
+	).Scan(&shared)
+	return shared
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><title>Log in</title></head>
+<body style="font-family:sans-serif;max-width:28em;margin:4em auto">
+<h2>Log in to {{.Domain}}</h2>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .EmailEnabled}}
+<form method="post" action="/auth/login">
+  <input type="hidden" name="rd" value="{{.Redirect}}">
+  <input type="email" name="email" placeholder="you@example.com" required autofocus>
+  <button type="submit">Email me a login link</button>
+</form>
+{{end}}
+<p>Have SSH access? Run <code>ssh {{.Domain}} login</code> for a one-time login link.</p>
+</body></html>`))
+
+type loginPageData struct {
+	Domain       string
+	Redirect     string
+	Message      string
+	EmailEnabled bool
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	data := loginPageData{
+		Domain:       s.Cfg.Domain,
+		Redirect:     s.safeRedirect(r.FormValue("rd")),
+		EmailEnabled: s.Cfg.SMTPHost != "",
+	}
+
+	if r.Method == http.MethodPost && data.EmailEnabled {
+		email := strings.TrimSpace(r.FormValue("email"))
+		// Only mail addresses the platform knows about so the form can't be
+		// used to spam arbitrary inboxes. The reply is the same either way.
+		if email != "" && s.knownEmail(email) {
+			token, err := IssueLoginToken(s.DB, email)
+			if err == nil {
+				err = sendMagicLink(s.Cfg, email, LoginURL(s.Cfg, token, data.Redirect))
+			}
+			if err != nil {
+				log.Printf("Failed to send login link to %s: %v", email, err)
+			}
+		}
+		data.Message = "If that address has access to an app, a login link is on its way."
+		data.EmailEnabled = false
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	loginPage.Execute(w, data)
+}
+
+func (s *Server) knownEmail(email string) bool {
+	var known bool
+	s.DB.Conn.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM users WHERE lower(email) = lower(?)) OR EXISTS(SELECT 1 FROM app_shares WHERE lower(email) = lower(?))",
+		email, email,
+	).Scan(&known)
+	return known
+}
+
+func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
+	email, err := consumeLoginToken(s.DB, r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	clientIP, _, _ := strings.Cut(r.Header.Get("X-Forwarded-For"), ",")
+	s.DB.LogAudit("web_login", 0, "", strings.TrimSpace(clientIP), "email="+email)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    s.signer.sign(email, time.Now().Add(cookieTTL)),
+		Domain:   s.Cfg.Domain,
+		Path:     "/",
+		MaxAge:   int(cookieTTL.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	redirect := s.safeRedirect(r.URL.Query().Get("rd"))
+	if redirect == "" {
+		w.Write([]byte("Logged in as " + email + ". You can now open your apps.\n"))
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieName,
+		Value:  "",
+		Domain: s.Cfg.Domain,
+		Path:   "/",
+		MaxAge: -1,
+	})
+	w.Write([]byte("Logged out.\n"))
+}
+
+// safeRedirect only allows https redirects back to hosts under the platform
+// domain
+func (s *Server) safeRedirect(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" {
+		return ""
+	}
+	host := u.Hostname()
+	if host != s.Cfg.Domain && !strings.HasSuffix(host, "."+s.Cfg.Domain) {
+		return ""
+	}
+	return u.String()
+}
+
+func stripPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
@@ -0,0 +1,25 @@
+package webauth
+
+import (
+	"testing"
+
+	"github.com/rnzor/poor_man_exe/internal/config"
+)
+
+func TestSafeRedirect(t *testing.T) {
+	s := &Server{Cfg: &config.Config{Domain: "example.com"}}
+	tests := map[string]string{
+		"https://blog.example.com/posts?id=1": "https://blog.example.com/posts?id=1",
+		"https://example.com/":                "https://example.com/",
+		"http://blog.example.com/":            "",
+		"javascript:alert(1)":                 "",
+		"https://evil.com/":                   "",
+		"https://blog.example.com.evil.com/":  "",
+		"//blog.example.com/":                 "",
+	}
+	for in, want := range tests {
+		if got := s.safeRedirect(in); got != want {
+			t.Errorf("safeRedirect(%q) = %q, want %q", in, got, want)
+		}
+	}
+}